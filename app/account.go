@@ -0,0 +1,445 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/scylladb/gocqlx/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var ErrUserExists = errors.New("username or email is already taken")
+
+type ChangePassword struct {
+	CurrentPassword string `form:"currentPassword" json:"currentPassword" validate:"required,min=8,max=50"`
+	Password        string `form:"password" json:"password" validate:"required,eqfield=ConfirmPassword,min=8,max=50"`
+	ConfirmPassword string `form:"confirmPassword" json:"confirmPassword" validate:"required,min=8,max=50"`
+}
+
+type ChangeEmail struct {
+	Email    string `form:"email" json:"email" validate:"required,email,max=50"`
+	Password string `form:"password" json:"password" validate:"required,min=8,max=50"`
+}
+
+type ChangeUsername struct {
+	Username string `form:"username" json:"username" validate:"required,min=3,max=30,excludesall=[]"`
+}
+
+// every postgres column that holds a username, they all have to be
+// updated when a user changes theirs
+var usernameColumns = []struct {
+	Table  string
+	Column string
+}{
+	{"Users", "username"},
+	{"UserSessions", "username"},
+	{"PasswordResets", "username"},
+	{"EmailVerifications", "username"},
+	{"ApiTokens", "username"},
+	{"TwoFactor", "username"},
+	{"RecoveryCodes", "username"},
+	{"LoginChallenges", "username"},
+	{"UserIdentities", "username"},
+	{"Invites", "creator"},
+	{"UserInvites", "inviter"},
+	{"UserInvites", "invitee"},
+	{"Rooms", "owner"},
+	{"AccountJobs", "username"},
+	{"SecurityEvents", "username"},
+	{"PreviousUsernames", "username"},
+}
+
+// sends a verification link to the new email. the user's email only
+// changes once the link is followed
+func (app App) requestEmailChange(ctx context.Context, username string, email string) error {
+	emailExists, _ := app.checkUserExists(ctx, email, "")
+	if emailExists {
+		return ErrUserExists
+	}
+
+	// links sent to other addresses shouldn't be able to change it back
+	_, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE EmailVerifications SET used = true WHERE username=$1 AND NOT used`,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error invalidating email verifications: ", err)
+		return err
+	}
+
+	return app.sendVerification(ctx, username, email)
+}
+
+// moves the user's rows in the scylla users table to the new username
+// and returns a function that removes the old ones
+func renameScyllaUser(ctx context.Context, session gocqlx.Session, oldUsername string, newUsername string) (func() error, error) {
+	stmt := "SELECT user, current_chatroom, chatroom FROM users WHERE user = ?;"
+	query := session.Query(stmt, []string{"user"})
+	query.Bind(oldUsername)
+
+	var rows []UserChatrooms
+	err := query.SelectRelease(&rows)
+	if err != nil {
+		Sugar.Error("Error finding all chatrooms for user: ", err)
+		return nil, err
+	}
+
+	for _, row := range rows {
+		row.User = newUsername
+		err = session.Query(userTable.Insert()).BindStruct(row).ExecRelease()
+		if err != nil {
+			Sugar.Error("Error copying chatroom for renamed user: ", err)
+			return nil, err
+		}
+	}
+
+	removeOld := func() error {
+		query := session.Query("DELETE FROM users WHERE user = ?;", []string{"user"})
+		query.Bind(oldUsername)
+		return query.ExecRelease()
+	}
+	return removeOld, nil
+}
+
+// updates the author of the user's messages in the rooms they are in
+func renameMessageAuthor(ctx context.Context, session gocqlx.Session, rooms []string, oldUsername string, newUsername string) error {
+	for _, room := range rooms {
+		// filtering is only done within the room's partition
+		stmt := "SELECT message_id FROM messages WHERE chatroom_name = ? AND user_id = ? ALLOW FILTERING;"
+		query := session.Query(stmt, []string{"chatroom_name", "user_id"})
+		query.Bind(room, oldUsername)
+
+		var messageIds []int64
+		err := query.SelectRelease(&messageIds)
+		if err != nil {
+			Sugar.Error("Error finding messages of renamed user: ", err)
+			return err
+		}
+
+		for _, messageId := range messageIds {
+			stmt := "UPDATE messages SET user_id = ? WHERE chatroom_name = ? AND message_id = ?;"
+			query := session.Query(stmt, []string{"user_id", "chatroom_name", "message_id"})
+			query.Bind(newUsername, room, messageId)
+			err = query.ExecRelease()
+			if err != nil {
+				Sugar.Error("Error renaming message author: ", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// changes the username everywhere it is stored. scylla has no transactions
+// so the new rows are written before the postgres changes are committed
+// and the old ones are only removed after. messages are only moved to the new
+// name in the rooms the user is still in, so the old name is kept for the user
+// and no one else can take it and pass as the author of the rest
+func (app App) renameUser(ctx context.Context, oldUsername string, newUsername string) error {
+	tx, err := app.Pg.BeginTx(ctx, nil)
+	if err != nil {
+		Sugar.Error("error starting transaction: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// stops two users from taking the same name at once
+	_, err = tx.ExecContext(ctx, `LOCK TABLE Users IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		Sugar.Error("error locking users table: ", err)
+		return err
+	}
+	// users can go back to a name they had before
+	var taken bool
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM Users WHERE username=$1)
+		OR EXISTS (SELECT 1 FROM PreviousUsernames WHERE previous=$1 AND username<>$2)`,
+		newUsername,
+		oldUsername,
+	).Scan(&taken)
+	if err != nil {
+		Sugar.Error("error checking username: ", err)
+		return err
+	}
+	if taken {
+		return ErrUserExists
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM PreviousUsernames WHERE previous=$1`, newUsername)
+	if err != nil {
+		Sugar.Error("error releasing previous username: ", err)
+		return err
+	}
+
+	for _, column := range usernameColumns {
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf(`UPDATE %s SET %s=$1 WHERE %s=$2`, column.Table, column.Column, column.Column),
+			newUsername,
+			oldUsername,
+		)
+		if err != nil {
+			Sugar.Errorf("error renaming user in %v: %v", column.Table, err)
+			return err
+		}
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO PreviousUsernames (previous, username) VALUES ($1, $2)`,
+		oldUsername,
+		newUsername,
+	)
+	if err != nil {
+		Sugar.Error("error keeping previous username: ", err)
+		return err
+	}
+
+	rooms, err := getUserChatrooms(ctx, app.ScyllaDb, oldUsername)
+	if err != nil && err.Error() != "not found" {
+		return err
+	}
+	removeOld, err := renameScyllaUser(ctx, app.ScyllaDb, oldUsername, newUsername)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		Sugar.Error("error committing rename: ", err)
+		return err
+	}
+
+	err = removeOld()
+	if err != nil {
+		Sugar.Error("Error removing chatrooms of old username: ", err)
+		return err
+	}
+	err = renameMessageAuthor(ctx, app.ScyllaDb, rooms, oldUsername, newUsername)
+	if err != nil {
+		return err
+	}
+
+	app.publish(ctx, BrokerEvent{Kind: BrokerRenamed, User: oldUsername, NewName: newUsername})
+
+	return nil
+}
+
+func (app App) ChangePassword(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ChangePassword")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for change password: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form ChangePassword
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	auth, _ := authFromContext(ctx)
+	err = app.checkPassword(ctx, auth.Username, form.CurrentPassword, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many wrong passwords.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_attempts",
+			Detail: "Too many wrong passwords, try again later",
+		})
+		return
+	} else if err == ErrInvalidCredentials {
+		span.SetStatus(codes.Ok, "Incorrect password.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{
+			Code:   "invalid_credentials",
+			Detail: "Current password is incorrect",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking password.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	err = app.setPassword(ctx, auth.Username, form.Password)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error setting password.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	// anyone else logged in with the old password is logged out
+	err = app.revokeOtherSessions(ctx, auth.Username, auth.SessionId)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error revoking other sessions.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Password changed.")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app App) ChangeEmail(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ChangeEmail")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for change email: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form ChangeEmail
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	username := currentUser(req)
+	err = app.checkPassword(ctx, username, form.Password, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many wrong passwords.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_attempts",
+			Detail: "Too many wrong passwords, try again later",
+		})
+		return
+	} else if err == ErrInvalidCredentials {
+		span.SetStatus(codes.Ok, "Incorrect password.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{
+			Code:   "invalid_credentials",
+			Detail: "Password is incorrect",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking password.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	err = app.requestEmailChange(ctx, username, form.Email)
+	if err == ErrUserExists {
+		span.SetStatus(codes.Ok, "Email already exists.")
+		writeError(w, req, http.StatusConflict, ErrorResponse{
+			Code:   "user_exists",
+			Fields: []FieldError{{Field: "email", Code: "exists"}},
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error requesting email change.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Email change requested.")
+	writeJSON(w, http.StatusAccepted, struct {
+		PendingEmail string `json:"pending_email"`
+	}{form.Email})
+}
+
+func (app App) ChangeUsername(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ChangeUsername")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for change username: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form ChangeUsername
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	auth, _ := authFromContext(ctx)
+	err = app.renameUser(ctx, auth.Username, form.Username)
+	if err == ErrUserExists {
+		span.SetStatus(codes.Ok, "Username already exists.")
+		writeError(w, req, http.StatusConflict, ErrorResponse{
+			Code:   "user_exists",
+			Fields: []FieldError{{Field: "username", Code: "exists"}},
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error renaming user.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	// other sessions still hold the old username so they have to log in again
+	err = app.revokeOtherSessions(ctx, form.Username, auth.SessionId)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error revoking other sessions.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	session, err := app.PgStore.Get(req, "session-name")
+	if err == nil {
+		session.Values["username"] = form.Username
+		err = session.Save(req, w)
+	}
+	if err != nil {
+		Sugar.Error("error saving renamed session: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error saving session.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Username changed.")
+	writeJSON(w, http.StatusOK, struct {
+		Username string `json:"username"`
+	}{form.Username})
+}
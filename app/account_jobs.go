@@ -0,0 +1,647 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/scylladb/gocqlx/v2"
+	"github.com/sony/sonyflake"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	AccountJobExport = "export"
+	AccountJobDelete = "delete"
+
+	AccountJobPending = "pending"
+	AccountJobRunning = "running"
+	AccountJobDone    = "done"
+	AccountJobFailed  = "failed"
+)
+
+// what happens to a user's messages when they delete their account
+type MessageDeletionPolicy string
+
+const (
+	DeleteMessages MessageDeletionPolicy = "delete"
+	// keeps the messages so conversations still make sense but
+	// removes who wrote them
+	AnonymizeMessages MessageDeletionPolicy = "anonymize"
+)
+
+// shown as the author of anonymized messages. usernames can't contain
+// brackets so no one can sign up with it
+const deletedUserId = "[deleted]"
+
+var ErrAccountJobNotFound = errors.New("account job not found")
+
+type AccountJob struct {
+	// random so the status of a deletion can still be checked after
+	// the user and their sessions are gone
+	Id       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished"`
+	username string
+}
+
+type DeleteAccount struct {
+	Password string `form:"password" json:"password" validate:"required,min=8,max=50"`
+	// only needed when two factor authentication is enabled
+	Code string `form:"code" json:"code" validate:"max=20"`
+}
+
+type AccountExport struct {
+	ExportedAt  time.Time          `json:"exported_at"`
+	Profile     ExportProfile      `json:"profile"`
+	Memberships []ExportMembership `json:"memberships"`
+	Messages    []ExportMessage    `json:"messages"`
+}
+
+type ExportProfile struct {
+	Username         string           `json:"username"`
+	Email            string           `json:"email"`
+	Verified         bool             `json:"verified"`
+	TwoFactorEnabled bool             `json:"two_factor_enabled"`
+	Identities       []ExportIdentity `json:"identities"`
+	ApiTokens        []ApiToken       `json:"api_tokens"`
+}
+
+type ExportIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Email   string `json:"email"`
+}
+
+type ExportMembership struct {
+	Room    string `json:"room"`
+	Owner   bool   `json:"owner"`
+	Current bool   `json:"current"`
+}
+
+type ExportMessage struct {
+	Room      string    `json:"room"`
+	MessageId uint64    `json:"message_id,string"`
+	Content   string    `json:"content"`
+	Sent      time.Time `json:"sent"`
+}
+
+const accountJobColumns = `id, username, kind, status, error, created, finished`
+
+func scanAccountJob(row interface{ Scan(...interface{}) error }) (AccountJob, error) {
+	var job AccountJob
+	var finished sql.NullTime
+	err := row.Scan(&job.Id, &job.username, &job.Kind, &job.Status, &job.Error, &job.Created, &finished)
+	if finished.Valid {
+		job.Finished = &finished.Time
+	}
+	return job, err
+}
+
+// queues a job for the user unless one of the same kind is still unfinished,
+// in which case that one is returned
+func (app App) createAccountJob(ctx context.Context, username string, kind string) (AccountJob, bool, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT `+accountJobColumns+` FROM AccountJobs
+		WHERE username=$1 AND kind=$2 AND status IN ('pending', 'running')`,
+		username,
+		kind,
+	)
+	job, err := scanAccountJob(row)
+	if err == nil {
+		return job, false, nil
+	} else if err != sql.ErrNoRows {
+		Sugar.Error("error getting account job: ", err)
+		return AccountJob{}, false, err
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		return AccountJob{}, false, err
+	}
+	row = app.Pg.QueryRowContext(
+		ctx,
+		`INSERT INTO AccountJobs (id, username, kind) VALUES ($1, $2, $3)
+		RETURNING `+accountJobColumns,
+		id,
+		username,
+		kind,
+	)
+	job, err = scanAccountJob(row)
+	if err != nil {
+		Sugar.Error("error inserting account job: ", err)
+		return AccountJob{}, false, err
+	}
+	return job, true, nil
+}
+
+func (app App) getAccountJob(ctx context.Context, id string) (AccountJob, error) {
+	row := app.Pg.QueryRowContext(ctx, `SELECT `+accountJobColumns+` FROM AccountJobs WHERE id=$1`, id)
+	job, err := scanAccountJob(row)
+	if err == sql.ErrNoRows {
+		return AccountJob{}, ErrAccountJobNotFound
+	} else if err != nil {
+		Sugar.Error("error getting account job: ", err)
+	}
+	return job, err
+}
+
+func (app App) userAccountJobs(ctx context.Context, username string) ([]AccountJob, error) {
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT `+accountJobColumns+` FROM AccountJobs WHERE username=$1 ORDER BY created DESC`,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error querying account jobs: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []AccountJob{}
+	for rows.Next() {
+		job, err := scanAccountJob(rows)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// runs the job in the background, recording whether it worked
+// a job interrupted by shutdown can't record that it finished, so it's still
+// running when the server starts again and is resumed then
+func (app App) runAccountJob(ctx context.Context, job AccountJob) {
+	ctx, span := otel.Tracer("").Start(ctx, "AccountJob "+job.Kind)
+	defer span.End()
+
+	_, err := app.Pg.ExecContext(ctx, `UPDATE AccountJobs SET status=$2 WHERE id=$1`, job.Id, AccountJobRunning)
+	if err != nil {
+		Sugar.Error("error starting account job: ", err)
+		span.RecordError(err)
+		return
+	}
+
+	var result sql.NullString
+	switch job.Kind {
+	case AccountJobExport:
+		var archive []byte
+		archive, err = app.exportAccount(ctx, job.username)
+		result = sql.NullString{String: string(archive), Valid: err == nil}
+	case AccountJobDelete:
+		err = app.deleteAccount(ctx, job.username)
+	default:
+		err = fmt.Errorf("unknown account job %q", job.Kind)
+	}
+
+	status := AccountJobDone
+	errorMessage := ""
+	if err != nil {
+		Sugar.Errorf("account job %v for %v failed: %v", job.Kind, job.username, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Account job failed.")
+		status = AccountJobFailed
+		errorMessage = err.Error()
+	} else {
+		span.SetStatus(codes.Ok, "Account job done.")
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`UPDATE AccountJobs SET status=$2, error=$3, result=$4, finished=now() WHERE id=$1`,
+		job.Id,
+		status,
+		errorMessage,
+		result,
+	)
+	if err != nil {
+		Sugar.Error("error finishing account job: ", err)
+		span.RecordError(err)
+	}
+}
+
+// starts jobs that were queued or interrupted when the server stopped
+func (app App) resumeAccountJobs(ctx context.Context) {
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT `+accountJobColumns+` FROM AccountJobs WHERE status IN ('pending', 'running')`,
+	)
+	if err != nil {
+		Sugar.Error("error querying unfinished account jobs: ", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		job, err := scanAccountJob(rows)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			return
+		}
+		app.startAccountJob(job)
+	}
+}
+
+func (app App) startAccountJob(job AccountJob) {
+	app.Background.Go(func(ctx context.Context) {
+		app.runAccountJob(ctx, job)
+	})
+}
+
+// the messages the user wrote in the rooms
+func userMessages(ctx context.Context, session gocqlx.Session, rooms []string, username string) ([]Message, error) {
+	var messages []Message
+	for _, room := range rooms {
+		// filtering is only done within the room's partition
+		stmt := "SELECT * FROM messages WHERE chatroom_name = ? AND user_id = ? ALLOW FILTERING;"
+		query := session.Query(stmt, []string{"chatroom_name", "user_id"})
+		query.Bind(room, username)
+
+		var roomMessages []Message
+		err := query.SelectRelease(&roomMessages)
+		if err != nil {
+			Sugar.Error("Error finding messages of user: ", err)
+			return nil, err
+		}
+		messages = append(messages, roomMessages...)
+	}
+	return messages, nil
+}
+
+// collects everything stored about the user into a json archive
+func (app App) exportAccount(ctx context.Context, username string) ([]byte, error) {
+	export := AccountExport{
+		ExportedAt:  time.Now().UTC(),
+		Profile:     ExportProfile{Username: username, Identities: []ExportIdentity{}},
+		Memberships: []ExportMembership{},
+		Messages:    []ExportMessage{},
+	}
+
+	row := app.Pg.QueryRowContext(ctx, `SELECT email, verified FROM Users WHERE username=$1`, username)
+	err := row.Scan(&export.Profile.Email, &export.Profile.Verified)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	export.Profile.TwoFactorEnabled, err = app.twoFactorEnabled(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	export.Profile.ApiTokens, err = app.userTokens(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT issuer, subject, email FROM UserIdentities WHERE username=$1`,
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var identity ExportIdentity
+		err = rows.Scan(&identity.Issuer, &identity.Subject, &identity.Email)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Profile.Identities = append(export.Profile.Identities, identity)
+	}
+	rows.Close()
+
+	rooms, err := getUserChatrooms(ctx, app.ScyllaDb, username)
+	if err != nil && err.Error() != "not found" {
+		return nil, err
+	}
+	currentRoom, err := getUserCurrentRoom(ctx, app.ScyllaDb, username)
+	if err != nil && err.Error() != "not found" {
+		return nil, err
+	}
+	for _, room := range rooms {
+		settings, err := app.getRoomSettings(room)
+		if err != nil && err != ErrRoomNotFound {
+			return nil, err
+		}
+		export.Memberships = append(export.Memberships, ExportMembership{
+			Room:    room,
+			Owner:   settings.Owner == username,
+			Current: room == currentRoom,
+		})
+	}
+
+	messages, err := userMessages(ctx, app.ScyllaDb, rooms, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		// sonyflake counts time in units of 10ms since the start time
+		elapsed := sonyflake.Decompose(message.MessageId)["time"]
+		export.Messages = append(export.Messages, ExportMessage{
+			Room:      message.ChatroomName,
+			MessageId: message.MessageId,
+			Content:   message.Content,
+			Sent:      time.Unix(0, 0).Add(time.Duration(elapsed) * time.Millisecond * 10).UTC(),
+		})
+	}
+
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// deletes or anonymizes the user's messages depending on the server's
+// policy and then removes everything else about them
+func (app App) deleteAccount(ctx context.Context, username string) error {
+	rooms, err := getUserChatrooms(ctx, app.ScyllaDb, username)
+	if err != nil && err.Error() != "not found" {
+		return err
+	}
+
+	if app.MessageDeletionPolicy == DeleteMessages {
+		messages, err := userMessages(ctx, app.ScyllaDb, rooms, username)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			stmt := "DELETE FROM messages WHERE chatroom_name = ? AND message_id = ?;"
+			query := app.ScyllaDb.Query(stmt, []string{"chatroom_name", "message_id"})
+			query.Bind(message.ChatroomName, message.MessageId)
+			err = query.ExecRelease()
+			if err != nil {
+				Sugar.Error("Error deleting message: ", err)
+				return err
+			}
+		}
+	} else {
+		err = renameMessageAuthor(ctx, app.ScyllaDb, rooms, username, deletedUserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := app.ScyllaDb.Query("DELETE FROM users WHERE user = ?;", []string{"user"})
+	query.Bind(username)
+	err = query.ExecRelease()
+	if err != nil {
+		Sugar.Error("Error deleting chatrooms of user: ", err)
+		return err
+	}
+
+	// http_sessions only knows the session id
+	err = app.revokeOtherSessions(ctx, username, "")
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.Pg.BeginTx(ctx, nil)
+	if err != nil {
+		Sugar.Error("error starting transaction: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		// invites they made stop working and their rooms go back to
+		// letting members decide, like rooms made before owners existed
+		`UPDATE Invites SET revoked = true, creator = '' WHERE creator=$1`,
+		`UPDATE Rooms SET owner = '' WHERE owner=$1`,
+		`DELETE FROM UserInvites WHERE inviter=$1 OR invitee=$1`,
+		`DELETE FROM AccountJobs WHERE username=$1 AND kind <> 'delete'`,
+		// messages in rooms they had left still show their old names
+		`UPDATE PreviousUsernames SET username = '' WHERE username=$1`,
+	}
+	for _, column := range usernameColumns {
+		if column.Table == "Invites" || column.Table == "Rooms" || column.Table == "UserInvites" || column.Table == "AccountJobs" || column.Table == "PreviousUsernames" {
+			continue
+		}
+		statements = append(statements, fmt.Sprintf(`DELETE FROM %s WHERE %s=$1`, column.Table, column.Column))
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement, username)
+		if err != nil {
+			Sugar.Errorf("error deleting user with %q: %v", statement, err)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		Sugar.Error("error committing account deletion: ", err)
+		return err
+	}
+
+	app.publish(ctx, BrokerEvent{Kind: BrokerAccountDeleted, User: username})
+
+	return nil
+}
+
+func writeAccountJob(w http.ResponseWriter, status int, job AccountJob) {
+	w.Header().Set("Location", "/api/v1/user/account/jobs/"+job.Id)
+	writeJSON(w, status, job)
+}
+
+func (app App) ExportAccount(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ExportAccount")
+	defer span.End()
+
+	job, created, err := app.createAccountJob(ctx, currentUser(req), AccountJobExport)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error creating export job.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if created {
+		app.startAccountJob(job)
+	}
+
+	span.SetStatus(codes.Ok, "Export job queued.")
+	writeAccountJob(w, http.StatusAccepted, job)
+}
+
+func (app App) DeleteAccount(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "DeleteAccount")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for delete account: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form DeleteAccount
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	username := currentUser(req)
+	err = app.checkPassword(ctx, username, form.Password, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many wrong passwords.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_attempts",
+			Detail: "Too many wrong passwords, try again later",
+		})
+		return
+	} else if err == ErrInvalidCredentials {
+		span.SetStatus(codes.Ok, "Incorrect password.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{
+			Code:   "invalid_credentials",
+			Detail: "Password is incorrect",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking password.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	twoFactor, err := app.twoFactorEnabled(ctx, username)
+	if err == nil && twoFactor {
+		err = app.checkSecondFactor(ctx, username, form.Code)
+	}
+	if err == ErrInvalidTwoFactorCode {
+		span.SetStatus(codes.Ok, "Invalid two factor code.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_code"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking two factor code.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	job, _, err := app.createAccountJob(ctx, username, AccountJobDelete)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error creating delete job.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	// nobody can log in while the job runs
+	_, err = app.Pg.ExecContext(ctx, `UPDATE Users SET password='' WHERE username=$1`, username)
+	if err == nil {
+		err = app.revokeOtherSessions(ctx, username, "")
+	}
+	if err != nil {
+		Sugar.Error("error disabling deleted account: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error disabling account.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	app.startAccountJob(job)
+
+	span.SetStatus(codes.Ok, "Delete job queued.")
+	writeAccountJob(w, http.StatusAccepted, job)
+}
+
+func (app App) ListAccountJobs(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ListAccountJobs")
+	defer span.End()
+
+	jobs, err := app.userAccountJobs(ctx, currentUser(req))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error listing account jobs.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// anyone with the job's id can see its status, which is how a deleted
+// user finds out their account is gone
+func (app App) GetAccountJob(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "GetAccountJob")
+	defer span.End()
+
+	job, err := app.getAccountJob(ctx, chi.URLParam(req, "id"))
+	if err == ErrAccountJobNotFound {
+		span.SetStatus(codes.Ok, "Account job not found.")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "job_not_found"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error getting account job.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (app App) DownloadAccountExport(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "DownloadAccountExport")
+	defer span.End()
+
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT status, result FROM AccountJobs WHERE id=$1 AND username=$2 AND kind=$3`,
+		chi.URLParam(req, "id"),
+		currentUser(req),
+		AccountJobExport,
+	)
+	var status string
+	var result sql.NullString
+	err := row.Scan(&status, &result)
+	if err == sql.ErrNoRows {
+		span.SetStatus(codes.Ok, "Export not found.")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "job_not_found"})
+		return
+	} else if err != nil {
+		Sugar.Error("error getting account export: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error getting account export.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	if status != AccountJobDone || !result.Valid {
+		span.SetStatus(codes.Ok, "Export not ready.")
+		writeError(w, req, http.StatusConflict, ErrorResponse{
+			Code:   "export_not_ready",
+			Detail: "The export is " + status,
+		})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="chat-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(result.String))
+}
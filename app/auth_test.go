@@ -1,10 +1,20 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"nhooyr.io/websocket"
 )
 
 func TestSignup(t *testing.T) {
@@ -191,3 +201,1222 @@ func TestLogoutWithoutLogin(t *testing.T) {
 	}
 
 }
+
+func TestSignupJSONValidation(t *testing.T) {
+	server, client, err := serverSetup()
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	body := `{"email": "not an email", "username": "art", "password": "secretpassy", "confirmPassword": "different"}`
+	res, err := client.Post(server.URL+"/api/auth/signup", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Received status code %v, wanted %v", res.StatusCode, http.StatusBadRequest)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Error response had content type %v, wanted application/problem+json", contentType)
+	}
+	var errorResponse ErrorResponse
+	err = json.NewDecoder(res.Body).Decode(&errorResponse)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding error response: %v", err)
+	}
+	if errorResponse.Code != "validation_failed" || errorResponse.Status != http.StatusBadRequest {
+		t.Errorf("Error response had code %v and status %v, wanted validation_failed and %v",
+			errorResponse.Code, errorResponse.Status, http.StatusBadRequest)
+	}
+	if errorResponse.RequestId == "" || errorResponse.RequestId != res.Header.Get("X-Request-Id") {
+		t.Errorf("Error response had request id %q, wanted the X-Request-Id header %q",
+			errorResponse.RequestId, res.Header.Get("X-Request-Id"))
+	}
+
+	fields := map[string]string{}
+	for _, field := range errorResponse.Fields {
+		fields[field.Field] = field.Code
+	}
+	if fields["email"] != "email" {
+		t.Errorf("Expected email field to fail the email rule, got %v", errorResponse.Fields)
+	}
+	if fields["password"] != "eqfield" {
+		t.Errorf("Expected password field to fail the eqfield rule, got %v", errorResponse.Fields)
+	}
+}
+
+func TestLoginJSON(t *testing.T) {
+	server, client, err := serverSetup()
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	body := `{"email": "test@gmail.com", "username": "art", "password": "secretpassy", "confirmPassword": "secretpassy"}`
+	res, err := client.Post(server.URL+"/api/auth/signup", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("User art was not created. Received status code %v, wanted %v", res.StatusCode, http.StatusCreated)
+	}
+
+	body = `{"email": "test@gmail.com", "password": "wrongpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Received status code %v, wanted %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	body = `{"email": "test@gmail.com", "password": "secretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("User art was not logged in. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+
+	res, err = client.Post(server.URL+"/api/auth/logout", "application/json", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("User art was not logged out. Received status code %v, wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestApiToken(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("name", "reader bot")
+	form.Set("scopes", "read")
+	res, err := client.PostForm(server.URL+"/api/user/tokens", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Token was not created. Received status code %v, wanted %v", res.StatusCode, http.StatusCreated)
+	}
+	var created struct {
+		Id    int64
+		Token string
+	}
+	err = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding token: %v", err)
+	}
+
+	// a client without the session cookie
+	bot := &http.Client{Transport: client.Transport}
+	authorized := func(method string, path string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+created.Token)
+		res, err := bot.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return res
+	}
+
+	res = authorized(http.MethodGet, "/api/user/invitations")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Token could not read invitations. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+
+	res = authorized(http.MethodPost, "/api/room/create")
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Read token was able to create a room. Received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+
+	res = authorized(http.MethodGet, "/api/user/tokens")
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Token was able to list tokens. Received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+
+	res, err = client.PostForm(server.URL+"/api/user/tokens/"+strconv.FormatInt(created.Id, 10)+"/revoke", url.Values{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Token was not revoked. Received status code %v, wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	res = authorized(http.MethodGet, "/api/user/invitations")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Revoked token was accepted. Received status code %v, wanted %v", res.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	// logs the same user in a second time with its own cookies
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	otherDevice := &http.Client{Transport: client.Transport, Jar: jar}
+	form := url.Values{}
+	form.Set("email", "kup@gmail.com")
+	form.Set("password", "secretpassy")
+	_, err = otherDevice.PostForm(server.URL+"/api/user/login", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	otherConn, _, err := websocket.Dial(ctx, server.URL+"/api/v1/ws", &websocket.DialOptions{HTTPClient: otherDevice})
+	if err != nil {
+		t.Fatalf("err opening websocket: %v", err)
+	}
+	defer otherConn.Close(websocket.StatusNormalClosure, "")
+
+	res, err := client.Get(server.URL + "/api/user/sessions")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var userSessions []UserSession
+	err = json.NewDecoder(res.Body).Decode(&userSessions)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding sessions: %v", err)
+	}
+	if len(userSessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %v", userSessions)
+	}
+
+	res, err = client.PostForm(server.URL+"/api/user/sessions/revoke-others", url.Values{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Sessions were not revoked. Received status code %v, wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	res, err = otherDevice.Get(server.URL + "/api/user/sessions")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode == http.StatusOK {
+		t.Error("Revoked session was still able to make requests.")
+	}
+	_, _, err = otherConn.Read(ctx)
+	if websocket.CloseStatus(err) != CloseSessionRevoked {
+		t.Errorf("Revoked session's websocket was closed with %v, wanted %v", websocket.CloseStatus(err), CloseSessionRevoked)
+	}
+
+	res, err = client.Get(server.URL + "/api/user/sessions")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Current session was revoked. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	forgot := url.Values{}
+	forgot.Set("email", "kup@gmail.com")
+	requestReset := func() int {
+		res, err := client.PostForm(server.URL+"/api/user/password/forgot", forgot)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// the emails are sent in the background
+	resetTokens := func(count int) []string {
+		var tokens []string
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			tokens = nil
+			for _, mail := range application.Mailer.(*MemoryMailer).Sent() {
+				token := regexp.MustCompile(`password/reset\?token=([\w-]+)`).FindStringSubmatch(mail.Body)
+				if mail.To == "kup@gmail.com" && token != nil {
+					tokens = append(tokens, token[1])
+				}
+			}
+			if len(tokens) >= count {
+				return tokens
+			}
+		}
+		t.Fatalf("Expected %v password reset emails to kup@gmail.com, got %v", count, len(tokens))
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := requestReset(); status != http.StatusAccepted {
+			t.Fatalf("Password reset was not requested. Received status code %v, wanted %v", status, http.StatusAccepted)
+		}
+	}
+	tokens := resetTokens(2)
+
+	// an address that no one has gets the same response
+	unknown := url.Values{}
+	unknown.Set("email", "nobody@gmail.com")
+	res, err := client.PostForm(server.URL+"/api/user/password/forgot", unknown)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("Password reset for an unknown email received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	form := url.Values{}
+	form.Set("token", tokens[1])
+	form.Set("password", "newsecretpassy")
+	form.Set("confirmPassword", "newsecretpassy")
+	res, err = client.PostForm(server.URL+"/api/user/password/reset", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Password was not reset. Received status code %v, wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	// the token can only be used once
+	res, err = client.PostForm(server.URL+"/api/user/password/reset", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Password reset token was used twice. Received status code %v, wanted %v", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// and the user's other links stop working
+	form.Set("token", tokens[0])
+	res, err = client.PostForm(server.URL+"/api/user/password/reset", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Older password reset token still worked. Received status code %v, wanted %v", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// an address can only be sent a few reset emails
+	if status := requestReset(); status != http.StatusAccepted {
+		t.Fatalf("Password reset was not requested. Received status code %v, wanted %v", status, http.StatusAccepted)
+	}
+	if status := requestReset(); status != http.StatusTooManyRequests {
+		t.Errorf("Password reset was not throttled. Received status code %v, wanted %v", status, http.StatusTooManyRequests)
+	}
+
+	// existing sessions are revoked
+	res, err = client.Get(server.URL + "/api/user/invitations")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode == http.StatusOK {
+		t.Error("Session was still valid after resetting the password.")
+	}
+
+	body := `{"email": "kup@gmail.com", "password": "newsecretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Could not log in with the new password. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	server, client, err := serverSetup()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("username", "artemis")
+	form.Set("email", "kup@gmail.com")
+	form.Set("password", "secretpassy")
+	form.Set("confirmPassword", "secretpassy")
+	_, err = client.PostForm(server.URL+"/api/user/signup", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	form = url.Values{}
+	form.Set("email", "kup@gmail.com")
+	form.Set("password", "secretpassy")
+	_, err = client.PostForm(server.URL+"/api/user/login", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	createRoom := func() int {
+		form := url.Values{}
+		form.Set("chatroom_name", "test chatroom")
+		res, err := client.PostForm(server.URL+"/api/room/create", form)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return res.StatusCode
+	}
+
+	if status := createRoom(); status != http.StatusForbidden {
+		t.Fatalf("Unverified user created a room. Received status code %v, wanted %v", status, http.StatusForbidden)
+	}
+
+	res, err := client.Post(server.URL+"/api/user/verify/resend", "", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Verification email was not resent. Received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+	}
+	if sent := application.Mailer.(*MemoryMailer).Sent(); len(sent) != 2 {
+		t.Fatalf("Expected two verification emails, got %v", sent)
+	}
+
+	err = verifyEmail(server.URL, client, "kup@gmail.com")
+	if err != nil {
+		t.Fatalf("err verifying email: %v", err)
+	}
+
+	if status := createRoom(); status == http.StatusForbidden {
+		t.Errorf("Verified user could not create a room. Received status code %v", status)
+	}
+
+	res, err = client.Post(server.URL+"/api/user/verify/resend", "", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Verification email was resent to a verified user. Received status code %v, wanted %v", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestTotpCode(t *testing.T) {
+	// test vectors from RFC 6238 truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, test := range tests {
+		code, err := totpCode(secret, totpStep(time.Unix(test.time, 0)))
+		if err != nil {
+			t.Fatalf("err generating totp code: %v", err)
+		}
+		if code != test.code {
+			t.Errorf("totp code at %v was %v, wanted %v", test.time, code, test.code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	step, ok := validateTotp(secret, "005924", now, 0)
+	if !ok {
+		t.Fatalf("valid totp code was rejected")
+	}
+	if _, ok = validateTotp(secret, "005924", now, step); ok {
+		t.Errorf("totp code was accepted twice")
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	res, err := client.Post(server.URL+"/api/user/2fa/enroll", "", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Two factor was not enrolled. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+	var enrollment TwoFactorEnrollment
+	err = json.NewDecoder(res.Body).Decode(&enrollment)
+	if err != nil {
+		t.Fatalf("err decoding enrollment: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.Uri, "otpauth://totp/") {
+		t.Errorf("Enrollment uri %q is not an otpauth uri", enrollment.Uri)
+	}
+
+	code, _ := totpCode(enrollment.Secret, totpStep(time.Now()))
+	form := url.Values{}
+	form.Set("code", code)
+	res, err = client.PostForm(server.URL+"/api/user/2fa/confirm", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Two factor was not confirmed. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&confirmed)
+	if err != nil {
+		t.Fatalf("err decoding recovery codes: %v", err)
+	}
+	if len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %v recovery codes, got %v", recoveryCodeCount, confirmed.RecoveryCodes)
+	}
+
+	// the password alone no longer starts a session
+	body := `{"email": "kup@gmail.com", "password": "secretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Login did not ask for a second factor. Received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+	}
+	var challenge struct {
+		Challenge string `json:"challenge"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&challenge)
+	if err != nil {
+		t.Fatalf("err decoding login challenge: %v", err)
+	}
+
+	loginTwoFactor := func(code string) int {
+		body, _ := json.Marshal(TwoFactorLogin{Challenge: challenge.Challenge, Code: code})
+		res, err := client.Post(server.URL+"/api/auth/login/2fa", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return res.StatusCode
+	}
+
+	if status := loginTwoFactor("000000"); status != http.StatusUnauthorized {
+		t.Errorf("Wrong code was accepted. Received status code %v, wanted %v", status, http.StatusUnauthorized)
+	}
+	// the code used to confirm can't be used again so use the next one
+	code, _ = totpCode(enrollment.Secret, totpStep(time.Now())+1)
+	if status := loginTwoFactor(code); status != http.StatusOK {
+		t.Fatalf("User was not logged in with their code. Received status code %v, wanted %v", status, http.StatusOK)
+	}
+
+	form = url.Values{}
+	form.Set("password", "secretpassy")
+	form.Set("code", strings.ToLower(confirmed.RecoveryCodes[0]))
+	res, err = client.PostForm(server.URL+"/api/user/2fa/disable", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Two factor was not disabled. Received status code %v, wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Login still asked for a second factor. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestChangeUsername(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	bobClient, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	message, _ := json.Marshal(TestMessage{ChatroomName: "test chatroom", Message: "hello"})
+	err = conn.Write(context.Background(), websocket.MessageText, message)
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+	// the message is saved before it is sent back
+	_, _, err = conn.Read(context.Background())
+	if err != nil {
+		t.Fatalf("err reading message: %v", err)
+	}
+
+	form = url.Values{}
+	form.Set("username", "bob")
+	res, err := client.PostForm(server.URL+"/api/user/account/username", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("User was renamed to a taken username. Received status code %v, wanted %v", res.StatusCode, http.StatusConflict)
+	}
+
+	form.Set("username", "athena")
+	res, err = client.PostForm(server.URL+"/api/user/account/username", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("User was not renamed. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+
+	// the session follows the new name
+	res, err = client.Get(server.URL + "/api/user/chatrooms")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var info struct {
+		Name      string   `json:"name"`
+		Chatrooms []string `json:"chatrooms"`
+	}
+	json.NewDecoder(res.Body).Decode(&info)
+	if info.Name != "athena" || len(info.Chatrooms) != 1 || info.Chatrooms[0] != "test chatroom" {
+		t.Errorf("Renamed user's info was %+v, wanted athena in [test chatroom]", info)
+	}
+
+	var authors []string
+	query := application.ScyllaDb.Query("SELECT user_id FROM messages WHERE chatroom_name = ?;", []string{"chatroom_name"})
+	query.Bind("test chatroom")
+	err = query.SelectRelease(&authors)
+	if err != nil {
+		t.Fatalf("err getting messages: %v", err)
+	}
+	if len(authors) != 1 || authors[0] != "athena" {
+		t.Errorf("Message authors were %v, wanted [athena]", authors)
+	}
+
+	var owner string
+	row := application.Pg.QueryRow(`SELECT owner FROM Rooms WHERE name=$1`, "test chatroom")
+	err = row.Scan(&owner)
+	if err != nil || owner != "athena" {
+		t.Errorf("Room owner is %v (%v), wanted athena", owner, err)
+	}
+
+	// the old name stays with its user for the messages still showing it
+	form.Set("username", "artemis")
+	res, err = bobClient.PostForm(server.URL+"/api/user/account/username", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Another user took a previous username. Received status code %v, wanted %v", res.StatusCode, http.StatusConflict)
+	}
+	res, err = client.PostForm(server.URL+"/api/user/account/username", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("User could not go back to their previous username. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestChangePasswordAndEmail(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("currentPassword", "wrongpassy")
+	form.Set("password", "newsecretpassy")
+	form.Set("confirmPassword", "newsecretpassy")
+	res, err := client.PostForm(server.URL+"/api/user/account/password", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Password was changed without the current one. Received status code %v, wanted %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	form.Set("currentPassword", "secretpassy")
+	res, err = client.PostForm(server.URL+"/api/user/account/password", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Password was not changed. Received status code %v, wanted %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	form = url.Values{}
+	form.Set("email", "artemis@gmail.com")
+	form.Set("password", "newsecretpassy")
+	res, err = client.PostForm(server.URL+"/api/user/account/email", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Email change was not requested. Received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	// the email doesn't change until the new one is verified
+	body := `{"email": "artemis@gmail.com", "password": "newsecretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Logged in with an unverified email. Received status code %v, wanted %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	err = verifyEmail(server.URL, client, "artemis@gmail.com")
+	if err != nil {
+		t.Fatalf("err verifying email: %v", err)
+	}
+
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Could not log in with the new email and password. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+}
+
+// polls the job's status until it finishes
+func waitForAccountJob(t *testing.T, serverUrl string, id string) AccountJob {
+	var job AccountJob
+	for i := 0; i < 50; i++ {
+		res, err := http.Get(serverUrl + "/api/user/account/jobs/" + id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = json.NewDecoder(res.Body).Decode(&job)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("err decoding account job: %v", err)
+		}
+		if job.Status == AccountJobDone || job.Status == AccountJobFailed {
+			return job
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	t.Fatalf("Account job %v did not finish, last status was %v", id, job.Status)
+	return job
+}
+
+func TestAccountExportAndDelete(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	message, _ := json.Marshal(TestMessage{ChatroomName: "test chatroom", Message: "hello"})
+	err = conn.Write(context.Background(), websocket.MessageText, message)
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+	_, _, err = conn.Read(context.Background())
+	if err != nil {
+		t.Fatalf("err reading message: %v", err)
+	}
+
+	res, err := client.Post(server.URL+"/api/user/account/export", "", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Export was not started. Received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+	}
+	var job AccountJob
+	json.NewDecoder(res.Body).Decode(&job)
+	if job = waitForAccountJob(t, server.URL, job.Id); job.Status != AccountJobDone {
+		t.Fatalf("Export failed: %v", job.Error)
+	}
+
+	res, err = client.Get(server.URL + "/api/user/account/jobs/" + job.Id + "/archive")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var export AccountExport
+	err = json.NewDecoder(res.Body).Decode(&export)
+	if err != nil {
+		t.Fatalf("err decoding export: %v", err)
+	}
+	if export.Profile.Username != "artemis" || export.Profile.Email != "kup@gmail.com" {
+		t.Errorf("Export profile was %+v", export.Profile)
+	}
+	if len(export.Memberships) != 1 || !export.Memberships[0].Owner {
+		t.Errorf("Export memberships were %+v, wanted owner of test chatroom", export.Memberships)
+	}
+	if len(export.Messages) != 1 || export.Messages[0].Content != "hello" {
+		t.Errorf("Export messages were %+v, wanted hello", export.Messages)
+	}
+
+	form = url.Values{}
+	form.Set("password", "secretpassy")
+	res, err = client.PostForm(server.URL+"/api/user/account/delete", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Deletion was not started. Received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+	}
+	json.NewDecoder(res.Body).Decode(&job)
+	if job = waitForAccountJob(t, server.URL, job.Id); job.Status != AccountJobDone {
+		t.Fatalf("Deletion failed: %v", job.Error)
+	}
+
+	body := `{"email": "kup@gmail.com", "password": "secretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Deleted user could log in. Received status code %v, wanted %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	// messages are anonymized by default
+	var authors []string
+	query := application.ScyllaDb.Query("SELECT user_id FROM messages WHERE chatroom_name = ?;", []string{"chatroom_name"})
+	query.Bind("test chatroom")
+	err = query.SelectRelease(&authors)
+	if err != nil {
+		t.Fatalf("err getting messages: %v", err)
+	}
+	if len(authors) != 1 || authors[0] != deletedUserId {
+		t.Errorf("Message authors were %v, wanted [%v]", authors, deletedUserId)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	server, client, err := serverSetup()
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	body := `{"email": "test@gmail.com", "username": "art", "password": "secretpassy", "confirmPassword": "secretpassy"}`
+	res, err := client.Post(server.URL+"/api/auth/signup", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("User art was not created. Received status code %v, wanted %v", res.StatusCode, http.StatusCreated)
+	}
+
+	body = `{"email": "test@gmail.com", "password": "wrongpassy"}`
+	for i := 0; i < application.LoginThrottle.AccountLimit; i++ {
+		res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Failed login %v received status code %v, wanted %v", i, res.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// the right password doesn't get through while the account is locked
+	body = `{"email": "test@gmail.com", "password": "secretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Locked account received status code %v, wanted %v", res.StatusCode, http.StatusTooManyRequests)
+	}
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Errorf("Locked login had Retry-After %q, wanted at most a minute", res.Header.Get("Retry-After"))
+	}
+
+	var kind string
+	row := application.Pg.QueryRow(`SELECT kind FROM SecurityEvents WHERE username=$1`, "art")
+	err = row.Scan(&kind)
+	if err != nil || kind != SecurityEventAccountLocked {
+		t.Errorf("Lockout was recorded as %q (%v), wanted %v", kind, err, SecurityEventAccountLocked)
+	}
+
+	// once the lockout is over the next failure locks it for twice as long
+	_, err = application.Pg.Exec(`UPDATE LoginFailures SET locked_until=now()`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(`{"email": "test@gmail.com", "password": "wrongpassy"}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Received status code %v, wanted %v", res.StatusCode, http.StatusUnauthorized)
+	}
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retryAfter, err = strconv.Atoi(res.Header.Get("Retry-After"))
+	if res.StatusCode != http.StatusTooManyRequests || err != nil || retryAfter <= 60 {
+		t.Errorf("Second lockout received status code %v with Retry-After %q, wanted %v for over a minute",
+			res.StatusCode, res.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
+
+func TestPasswordCheckLockout(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("currentPassword", "wrongpassy")
+	form.Set("password", "newsecretpassy")
+	form.Set("confirmPassword", "newsecretpassy")
+	for i := 0; i < application.LoginThrottle.AccountLimit; i++ {
+		res, err := client.PostForm(server.URL+"/api/user/account/password", form)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Wrong password %v received status code %v, wanted %v", i, res.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// a session doesn't get more guesses at the password than a login does
+	form.Set("currentPassword", "secretpassy")
+	res, err := client.PostForm(server.URL+"/api/user/account/password", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Locked account's password was checked. Received status code %v, wanted %v", res.StatusCode, http.StatusTooManyRequests)
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("err parsing trusted proxies: %v", err)
+	}
+	app := App{TrustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{"direct", "203.0.113.5:1234", "", "203.0.113.5"},
+		{"untrusted proxy", "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"spoofed header", "10.1.2.3:1234", "1.2.3.4, 198.51.100.7", "198.51.100.7"},
+		{"proxy chain", "10.1.2.3:1234", "198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"no header", "10.1.2.3:1234", "", "10.1.2.3"},
+		{"garbage header", "10.1.2.3:1234", "not an ip", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := app.clientIp(req); ip != test.ip {
+			t.Errorf("%v: client ip was %v, wanted %v", test.name, ip, test.ip)
+		}
+	}
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	if err == nil {
+		t.Errorf("Invalid network was accepted")
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	res, err := client.Post(server.URL+"/api/user/2fa/enroll", "", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var enrollment TwoFactorEnrollment
+	err = json.NewDecoder(res.Body).Decode(&enrollment)
+	if err != nil {
+		t.Fatalf("err decoding enrollment: %v", err)
+	}
+	code, _ := totpCode(enrollment.Secret, totpStep(time.Now()))
+	form := url.Values{}
+	form.Set("code", code)
+	res, err = client.PostForm(server.URL+"/api/user/2fa/confirm", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Two factor was not confirmed. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+
+	login := func() *http.Response {
+		body := `{"email": "kup@gmail.com", "password": "secretpassy"}`
+		res, err := client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return res
+	}
+	newChallenge := func() string {
+		res := login()
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("Login did not ask for a second factor. Received status code %v, wanted %v", res.StatusCode, http.StatusAccepted)
+		}
+		var challenge struct {
+			Challenge string `json:"challenge"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&challenge)
+		if err != nil {
+			t.Fatalf("err decoding login challenge: %v", err)
+		}
+		return challenge.Challenge
+	}
+	loginTwoFactor := func(challenge string, code string) int {
+		body, _ := json.Marshal(TwoFactorLogin{Challenge: challenge, Code: code})
+		res, err := client.Post(server.URL+"/api/auth/login/2fa", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return res.StatusCode
+	}
+
+	waiting := newChallenge()
+	// each wrong code gets a fresh challenge, which doesn't reset the count
+	for i := 0; i < application.LoginThrottle.AccountLimit; i++ {
+		if status := loginTwoFactor(newChallenge(), "000000"); status != http.StatusUnauthorized {
+			t.Fatalf("Wrong code %v received status code %v, wanted %v", i, status, http.StatusUnauthorized)
+		}
+	}
+
+	if res := login(); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Locked account was given a challenge. Received status code %v, wanted %v", res.StatusCode, http.StatusTooManyRequests)
+	}
+	code, _ = totpCode(enrollment.Secret, totpStep(time.Now())+1)
+	if status := loginTwoFactor(waiting, code); status != http.StatusTooManyRequests {
+		t.Errorf("Locked account's code was checked. Received status code %v, wanted %v", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	server, client, err := serverSetup()
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	body := `{"email": "test@gmail.com", "username": "art", "password": "secretpassy", "confirmPassword": "secretpassy"}`
+	res, err := client.Post(server.URL+"/api/auth/signup", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("User art was not created. Received status code %v, wanted %v", res.StatusCode, http.StatusCreated)
+	}
+
+	// users who signed up before the cost was raised
+	weak, err := bcrypt.GenerateFromPassword([]byte("secretpassy"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = application.Pg.Exec(`UPDATE Users SET password=$2 WHERE username=$1`, "art", string(weak))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	body = `{"email": "test@gmail.com", "password": "secretpassy"}`
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("User art was not logged in. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+
+	var hash string
+	row := application.Pg.QueryRow(`SELECT password FROM Users WHERE username=$1`, "art")
+	err = row.Scan(&hash)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || cost != application.Passwords.BcryptCost {
+		t.Errorf("Password hash has cost %v (%v) after logging in, wanted %v", cost, err, application.Passwords.BcryptCost)
+	}
+}
+
+func TestPasswordConfig(t *testing.T) {
+	config := DefaultPasswordConfig()
+	config.Algorithm = Argon2id
+	config.Argon2Memory = 8 * 1024
+	config.Argon2Time = 1
+
+	hash, err := config.hash("secretpassy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, outdated, err := config.verify(hash, "secretpassy")
+	if err != nil || !ok || outdated {
+		t.Errorf("Argon2id hash verified as %v (outdated %v, %v), wanted a current match", ok, outdated, err)
+	}
+	ok, _, err = config.verify(hash, "wrongpassy")
+	if err != nil || ok {
+		t.Errorf("Wrong password verified as %v (%v), wanted no match", ok, err)
+	}
+
+	// hashes from before switching algorithms still work until they're replaced
+	bcryptHash, err := DefaultPasswordConfig().hash("secretpassy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, outdated, err = config.verify(bcryptHash, "secretpassy")
+	if err != nil || !ok || !outdated {
+		t.Errorf("Bcrypt hash verified as %v (outdated %v, %v), wanted an outdated match", ok, outdated, err)
+	}
+
+	config.Argon2Time = 2
+	_, outdated, _ = config.verify(hash, "secretpassy")
+	if !outdated {
+		t.Errorf("Argon2id hash made with other parameters was not outdated")
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	// a form posted by another site carries the session cookie but not the token
+	browser := &http.Client{Transport: client.Transport.(csrfTransport).base, Jar: client.Jar}
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	res, err := browser.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("Request without csrf token received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+
+	var token string
+	serverUrl, _ := url.Parse(server.URL)
+	for _, cookie := range client.Jar.Cookies(serverUrl) {
+		if cookie.Name == csrfCookie {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		t.Fatalf("Server did not set a %v cookie", csrfCookie)
+	}
+
+	form.Set(csrfField, "wrong")
+	res, err = browser.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Request with wrong csrf token received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+
+	form.Set(csrfField, token)
+	res, err = browser.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode == http.StatusForbidden {
+		t.Errorf("Request with csrf token in the form was rejected")
+	}
+
+	// pages on other origins can't open websockets with the user's cookies
+	_, res, err = websocket.Dial(context.Background(), server.URL+"/api/ws", &websocket.DialOptions{
+		HTTPClient: client,
+		HTTPHeader: http.Header{"Origin": []string{"https://evil.example.com"}},
+	})
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("Websocket from another origin was not rejected: %v", err)
+	}
+}
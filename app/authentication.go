@@ -3,29 +3,38 @@ package app
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/schema"
 	"github.com/gorilla/sessions"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var Decoder = schema.NewDecoder()
 
 type UserSignup struct {
-	Email           string `form:"email" validate:"required,email,max=50"`
-	Username        string `form:"username" validate:"required,min=3,max=30"`
-	Password        string `form:"password" validate:"required,eqfield=ConfirmPassword,min=8,max=50"`
-	ConfirmPassword string `form:"confirmPassword" validate:"required,min=8,max=50"`
+	Email           string `form:"email" json:"email" validate:"required,email,max=50"`
+	Username        string `form:"username" json:"username" validate:"required,min=3,max=30,excludesall=[]"`
+	Password        string `form:"password" json:"password" validate:"required,eqfield=ConfirmPassword,min=8,max=50"`
+	ConfirmPassword string `form:"confirmPassword" json:"confirmPassword" validate:"required,min=8,max=50"`
 }
 
 type UserLogin struct {
-	Email    string `form:"email" validate:"required,email,max=50"`
-	Password string `form:"password" validate:"required,min=8,max=50"`
+	Email    string `form:"email" json:"email" validate:"required,email,max=50"`
+	Password string `form:"password" json:"password" validate:"required,min=8,max=50"`
 }
 
+var (
+	ErrInvalidCredentials = errors.New("email or password is incorrect")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrLoginRequired      = errors.New("user needs to log in")
+)
+
 func (app App) Signup(w http.ResponseWriter, req *http.Request) {
 	ctx, span := otel.Tracer("").Start(req.Context(), "Signup")
 	defer span.End()
@@ -36,7 +45,7 @@ func (app App) Signup(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		Sugar.Error("Error parsing form: ", err)
 		span.RecordError(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
 		span.SetStatus(codes.Error, "Error parsing form")
 		return
 	}
@@ -45,7 +54,7 @@ func (app App) Signup(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		Sugar.Error("err decoding form in signup: ", err)
 		span.RecordError(err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
 		span.SetStatus(codes.Error, "Error decoding form.")
 		return
 	}
@@ -55,20 +64,14 @@ func (app App) Signup(w http.ResponseWriter, req *http.Request) {
 		Sugar.Info("err validating form in signup: ", err)
 		// span.RecordError(errors.Wrap(err, applog.Sugar.Error("Err validating form in signup")))
 		span.RecordError(err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
 		span.SetStatus(codes.Error, "Error validating form.")
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.MinCost)
-	if err != nil {
-		Sugar.Error("err generating from password: ", err)
-		span.RecordError(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		span.SetStatus(codes.Error, "Error generating hash for password.")
-		return
-	}
-
 	emailExists, usernameExists := app.checkUserExists(ctx, form.Email, form.Username)
 
 	userExists := struct {
@@ -119,26 +122,13 @@ func (app App) Signup(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err == nil {
-		_, dbSpan := otel.Tracer("").Start(ctx, "Adding User to DB.")
-		_, err = app.Pg.Exec(
-			`INSERT INTO Users (email, username, password) VALUES ($1, $2, $3)`,
-			form.Email,
-			form.Username,
-			string(hash),
-		)
-		if err != nil {
-			Sugar.Error("error inserting new user: ", err)
-			dbSpan.RecordError(err)
-		}
-		dbSpan.End()
-	} else {
-		Sugar.Error("error inserting values: \n", err)
+	err = app.createUser(ctx, form)
+	if err != nil {
 		span.RecordError(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error creating user.")
 		return
 	}
-	app.Clients[form.Username] = &User{}
 
 	w.WriteHeader(http.StatusCreated)
 	span.SetStatus(codes.Ok, "User was created.")
@@ -150,7 +140,7 @@ func (app App) Signup(w http.ResponseWriter, req *http.Request) {
 }
 
 func (app App) Login(w http.ResponseWriter, req *http.Request) {
-	_, span := otel.Tracer("").Start(req.Context(), "Login")
+	ctx, span := otel.Tracer("").Start(req.Context(), "Login")
 	defer span.End()
 
 	// span.SetAttributes(kv.Route, "/api/user/login")
@@ -159,7 +149,7 @@ func (app App) Login(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		span.RecordError(err)
 		Sugar.Error("err parsing form data: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
 		span.SetStatus(codes.Error, "Error parsing form data.")
 		return
 	}
@@ -168,7 +158,7 @@ func (app App) Login(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		span.RecordError(err)
 		Sugar.Error("err decoding post form: ", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
 		span.SetStatus(codes.Error, "Error parsing form data.")
 		return
 	}
@@ -181,15 +171,18 @@ func (app App) Login(w http.ResponseWriter, req *http.Request) {
 		"Email or Password is incorrect",
 	}
 
-	row := app.Pg.QueryRow(
-		`SELECT password FROM Users WHERE email=$1`,
-		form.Email,
-	)
-
-	var password string
-	err = row.Scan(&password)
-	if err == sql.ErrNoRows {
-		span.RecordError(err)
+	username, err := app.authenticate(ctx, form.Email, form.Password, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many failed logins.")
+		err = app.renderLoginError(w, http.StatusTooManyRequests, "Too many failed logins, try again later")
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	} else if err == ErrInvalidCredentials {
 		w.WriteHeader(http.StatusOK)
 		span.SetStatus(codes.Ok, "")
 
@@ -202,68 +195,53 @@ func (app App) Login(w http.ResponseWriter, req *http.Request) {
 		return
 	} else if err != nil {
 		span.RecordError(err)
-		Sugar.Error("err getting password hash: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		span.SetStatus(codes.Ok, "Error getting password hash")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error authenticating user.")
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(password), []byte(form.Password))
-	// password did not match
+	twoFactor, err := app.twoFactorEnabled(ctx, username)
 	if err != nil {
+		span.RecordError(err)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error checking two factor.")
+		return
+	}
+	if twoFactor {
+		challenge, err := app.createLoginChallenge(ctx, username, app.clientIp(req))
+		if errors.As(err, &throttled) {
+			setRetryAfter(w, throttled.RetryAfter)
+			span.SetStatus(codes.Ok, "Too many failed logins.")
+			err = app.renderLoginError(w, http.StatusTooManyRequests, "Too many failed logins, try again later")
+			if err != nil {
+				Sugar.Error("error executing template: ", err)
+				span.RecordError(err)
+			}
+			return
+		} else if err != nil {
+			span.RecordError(err)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			span.SetStatus(codes.Error, "Error creating login challenge.")
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
-		err = app.Tmpl.ExecuteTemplate(w, "login.html", loginSuccess)
+		span.SetStatus(codes.Ok, "Two factor code required.")
+		err = app.Tmpl.ExecuteTemplate(w, "login_2fa.html", struct {
+			Challenge    string
+			ErrorMessage string
+		}{challenge, ""})
 		if err != nil {
 			Sugar.Error("error executing template: ", err)
-			span.AddEvent("TemplateExecutionFailure")
+			span.RecordError(err)
 		}
 		return
 	}
 
-	session, err := app.PgStore.New(req, "session-name")
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		span.SetStatus(
-			codes.Error,
-			"Could not create new session name for user.",
-		)
-		Sugar.Error("error creating new unsaved session: ", err)
-		return
-	}
-	session.Options = &sessions.Options{
-		Path: "/",
-		// in seconds
-		MaxAge:   60 * 5 * 60,
-		Secure:   false,
-		HttpOnly: false,
-		SameSite: 4,
-	}
-
-	// todo: combine this with search for password to get username and password
-	row = app.Pg.QueryRow(
-		`SELECT username FROM Users WHERE email=$1`,
-		form.Email,
-	)
-	var username string
-	err = row.Scan(&username)
-	if err != nil {
-		Sugar.Error("err scanning row: ", err)
-		span.AddEvent("DbError")
-		w.WriteHeader(http.StatusInternalServerError)
-		span.SetStatus(
-			codes.Error,
-			"Could not scan DB row for username.",
-		)
-		return
-	}
-
-	session.Values["username"] = username
-
-	err = session.Save(req, w)
+	err = app.startSession(w, req, username)
 	if err != nil {
 		span.RecordError(err)
-		Sugar.Error("error saving session to db: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
 		span.SetStatus(
 			codes.Error,
 			"Error saving session to DB.",
@@ -289,8 +267,11 @@ func (app App) checkUserExists(ctx context.Context, email string, username strin
 	if err != nil {
 		emailExists = false
 	}
+	// names users have changed away from stay taken, their old messages
+	// may still show them
 	row = app.Pg.QueryRow(
-		`SELECT username FROM Users WHERE username=$1`,
+		`SELECT username FROM Users WHERE username=$1
+		UNION ALL SELECT previous FROM PreviousUsernames WHERE previous=$1`,
 		username,
 	)
 
@@ -304,57 +285,547 @@ func (app App) checkUserExists(ctx context.Context, email string, username strin
 }
 
 func (app App) Logout(w http.ResponseWriter, req *http.Request) {
+	err := app.endSession(w, req)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+func (app App) hashPassword(password string) (string, error) {
+	hash, err := app.Passwords.hash(password)
+	if err != nil {
+		Sugar.Error("err generating from password: ", err)
+		return "", err
+	}
+	return hash, nil
+}
+
+// hashes the user's password and adds them to the Users table
+func (app App) createUser(ctx context.Context, form UserSignup) error {
+	hash, err := app.hashPassword(form.Password)
+	if err != nil {
+		return err
+	}
+
+	_, dbSpan := otel.Tracer("").Start(ctx, "Adding User to DB.")
+	defer dbSpan.End()
+	_, err = app.Pg.Exec(
+		`INSERT INTO Users (email, username, password) VALUES ($1, $2, $3)`,
+		form.Email,
+		form.Username,
+		hash,
+	)
+	if err != nil {
+		Sugar.Error("error inserting new user: ", err)
+		dbSpan.RecordError(err)
+		return err
+	}
+	app.addClient(form.Username)
+
+	// the user can ask for another email if this one doesn't arrive
+	err = app.sendVerification(ctx, form.Username, form.Email)
+	if err != nil {
+		dbSpan.RecordError(err)
+	}
+
+	return nil
+}
+
+// checks the password against the one stored for the email and returns
+// the username of the user it belongs to. failures are counted against
+// the email and ip, and once either has too many a LoginThrottledError is
+// returned without checking the password
+func (app App) authenticate(ctx context.Context, email string, password string, ip string) (string, error) {
+	retryAfter, err := app.loginLockout(ctx, email, ip)
+	if err != nil {
+		return "", err
+	}
+	if retryAfter > 0 {
+		return "", &LoginThrottledError{RetryAfter: retryAfter}
+	}
+
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT username, password FROM Users WHERE email=$1`,
+		email,
+	)
+
+	var username string
+	var hash string
+	err = row.Scan(&username, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		Sugar.Error("err getting password hash: ", err)
+		return "", err
+	}
+
+	// without a user the password is still hashed so this takes as long
+	exists := err == nil && hash != ""
+	if !exists {
+		hash, err = app.Passwords.dummyHash()
+		if err != nil {
+			Sugar.Error("err making dummy password hash: ", err)
+			return "", err
+		}
+	}
+	ok, outdated, err := app.Passwords.verify(hash, password)
+	if err != nil {
+		Sugar.Error("err verifying password: ", err)
+		return "", err
+	}
+	// password did not match or there is no user with the email
+	if !ok || !exists {
+		err = app.recordLoginFailure(ctx, email, username, ip)
+		if err != nil {
+			return "", err
+		}
+		return "", ErrInvalidCredentials
+	}
+
+	// with two factor on the failures are only forgotten once the code is
+	// right too, so a known password can't keep resetting guesses at the code
+	twoFactor, err := app.twoFactorEnabled(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	if !twoFactor {
+		app.clearLoginFailures(ctx, email)
+	}
+	if outdated {
+		app.rehashPassword(ctx, username, hash, password)
+	}
+
+	return username, nil
+}
+
+// replaces a hash made with old settings now that the password is known.
+// the login still succeeds if this fails, it will be tried again next time
+func (app App) rehashPassword(ctx context.Context, username string, oldHash string, password string) {
+	hash, err := app.hashPassword(password)
+	if err != nil {
+		return
+	}
+	// the password may have been changed since it was checked
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`UPDATE Users SET password=$3 WHERE username=$1 AND password=$2`,
+		username,
+		oldHash,
+		hash,
+	)
+	if err != nil {
+		Sugar.Error("error updating password hash: ", err)
+	}
+}
+
+// creates a new session for the user and sets its cookie on the response
+func (app App) startSession(w http.ResponseWriter, req *http.Request, username string) error {
+	session, err := app.PgStore.New(req, "session-name")
+	if err != nil {
+		Sugar.Error("error creating new unsaved session: ", err)
+		return err
+	}
+	session.Options = &sessions.Options{
+		Path:   "/",
+		Domain: app.Cookies.Domain,
+		// in seconds
+		MaxAge:   int(app.SessionMaxAge.Seconds()),
+		Secure:   app.Cookies.Secure,
+		HttpOnly: true,
+		SameSite: app.Cookies.SameSite,
+	}
+
+	session.Values["username"] = username
+
+	err = session.Save(req, w)
+	if err != nil {
+		Sugar.Error("error saving session to db: ", err)
+		return err
+	}
+
+	return app.trackSession(req.Context(), req, session.ID, username)
+}
+
+// deletes the request's session and expires its cookie
+func (app App) endSession(w http.ResponseWriter, req *http.Request) error {
 	session, err := app.PgStore.Get(req, "session-name")
 	if err != nil {
 		Sugar.Error("err getting session name: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
 	if session.ID == "" {
 		Sugar.Error("err getting session name. It was empty: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return ErrSessionNotFound
+	}
+
+	_, err = app.Pg.Exec(`DELETE FROM UserSessions WHERE session_id=$1`, session.ID)
+	if err != nil {
+		Sugar.Error("Error deleting user session: ", err)
+		return err
 	}
 
 	session.Options.MaxAge = -1
 	err = session.Save(req, w)
 	if err != nil {
 		Sugar.Error("Error deleting session: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+// decodes a json request body into the form, responding with an error
+// and returning false if it couldn't be decoded
+func decodeJSONForm(w http.ResponseWriter, req *http.Request, form interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeError(w, req, http.StatusUnsupportedMediaType, ErrorResponse{
+			Code:   "unsupported_media_type",
+			Detail: "Request body must be application/json",
+		})
+		return false
+	}
+
+	err = json.NewDecoder(req.Body).Decode(form)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "malformed_json",
+			Detail: err.Error(),
+		})
+		return false
+	}
+
+	return true
+}
+
+func (app App) SignupJSON(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "SignupJSON")
+	defer span.End()
+
+	var form UserSignup
+	if !decodeJSONForm(w, req, &form) {
+		span.SetStatus(codes.Ok, "Error decoding json.")
 		return
 	}
 
-	http.Redirect(w, req, "/", http.StatusSeeOther)
+	err := Validate.Struct(form)
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	emailExists, usernameExists := app.checkUserExists(ctx, form.Email, form.Username)
+	if emailExists || usernameExists {
+		fields := []FieldError{}
+		if emailExists {
+			fields = append(fields, FieldError{Field: "email", Code: "exists"})
+		}
+		if usernameExists {
+			fields = append(fields, FieldError{Field: "username", Code: "exists"})
+		}
+		span.SetStatus(codes.Ok, "User already exists.")
+		writeError(w, req, http.StatusConflict, ErrorResponse{
+			Code:   "user_exists",
+			Fields: fields,
+		})
+		return
+	}
+
+	err = app.createUser(ctx, form)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error creating user.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "User was created.")
+	writeJSON(w, http.StatusCreated, struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}{form.Username, form.Email})
+}
+
+func (app App) LoginJSON(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "LoginJSON")
+	defer span.End()
+
+	var form UserLogin
+	if !decodeJSONForm(w, req, &form) {
+		span.SetStatus(codes.Ok, "Error decoding json.")
+		return
+	}
+
+	err := Validate.Struct(form)
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	username, err := app.authenticate(ctx, form.Email, form.Password, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many failed logins.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_attempts",
+			Detail: "Too many failed logins, try again later",
+		})
+		return
+	} else if err == ErrInvalidCredentials {
+		span.SetStatus(codes.Ok, "Email or password is incorrect.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{
+			Code:   "invalid_credentials",
+			Detail: "Email or Password is incorrect",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error authenticating user.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+
+	twoFactor, err := app.twoFactorEnabled(ctx, username)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking two factor.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+	if twoFactor {
+		challenge, err := app.createLoginChallenge(ctx, username, app.clientIp(req))
+		if errors.As(err, &throttled) {
+			setRetryAfter(w, throttled.RetryAfter)
+			span.SetStatus(codes.Ok, "Too many failed logins.")
+			writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+				Code:   "too_many_attempts",
+				Detail: "Too many failed logins, try again later",
+			})
+			return
+		} else if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Error creating login challenge.")
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+			return
+		}
+
+		// the session is started by /auth/login/2fa once the code is sent
+		span.SetStatus(codes.Ok, "Two factor code required.")
+		writeJSON(w, http.StatusAccepted, struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			Challenge         string `json:"challenge"`
+		}{true, challenge})
+		return
+	}
+
+	err = app.startSession(w, req, username)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error saving session to DB.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Successfully logged in.")
+	writeJSON(w, http.StatusOK, struct {
+		Username string `json:"username"`
+	}{username})
+}
+
+func (app App) LogoutJSON(w http.ResponseWriter, req *http.Request) {
+	_, span := otel.Tracer("").Start(req.Context(), "LogoutJSON")
+	defer span.End()
+
+	err := app.endSession(w, req)
+	if err == ErrSessionNotFound {
+		span.SetStatus(codes.Ok, "Session not found.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{Code: "not_logged_in"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error ending session.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Successfully logged out.")
+	w.WriteHeader(http.StatusNoContent)
 }
 
+type contextKey string
+
+const authKey contextKey = "auth"
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeChat  = "chat"
+)
+
+// who made a request and how they proved it
+type Auth struct {
+	Username string
+	// set when the request was authenticated with a session cookie
+	SessionId string
+	// set when the request was authenticated with an api token
+	TokenId int64
+	Scopes  []string
+}
+
+// sessions can do anything the user can, api tokens are limited
+// to the scopes they were created with
+func (auth Auth) HasScope(scope string) bool {
+	if auth.TokenId == 0 {
+		return true
+	}
+	for _, granted := range auth.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func authFromContext(ctx context.Context) (Auth, bool) {
+	auth, ok := ctx.Value(authKey).(Auth)
+	return auth, ok
+}
+
+// returns the username UserSession authenticated the request as
+func currentUser(req *http.Request) string {
+	auth, _ := authFromContext(req.Context())
+	return auth.Username
+}
+
+// returns the token from an "Authorization: Bearer <token>" header
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// works out who made the request from its api token or session cookie.
+// ErrInvalidToken, ErrSessionNotFound and ErrLoginRequired mean the
+// request couldn't be authenticated
+func (app App) authenticateRequest(ctx context.Context, req *http.Request) (Auth, error) {
+	if token, ok := bearerToken(req); ok {
+		apiToken, err := app.authenticateToken(ctx, token)
+		if err != nil {
+			return Auth{}, err
+		}
+
+		return Auth{
+			Username: apiToken.Username,
+			TokenId:  apiToken.Id,
+			Scopes:   apiToken.Scopes,
+		}, nil
+	}
+
+	session, err := app.PgStore.Get(req, "session-name")
+	if err != nil {
+		return Auth{}, err
+	}
+	if session.ID == "" {
+		return Auth{}, ErrSessionNotFound
+	}
+	if session.IsNew {
+		return Auth{}, ErrLoginRequired
+	}
+
+	err = app.touchSession(ctx, session.ID)
+	if err != nil {
+		Sugar.Error("Could not update session last seen: ", err)
+	}
+
+	return Auth{
+		Username:  session.Values["username"].(string),
+		SessionId: session.ID,
+	}, nil
+}
+
+// authenticates the request with either an api token or a session cookie
+// and makes the Auth available to the handlers through the request context
 func (app App) UserSession(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		ctx, span := otel.Tracer("").Start(ctx, "AuthenticateUserSession")
 
-		session, err := app.PgStore.Get(req, "session-name")
-		if err != nil {
-			span.RecordError(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			Sugar.Error("Could not get session: ", err)
+		auth, err := app.authenticateRequest(ctx, req)
+		if err == ErrInvalidToken {
+			span.SetStatus(codes.Ok, "Api token was invalid.")
+			span.End()
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, req, http.StatusUnauthorized, ErrorResponse{Code: "invalid_token"})
 			return
-		}
-
-		if session.ID == "" {
-			w.WriteHeader(http.StatusInternalServerError)
+		} else if err == ErrSessionNotFound {
 			span.SetStatus(codes.Error, "User session was empty.")
 			span.AddEvent("Session not Found")
+			span.End()
 			Sugar.Error("Could not find session.")
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
 			return
-
-		}
-
-		if session.IsNew {
+		} else if err == ErrLoginRequired {
 			span.SetStatus(codes.Ok, "User needs to login.")
+			span.End()
 			http.Redirect(w, req, "/login", http.StatusSeeOther)
 			return
+		} else if err != nil {
+			span.RecordError(err)
+			span.End()
+			Sugar.Error("Could not authenticate request: ", err)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
 		}
 		span.End()
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), authKey, auth)))
+	})
+}
+
+// rejects requests made with an api token that wasn't granted the scope
+// it has to come after UserSession
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			auth, _ := authFromContext(req.Context())
+			if !auth.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				writeError(w, req, http.StatusForbidden, ErrorResponse{
+					Code:   "insufficient_scope",
+					Detail: "Api token needs the " + scope + " scope",
+				})
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// rejects requests that weren't made with a session cookie, so api tokens
+// can't be used to manage the user's credentials
+// it has to come after UserSession
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth, _ := authFromContext(req.Context())
+		if auth.SessionId == "" {
+			writeError(w, req, http.StatusForbidden, ErrorResponse{
+				Code:   "session_required",
+				Detail: "This endpoint can't be used with an api token",
+			})
+			return
+		}
 		next.ServeHTTP(w, req)
 	})
 }
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"sync"
+)
+
+// the kinds of events nodes send each other
+const (
+	// a message was saved in Room
+	BrokerMessage = "message"
+	// User became a member of Room
+	BrokerJoined = "joined"
+	// User was invited to a room
+	BrokerInvitation = "invitation"
+	// User's Session was logged out or revoked
+	BrokerSessionRevoked = "session_revoked"
+	// User is now called NewName
+	BrokerRenamed = "renamed"
+	// User's account was deleted
+	BrokerAccountDeleted = "account_deleted"
+)
+
+// something that happened on one node that the other nodes may have to tell
+// their connected users about
+type BrokerEvent struct {
+	Kind       string           `json:"kind"`
+	Room       string           `json:"room,omitempty"`
+	User       string           `json:"user,omitempty"`
+	NewName    string           `json:"new_name,omitempty"`
+	Session    string           `json:"session,omitempty"`
+	Message    *OutgoingMessage `json:"message,omitempty"`
+	Invitation *InvitationEvent `json:"invitation,omitempty"`
+}
+
+// carries events between the nodes serving the app, so a user connected to
+// any node gets the events for their rooms wherever they happened
+type Broker interface {
+	// sends the event to every subscribed node, this one included
+	Publish(ctx context.Context, event BrokerEvent) error
+	// returns once the node is subscribed, then calls receive with the events
+	// published by any node until ctx is done. receive can be called from
+	// several goroutines at once
+	Subscribe(ctx context.Context, receive func(BrokerEvent)) error
+}
+
+// a broker for a single node, which hands events straight to its subscribers
+type MemoryBroker struct {
+	mutex       sync.Mutex
+	subscribers map[int]func(BrokerEvent)
+	nextId      int
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: make(map[int]func(BrokerEvent))}
+}
+
+func (broker *MemoryBroker) Publish(ctx context.Context, event BrokerEvent) error {
+	broker.mutex.Lock()
+	receivers := make([]func(BrokerEvent), 0, len(broker.subscribers))
+	for _, receive := range broker.subscribers {
+		receivers = append(receivers, receive)
+	}
+	broker.mutex.Unlock()
+
+	for _, receive := range receivers {
+		receive(event)
+	}
+	return nil
+}
+
+func (broker *MemoryBroker) Subscribe(ctx context.Context, receive func(BrokerEvent)) error {
+	broker.mutex.Lock()
+	id := broker.nextId
+	broker.nextId++
+	broker.subscribers[id] = receive
+	broker.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		broker.mutex.Lock()
+		delete(broker.subscribers, id)
+		broker.mutex.Unlock()
+	}()
+	return nil
+}
+
+// publishes an event about a change that has already been saved, so failing
+// to publish it is only logged
+func (app App) publish(ctx context.Context, event BrokerEvent) {
+	err := app.Broker.Publish(ctx, event)
+	if err != nil {
+		Sugar.Errorf("error publishing %v event: %v", event.Kind, err)
+	}
+}
+
+// the room's goroutine on this node, started the first time the room is
+// used here. rooms created on other nodes are started when a user on this
+// node connects to them or sends them a message
+func (app App) localRoom(name string) *Chatroom {
+	app.clientsMutex.Lock()
+	defer app.clientsMutex.Unlock()
+	return app.startRoom(name)
+}
+
+// localRoom for callers already holding the clientsMutex
+func (app App) startRoom(name string) *Chatroom {
+	if room, ok := app.Chatrooms[name]; ok {
+		return room
+	}
+
+	room := NewChatroom()
+	room.Id = name
+	room.ScyllaSession = &app.ScyllaDb
+	room.Snowflake = app.Snowflake
+	room.Broker = app.Broker
+	app.Chatrooms[name] = room
+	app.ChatroomChannels[name] = room.Channel
+
+	app.Background.Go(room.Run)
+	return room
+}
+
+// passes an event from any node on to the users connected to this one
+func (app App) receive(event BrokerEvent) {
+	switch event.Kind {
+	case BrokerMessage:
+		if event.Message == nil {
+			return
+		}
+		// only rooms that have been used on this node can have users here
+		app.clientsMutex.RLock()
+		var queues []*EventQueue
+		if room, ok := app.Chatrooms[event.Room]; ok {
+			for _, client := range room.Clients {
+				queues = append(queues, client.Events)
+			}
+		}
+		app.clientsMutex.RUnlock()
+
+		// the payload is encoded when it's first written to a connection
+		// that wants each format
+		payload := NewPayload(*event.Message)
+		for _, events := range queues {
+			events.push(payload)
+		}
+
+	case BrokerJoined:
+		// users that haven't connected yet are added to their rooms when they do
+		app.clientsMutex.Lock()
+		defer app.clientsMutex.Unlock()
+		chatUser, ok := app.Clients[event.User]
+		if !ok || chatUser.Events == nil {
+			return
+		}
+		app.startRoom(event.Room).addUser(chatUser.Events, event.User)
+		for _, name := range chatUser.Chatrooms {
+			if name == event.Room {
+				return
+			}
+		}
+		chatUser.Chatrooms = append(chatUser.Chatrooms, event.Room)
+
+	case BrokerInvitation:
+		app.clientsMutex.RLock()
+		chatUser, ok := app.Clients[event.User]
+		app.clientsMutex.RUnlock()
+		if !ok || chatUser.Events == nil || event.Invitation == nil {
+			return
+		}
+		chatUser.Events.push(NewPayload(*event.Invitation))
+
+	case BrokerSessionRevoked:
+		// closing waits on the client so it doesn't hold up other events
+		app.clientsMutex.RLock()
+		chatUser, ok := app.Clients[event.User]
+		app.clientsMutex.RUnlock()
+		if ok {
+			go chatUser.closeSession(event.Session, "session revoked")
+		}
+
+	case BrokerRenamed:
+		// the open websocket keeps working under the new name
+		app.clientsMutex.Lock()
+		defer app.clientsMutex.Unlock()
+		chatUser, ok := app.Clients[event.User]
+		if !ok {
+			return
+		}
+		chatUser.mutex.Lock()
+		chatUser.Id = event.NewName
+		chatUser.mutex.Unlock()
+		app.Clients[event.NewName] = chatUser
+		delete(app.Clients, event.User)
+		for _, name := range chatUser.Chatrooms {
+			if room, ok := app.Chatrooms[name]; ok {
+				for _, client := range room.Clients {
+					if client.Id == event.User {
+						client.Id = event.NewName
+					}
+				}
+			}
+		}
+
+	case BrokerAccountDeleted:
+		app.clientsMutex.Lock()
+		defer app.clientsMutex.Unlock()
+		chatUser, ok := app.Clients[event.User]
+		if !ok {
+			return
+		}
+		go chatUser.closeAll(CloseSessionRevoked, "account deleted")
+		delete(app.Clients, event.User)
+		for _, name := range chatUser.Chatrooms {
+			if room, ok := app.Chatrooms[name]; ok {
+				clients := room.Clients[:0]
+				for _, client := range room.Clients {
+					if client.Id != event.User {
+						clients = append(clients, client)
+					}
+				}
+				room.Clients = clients
+			}
+		}
+
+	default:
+		Sugar.Warn("unknown broker event: ", event.Kind)
+	}
+}
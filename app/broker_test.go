@@ -0,0 +1,206 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestBrokerAcrossNodes(t *testing.T) {
+	broker := NewMemoryBroker()
+	application = newTestNode(NodeConfig{MachineId: 1, Broker: broker})
+	other := newTestNode(NodeConfig{MachineId: 2, Broker: broker})
+	server := httptest.NewServer(application.Routes())
+	otherServer := httptest.NewServer(other.Routes())
+	t.Cleanup(func() {
+		server.Close()
+		otherServer.Close()
+		databaseReset()
+	})
+
+	// sessions are in postgres so the login works on both nodes
+	base := server.Client()
+	base.Transport = csrfTransport{base.Transport}
+	client, err := secondUserClient(server.URL, base, "artemis", "kup@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up user: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	second, _, err := websocket.Dial(ctx, otherServer.URL+"/api/v1/ws", &websocket.DialOptions{HTTPClient: client})
+	if err != nil {
+		t.Fatalf("err opening websocket: %v", err)
+	}
+	defer second.Close(websocket.StatusNormalClosure, "")
+
+	// the room is made on the first node after the second one started
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	res, err := client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Room was not created. Received status code %v, wanted %v", res.StatusCode, http.StatusCreated)
+	}
+
+	first, _, err := websocket.Dial(ctx, server.URL+"/api/v1/ws", &websocket.DialOptions{HTTPClient: client})
+	if err != nil {
+		t.Fatalf("err opening websocket: %v", err)
+	}
+	defer first.Close(websocket.StatusNormalClosure, "")
+
+	// a message sent to the second node reaches the websockets on both
+	message, _ := json.Marshal(TestMessage{ChatroomName: "test chatroom", Message: "hello"})
+	err = second.Write(ctx, websocket.MessageText, message)
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+	for node, conn := range []*websocket.Conn{first, second} {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("err reading message from node %v: %v", node+1, err)
+		}
+		var outgoing OutgoingMessage
+		err = json.Unmarshal(data, &outgoing)
+		if err != nil || outgoing.Content != "hello" {
+			t.Errorf("Node %v sent %s (%v), wanted hello", node+1, data, err)
+		}
+	}
+}
+
+// meant to be run with go test -race, which fails it if connecting users and
+// broker events touch the app's users and rooms without the lock
+func TestBrokerEventsAlongsideConnects(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Fatalf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	res, err := client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Room was not created. Received status code %v, wanted %v", res.StatusCode, http.StatusCreated)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	const connects = 50
+	message := OutgoingMessage{ChatroomName: "test chatroom", UserId: "artemis", Content: "hello"}
+
+	// artemis is renamed back and forth while other users connect, join the
+	// room and get its messages
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < connects; i++ {
+			application.receive(BrokerEvent{Kind: BrokerRenamed, User: "artemis", NewName: "apollo"})
+			application.receive(BrokerEvent{Kind: BrokerRenamed, User: "apollo", NewName: "artemis"})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < connects; i++ {
+			username := fmt.Sprintf("hermes%v", i)
+			_, err := application.connectUser(ctx, username)
+			if err != nil {
+				t.Errorf("err connecting %v: %v", username, err)
+				return
+			}
+			application.receive(BrokerEvent{Kind: BrokerJoined, Room: "test chatroom", User: username})
+			application.receive(BrokerEvent{Kind: BrokerMessage, Room: "test chatroom", Message: &message})
+		}
+	}()
+	wg.Wait()
+
+	application.clientsMutex.RLock()
+	defer application.clientsMutex.RUnlock()
+	chatUser, ok := application.Clients["artemis"]
+	if !ok || chatUser.name() != "artemis" {
+		t.Errorf("artemis was not connected under their name after the renames")
+	}
+	if _, ok := application.Clients["apollo"]; ok {
+		t.Errorf("apollo was still connected after being renamed back")
+	}
+	members := make(map[string]int)
+	for _, client := range application.Chatrooms["test chatroom"].Clients {
+		members[client.Id]++
+	}
+	if members["artemis"] != 1 || members["apollo"] != 0 {
+		t.Errorf("Room had artemis %v times and apollo %v times, wanted artemis once", members["artemis"], members["apollo"])
+	}
+	for i := 0; i < connects; i++ {
+		username := fmt.Sprintf("hermes%v", i)
+		if _, ok := application.Clients[username]; !ok || members[username] != 1 {
+			t.Errorf("%v was not connected to the room once", username)
+		}
+	}
+}
+
+func TestPgBroker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := NewPgBroker(testPgConfig())
+	received := make(chan BrokerEvent, 1)
+	err := broker.Subscribe(ctx, func(event BrokerEvent) {
+		received <- event
+	})
+	if err != nil {
+		t.Fatalf("err subscribing: %v", err)
+	}
+
+	message := OutgoingMessage{ChatroomName: "test chatroom", UserId: "artemis", Content: "hello"}
+	err = broker.Publish(ctx, BrokerEvent{Kind: BrokerMessage, Room: "test chatroom", Message: &message})
+	if err != nil {
+		t.Fatalf("err publishing: %v", err)
+	}
+	select {
+	case event := <-received:
+		if event.Kind != BrokerMessage || event.Message == nil || *event.Message != message {
+			t.Errorf("Broker delivered %+v, wanted the hello message", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("Published event was never received")
+	}
+
+	// the longest message a user can send fits even when every character
+	// has to be escaped
+	longest := OutgoingMessage{
+		ChatroomName: "test chatroom",
+		UserId:       strings.Repeat("a", 30),
+		Content:      strings.Repeat("<", maxMessageLength),
+		Timestamp:    time.Now().Format(time.RFC3339),
+	}
+	err = broker.Publish(ctx, BrokerEvent{Kind: BrokerMessage, Room: "test chatroom", Message: &longest})
+	if err != nil {
+		t.Fatalf("err publishing the longest message: %v", err)
+	}
+	select {
+	case event := <-received:
+		if event.Message == nil || *event.Message != longest {
+			t.Errorf("Broker delivered %+v, wanted the longest message", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("Longest message was never received")
+	}
+}
@@ -0,0 +1,441 @@
+package app
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// the messages in proto/chat.proto, encoded by hand so building the app
+// doesn't need protoc. field numbers have to match the .proto file, which
+// TestProtoConformance checks
+
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(data []byte) error
+}
+
+// the grpc codec for the messages above. it's named proto so clients
+// generated from proto/chat.proto can talk to it without any setup
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("can't encode %T as a chat protobuf message", v)
+	}
+	return message.marshalProto(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("can't decode %T as a chat protobuf message", v)
+	}
+	return message.unmarshalProto(data)
+}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) String() string {
+	return "proto"
+}
+
+// proto3 leaves fields with their zero value out
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendVarint(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendMessage(b []byte, num protowire.Number, message protoMessage) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message.marshalProto())
+}
+
+// calls read with each field in the message. read returns how many bytes of
+// the field's value it consumed, or a negative number if it was malformed.
+// fields read doesn't know about have to be skipped with skipField
+func readFields(data []byte, read func(num protowire.Number, typ protowire.Type, value []byte) int) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n = read(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func skipField(num protowire.Number, typ protowire.Type, value []byte) int {
+	return protowire.ConsumeFieldValue(num, typ, value)
+}
+
+// returned by the read functions for a field sent as the wrong type. it's
+// outside protowire's error codes so ParseError reports a generic parse error
+const wrongWireType = -100
+
+// reads a string field, failing when it was sent as another type
+func readString(typ protowire.Type, value []byte, field *string) int {
+	if typ != protowire.BytesType {
+		return wrongWireType
+	}
+	var n int
+	*field, n = protowire.ConsumeString(value)
+	return n
+}
+
+func readVarint(typ protowire.Type, value []byte, field *uint64) int {
+	if typ != protowire.VarintType {
+		return wrongWireType
+	}
+	var n int
+	*field, n = protowire.ConsumeVarint(value)
+	return n
+}
+
+func readMessage(typ protowire.Type, value []byte, message protoMessage) int {
+	if typ != protowire.BytesType {
+		return wrongWireType
+	}
+	bytes, n := protowire.ConsumeBytes(value)
+	if n < 0 {
+		return n
+	}
+	if message.unmarshalProto(bytes) != nil {
+		return wrongWireType
+	}
+	return n
+}
+
+type Room struct {
+	Name string
+}
+
+func (m *Room) marshalProto() []byte {
+	return appendString(nil, 1, m.Name)
+}
+
+func (m *Room) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		if num == 1 {
+			return readString(typ, value, &m.Name)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type CreateRoomRequest struct {
+	Name string
+}
+
+func (m *CreateRoomRequest) marshalProto() []byte {
+	return appendString(nil, 1, m.Name)
+}
+
+func (m *CreateRoomRequest) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		if num == 1 {
+			return readString(typ, value, &m.Name)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type ListRoomsRequest struct{}
+
+func (m *ListRoomsRequest) marshalProto() []byte {
+	return nil
+}
+
+func (m *ListRoomsRequest) unmarshalProto(data []byte) error {
+	return readFields(data, skipField)
+}
+
+type ListRoomsResponse struct {
+	Rooms       []string
+	CurrentRoom string
+}
+
+func (m *ListRoomsResponse) marshalProto() []byte {
+	var b []byte
+	for _, room := range m.Rooms {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, room)
+	}
+	return appendString(b, 2, m.CurrentRoom)
+}
+
+func (m *ListRoomsResponse) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch num {
+		case 1:
+			var room string
+			n := readString(typ, value, &room)
+			m.Rooms = append(m.Rooms, room)
+			return n
+		case 2:
+			return readString(typ, value, &m.CurrentRoom)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type GetMessagesRequest struct {
+	Room string
+}
+
+func (m *GetMessagesRequest) marshalProto() []byte {
+	return appendString(nil, 1, m.Room)
+}
+
+func (m *GetMessagesRequest) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		if num == 1 {
+			return readString(typ, value, &m.Room)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type GetMessagesResponse struct {
+	Messages []*ChatMessage
+}
+
+func (m *GetMessagesResponse) marshalProto() []byte {
+	var b []byte
+	for _, message := range m.Messages {
+		b = appendMessage(b, 1, message)
+	}
+	return b
+}
+
+func (m *GetMessagesResponse) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		if num == 1 {
+			message := &ChatMessage{}
+			m.Messages = append(m.Messages, message)
+			return readMessage(typ, value, message)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type ChatMessage struct {
+	Room      string
+	User      string
+	Content   string
+	Timestamp string
+}
+
+func (m *ChatMessage) marshalProto() []byte {
+	b := appendString(nil, 1, m.Room)
+	b = appendString(b, 2, m.User)
+	b = appendString(b, 3, m.Content)
+	return appendString(b, 4, m.Timestamp)
+}
+
+func (m *ChatMessage) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch num {
+		case 1:
+			return readString(typ, value, &m.Room)
+		case 2:
+			return readString(typ, value, &m.User)
+		case 3:
+			return readString(typ, value, &m.Content)
+		case 4:
+			return readString(typ, value, &m.Timestamp)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type CreateInviteRequest struct {
+	Room          string
+	ExpirySeconds int64
+	MaxUses       int32
+}
+
+func (m *CreateInviteRequest) marshalProto() []byte {
+	b := appendString(nil, 1, m.Room)
+	b = appendVarint(b, 2, uint64(m.ExpirySeconds))
+	// negative int32s are sign extended to 64 bits on the wire
+	return appendVarint(b, 3, uint64(int64(m.MaxUses)))
+}
+
+func (m *CreateInviteRequest) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		var varint uint64
+		switch num {
+		case 1:
+			return readString(typ, value, &m.Room)
+		case 2:
+			n := readVarint(typ, value, &varint)
+			m.ExpirySeconds = int64(varint)
+			return n
+		case 3:
+			n := readVarint(typ, value, &varint)
+			m.MaxUses = int32(varint)
+			return n
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type InviteLink struct {
+	Code string
+	Url  string
+}
+
+func (m *InviteLink) marshalProto() []byte {
+	b := appendString(nil, 1, m.Code)
+	return appendString(b, 2, m.Url)
+}
+
+func (m *InviteLink) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch num {
+		case 1:
+			return readString(typ, value, &m.Code)
+		case 2:
+			return readString(typ, value, &m.Url)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type JoinRoomRequest struct {
+	Code string
+}
+
+func (m *JoinRoomRequest) marshalProto() []byte {
+	return appendString(nil, 1, m.Code)
+}
+
+func (m *JoinRoomRequest) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		if num == 1 {
+			return readString(typ, value, &m.Code)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type ChatRequest struct {
+	Room    string
+	Message string
+}
+
+func (m *ChatRequest) marshalProto() []byte {
+	b := appendString(nil, 1, m.Room)
+	return appendString(b, 2, m.Message)
+}
+
+func (m *ChatRequest) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch num {
+		case 1:
+			return readString(typ, value, &m.Room)
+		case 2:
+			return readString(typ, value, &m.Message)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+// only one of Message and Invitation is set
+type ChatEvent struct {
+	Id         uint64
+	Message    *ChatMessage
+	Invitation *Invitation
+}
+
+func (m *ChatEvent) marshalProto() []byte {
+	b := appendVarint(nil, 1, m.Id)
+	if m.Message != nil {
+		b = appendMessage(b, 2, m.Message)
+	} else if m.Invitation != nil {
+		b = appendMessage(b, 3, m.Invitation)
+	}
+	return b
+}
+
+func (m *ChatEvent) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch num {
+		case 1:
+			return readVarint(typ, value, &m.Id)
+		case 2:
+			m.Message, m.Invitation = &ChatMessage{}, nil
+			return readMessage(typ, value, m.Message)
+		case 3:
+			m.Message, m.Invitation = nil, &Invitation{}
+			return readMessage(typ, value, m.Invitation)
+		}
+		return skipField(num, typ, value)
+	})
+}
+
+type Invitation struct {
+	Id      int64
+	Room    string
+	Inviter string
+	Invitee string
+	Status  string
+	Created string
+	Expires string
+}
+
+func (m *Invitation) marshalProto() []byte {
+	b := appendVarint(nil, 1, uint64(m.Id))
+	b = appendString(b, 2, m.Room)
+	b = appendString(b, 3, m.Inviter)
+	b = appendString(b, 4, m.Invitee)
+	b = appendString(b, 5, m.Status)
+	b = appendString(b, 6, m.Created)
+	return appendString(b, 7, m.Expires)
+}
+
+func (m *Invitation) unmarshalProto(data []byte) error {
+	return readFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch num {
+		case 1:
+			var id uint64
+			n := readVarint(typ, value, &id)
+			m.Id = int64(id)
+			return n
+		case 2:
+			return readString(typ, value, &m.Room)
+		case 3:
+			return readString(typ, value, &m.Inviter)
+		case 4:
+			return readString(typ, value, &m.Invitee)
+		case 5:
+			return readString(typ, value, &m.Status)
+		case 6:
+			return readString(typ, value, &m.Created)
+		case 7:
+			return readString(typ, value, &m.Expires)
+		}
+		return skipField(num, typ, value)
+	})
+}
@@ -1,24 +1,34 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/scylladb/gocqlx/v2"
 	"github.com/scylladb/gocqlx/v2/table"
 	"github.com/sony/sonyflake"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"nhooyr.io/websocket"
 )
 
 const webUrl = "http://localhost:8000"
 
+var ErrRoomNotFound = errors.New("room not found")
+var ErrRoomExists = errors.New("room already exists")
+
+// chatroom names are 4 to 29 ascii characters
+const roomNameRules = "lt=30,gt=3,ascii"
+
 var messageMetaData = table.Metadata{
 	Name:    "messages",
 	Columns: []string{"chatroom_name", "user_id", "content", "message_id"},
@@ -62,58 +72,83 @@ type Chatroom struct {
 	Channel       chan MessageWithCtx
 	ScyllaSession *gocqlx.Session
 	Snowflake     *sonyflake.Sonyflake
+	Broker        Broker
 }
 
-func (room *Chatroom) addUser(conn *websocket.Conn, user string) {
-	client := ChatroomClient{Conn: conn, Id: user}
+// the app's clientsMutex has to be held, since broker events read and change
+// the room's clients from other goroutines
+func (room *Chatroom) addUser(events *EventQueue, user string) {
+	for _, client := range room.Clients {
+		if client.Events == events {
+			return
+		}
+	}
+	client := ChatroomClient{Events: events, Id: user}
 	room.Clients = append(room.Clients, &client)
 }
-func (room *Chatroom) Run() {
-	// ctx := context.Background()
+
+// saves and sends the room's messages until ctx is done. messages that are
+// already waiting on the channel then are still saved before it returns
+func (room *Chatroom) Run(ctx context.Context) {
 	for {
-		newMessage := <-room.Channel
-		ctx := newMessage.Ctx
-		message := newMessage.Message
-		_, span := otel.Tracer("").Start(ctx, "Saving message")
-		// room.Messages = append(room.Messages, newMessage)
-		// err := room.saveMessage(newMessage)
-		savedMsg, err := room.saveMessage(message)
-		// if there is an error saving the message there should be
-		// a way to communicate back to the user that sent the message
-		// that it was not sent successfully and should try again
-		if err != nil {
-			Sugar.Error("error saving message: ", err)
+		select {
+		case newMessage := <-room.Channel:
+			room.deliver(newMessage)
+		case <-ctx.Done():
+			for {
+				select {
+				case newMessage := <-room.Channel:
+					room.deliver(newMessage)
+				default:
+					return
+				}
+			}
 		}
-		// bytes, err := json.Marshal(newMessage)
+	}
+}
 
-		snowFlakeParts := sonyflake.Decompose(savedMsg.MessageId)
-		msgTime := snowFlakeParts["time"]
+func (room *Chatroom) deliver(newMessage MessageWithCtx) {
+	ctx := newMessage.Ctx
+	message := newMessage.Message
+	_, span := otel.Tracer("").Start(ctx, "Saving message")
+	// room.Messages = append(room.Messages, newMessage)
+	// err := room.saveMessage(newMessage)
+	savedMsg, err := room.saveMessage(message)
+	// if there is an error saving the message there should be
+	// a way to communicate back to the user that sent the message
+	// that it was not sent successfully and should try again
+	if err != nil {
+		Sugar.Error("error saving message: ", err)
+	}
+	// bytes, err := json.Marshal(newMessage)
 
-		outMessage := OutgoingMessage{
-			ChatroomName: savedMsg.ChatroomName,
-			UserId:       savedMsg.UserId,
-			Content:      savedMsg.Content,
-			Timestamp:    time.Unix(int64(msgTime/100), 0).Format(time.RFC3339),
-		}
+	snowFlakeParts := sonyflake.Decompose(savedMsg.MessageId)
+	msgTime := snowFlakeParts["time"]
 
-		savedMsg.MessageId = msgTime
+	outMessage := OutgoingMessage{
+		ChatroomName: savedMsg.ChatroomName,
+		UserId:       savedMsg.UserId,
+		Content:      savedMsg.Content,
+		Timestamp:    time.Unix(int64(msgTime/100), 0).Format(time.RFC3339),
+	}
 
-		bytes, err := json.Marshal(outMessage)
-		if err != nil {
-			span.RecordError(err)
-			Sugar.Error(err)
-		}
-		span.End()
-		ctx, span = otel.Tracer("").Start(ctx, "Writing message to users")
-		for i := range room.Clients {
-			// err = room.Clients[i].Conn.WriteMessage(websocket.TextMessage, bytes)
-			err = room.Clients[i].Conn.Write(ctx, websocket.MessageText, bytes)
-			if err != nil {
-				Sugar.Error("error writing message to user ws connection: ", err)
-			}
-		}
-		span.End()
+	savedMsg.MessageId = msgTime
+	span.End()
+
+	// every node, this one included, sends it to the members connected to
+	// it. the sender's context can already be done, like when they closed
+	// their websocket right after sending
+	_, span = otel.Tracer("").Start(ctx, "Publishing message")
+	err = room.Broker.Publish(context.Background(), BrokerEvent{
+		Kind:    BrokerMessage,
+		Room:    room.Id,
+		Message: &outMessage,
+	})
+	if err != nil {
+		Sugar.Error("error publishing message: ", err)
+		span.RecordError(err)
 	}
+	span.End()
 }
 
 func (room *Chatroom) saveMessage(chatMessage IncomingMessage) (Message, error) {
@@ -151,7 +186,7 @@ func NewChatroom() *Chatroom {
 
 // TODO think about tracking users and the rooms they are a part of
 func (app App) Create(writer http.ResponseWriter, req *http.Request) {
-	_, span := otel.Tracer("").Start(req.Context(), "CreateRoom")
+	ctx, span := otel.Tracer("").Start(req.Context(), "CreateRoom")
 	defer span.End()
 
 	err := req.ParseForm()
@@ -159,97 +194,41 @@ func (app App) Create(writer http.ResponseWriter, req *http.Request) {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "error parsing form")
 		Sugar.Error("error parsing form: ", err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeError(writer, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
 		return
 	}
 
-	roomName := req.FormValue("chatroom_name")
-	err = Validate.Var(roomName, "lt=30,gt=3,ascii")
+	roomName := roomParam(req)
+	err = Validate.Var(roomName, roomNameRules)
 	if err != nil {
 		Sugar.Error("chatroom name was not valid: ", err)
 		span.RecordError(err)
 		span.SetStatus(codes.Ok, "chatroom name was not valid")
-		writer.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	session, err := app.PgStore.Get(req, "session-name")
-	if err != nil {
-		Sugar.Error("error getting session name: ", err)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "error getting session name")
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if session.ID == "" {
-		Sugar.Error("Session was empty. Session was not found")
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "session was empty")
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeError(writer, req, http.StatusBadRequest, invalidVar(
+			"chatroom_name",
+			err,
+			"Chatroom names are 4 to 29 ascii characters",
+		))
 		return
 	}
 
-	username := session.Values["username"].(string)
+	username := currentUser(req)
 
-	room := NewChatroom()
-	room.Id = roomName
-	room.Snowflake = app.Snowflake
-	room.ScyllaSession = &app.ScyllaDb
-
-	newRoomForUser := struct {
-		User            string
-		CurrentChatroom string
-		Chatroom        string
-	}{
-		User:            username,
-		CurrentChatroom: roomName,
-		Chatroom:        roomName,
-	}
-
-	// TODO: assume these ccan fail
-	query := room.ScyllaSession.Query(userTable.Insert()).BindStruct(newRoomForUser)
-	err = query.ExecRelease()
-	if err != nil {
-		Sugar.Error("Error inserting new chatroom for user in user table: ", err)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "error inserting new chatroom for user in user table")
-		writer.WriteHeader(http.StatusInternalServerError)
+	room, err := app.createRoom(ctx, username, roomName)
+	if err == ErrRoomExists {
+		span.SetStatus(codes.Ok, "room already exists")
+		writeError(writer, req, http.StatusConflict, ErrorResponse{
+			Code:   "room_exists",
+			Fields: []FieldError{{Field: "chatroom_name", Code: "exists"}},
+		})
 		return
-	}
-
-	// TODO: assume these ccan fail and I will have to roll back the above scylla insert and
-	// PG insert
-	// query = room.ScyllaSession.Query(chatroomTable.Insert()).BindStruct(newRoomForUser)
-	// err = query.ExecRelease()
-	// if err != nil {
-	// 	Sugar.Error("Error inserting new chatroom into messages table: ", err)
-	// 	writer.WriteHeader(http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// TODO: assume these ccan fail and I will have to roll back the above scylla insert
-	_, err = app.Pg.Exec(
-		`INSERT INTO Rooms (name) VALUES ($1)`,
-		roomName,
-	)
-	if err != nil {
-		Sugar.Error("error inserting new chatroom into Rooms table: ", err)
+	} else if err != nil {
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "error inserting new chatroom into Rooms table")
-		writer.WriteHeader(http.StatusInternalServerError)
+		span.SetStatus(codes.Error, "error creating room")
+		writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
 
-	app.Clients[username].Chatrooms = append(app.Clients[username].Chatrooms, room.Id)
-	user := session.Values["username"].(string)
-	client := ChatroomClient{Id: app.Clients[user].Id, Conn: app.Clients[user].Conn}
-	room.Clients = append(room.Clients, &client)
-	app.ChatroomChannels[room.Id] = room.Channel
-	app.Chatrooms[room.Id] = room
-
-	go room.Run()
-
 	chatroomNameEncoded, err := json.Marshal(room.Id)
 	if err != nil {
 		Sugar.Error(err)
@@ -257,6 +236,7 @@ func (app App) Create(writer http.ResponseWriter, req *http.Request) {
 		span.SetStatus(codes.Error, "error mashalling room.Id")
 	}
 
+	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusCreated)
 	span.SetStatus(codes.Ok, "room was created")
 	_, err = writer.Write(chatroomNameEncoded)
@@ -264,15 +244,51 @@ func (app App) Create(writer http.ResponseWriter, req *http.Request) {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Error writing encoded chatroom name in response")
 		Sugar.Error("error writing chatroom name in response: ", err)
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
 	}
 }
 
-// TODO check to see if the user is actually a part of the chatroom
-// before they are allowed to create an invite
+// makes the user the owner and first member of a new room and starts it
+func (app App) createRoom(ctx context.Context, username string, roomName string) (*Chatroom, error) {
+	// the name is claimed before the user is made a member, so creating a
+	// room that already exists can't be used to join it
+	result, err := app.Pg.Exec(
+		`INSERT INTO Rooms (name, owner) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`,
+		roomName,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error inserting new chatroom into Rooms table: ", err)
+		return nil, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		Sugar.Error("error checking the new chatroom was inserted: ", err)
+		return nil, err
+	}
+	if inserted == 0 {
+		return nil, ErrRoomExists
+	}
+
+	err = addUserChatroom(ctx, app.ScyllaDb, username, roomName)
+	if err != nil {
+		Sugar.Error("Error inserting new chatroom for user in user table: ", err)
+		// frees the name so creating the room can be tried again
+		_, deleteErr := app.Pg.Exec(`DELETE FROM Rooms WHERE name = $1 AND owner = $2`, roomName, username)
+		if deleteErr != nil {
+			Sugar.Error("error removing chatroom that couldn't be created: ", deleteErr)
+		}
+		return nil, err
+	}
+
+	room := app.localRoom(roomName)
+	// the creator's connections on any node start getting the room's messages
+	app.publish(ctx, BrokerEvent{Kind: BrokerJoined, Room: roomName, User: username})
+
+	return room, nil
+}
+
 func (app App) CreateInvite(w http.ResponseWriter, req *http.Request) {
-	_, span := otel.Tracer("").Start(req.Context(), "CreateInvite")
+	ctx, span := otel.Tracer("").Start(req.Context(), "CreateInvite")
 	defer span.End()
 
 	err := req.ParseForm()
@@ -280,46 +296,102 @@ func (app App) CreateInvite(w http.ResponseWriter, req *http.Request) {
 		Sugar.Error("error parsing form for create invite: ", err)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "error parsing form for create invite")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
 		return
 	}
-	roomName := req.FormValue("chatroom_name")
+	roomName := roomParam(req)
 
-	var inviteTimeLimit InviteTimeLimit
-	switch timeLimit := req.FormValue("invite_timelimit"); timeLimit {
-	case "1 day":
-		inviteTimeLimit = InviteTimeLimit{
-			limit: 1,
-		}
-	case "1 week":
-		inviteTimeLimit = InviteTimeLimit{
-			limit: 7,
+	username := currentUser(req)
+
+	allowed, err := app.canInvite(ctx, username, roomName)
+	if err == ErrRoomNotFound {
+		span.SetStatus(codes.Ok, "room not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "room_not_found"})
+		return
+	} else if err != nil {
+		Sugar.Error("error checking invite permission: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error checking invite permission")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if !allowed {
+		span.SetStatus(codes.Ok, "user is not allowed to invite people to room")
+		writeError(w, req, http.StatusForbidden, ErrorResponse{
+			Code:   "invite_forbidden",
+			Detail: "Only members allowed to invite people can create invites",
+		})
+		return
+	}
+
+	maxUses := 0
+	if value := req.FormValue("max_uses"); value != "" {
+		maxUses, err = strconv.Atoi(value)
+		if err != nil || maxUses < 0 {
+			span.AddEvent("InviteBadRequest")
+			span.SetStatus(codes.Ok, fmt.Sprintf("bad max uses: %v", value))
+			writeError(w, req, http.StatusBadRequest, invalidField(
+				"max_uses",
+				"min",
+				"Max uses must be a number that is 0 or greater",
+			))
+			return
 		}
-	case "Forever":
-		inviteTimeLimit = InviteTimeLimit{
-			// this will represent infinity
-			limit: 0,
+	}
+
+	var expiry time.Duration
+	// an expiry like "36h" takes precedence over the fixed time limits
+	if value := req.FormValue("invite_expiry"); value != "" {
+		expiry, err = time.ParseDuration(value)
+		if err != nil || expiry < 0 {
+			span.AddEvent("InviteBadRequest")
+			span.SetStatus(codes.Ok, fmt.Sprintf("bad invite expiry: %v", value))
+			writeError(w, req, http.StatusBadRequest, invalidField(
+				"invite_expiry",
+				"duration",
+				"Expiry must be a duration such as 12h or 90m",
+			))
+			return
 		}
-	default:
-		span.AddEvent("InviteBadRequest")
-		span.SetStatus(codes.Ok, fmt.Sprintf("bad invite: %v", timeLimit))
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("Expiry value is not one of the possible choices"))
-		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, "error writing response")
-			Sugar.Error(req.FormValue("invite_timelimit"), err)
-			w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		var inviteTimeLimit InviteTimeLimit
+		switch timeLimit := req.FormValue("invite_timelimit"); timeLimit {
+		case "1 day":
+			inviteTimeLimit = InviteTimeLimit{
+				limit: Day,
+			}
+		case "1 week":
+			inviteTimeLimit = InviteTimeLimit{
+				limit: Week,
+			}
+		case "Forever":
+			inviteTimeLimit = InviteTimeLimit{
+				// this will represent infinity
+				limit: Never,
+			}
+		default:
+			span.AddEvent("InviteBadRequest")
+			span.SetStatus(codes.Ok, fmt.Sprintf("bad invite: %v", timeLimit))
+			writeError(w, req, http.StatusBadRequest, invalidField(
+				"invite_timelimit",
+				"oneof",
+				"Expiry value is not one of the possible choices",
+			))
+			return
 		}
-		return
+		expiry = inviteTimeLimit.duration()
 	}
 
-	inviteCode, err := app.Invitations.createInvite(roomName, inviteTimeLimit)
+	inviteCode, err := app.Invitations.createInvite(roomName, InviteOptions{
+		Creator: username,
+		Expiry:  expiry,
+		MaxUses: maxUses,
+	})
 	if err != nil {
 		Sugar.Error(err)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "invite code not successfully created")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
 
@@ -328,9 +400,10 @@ func (app App) CreateInvite(w http.ResponseWriter, req *http.Request) {
 		Sugar.Error(err)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "marshalling failed")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	span.SetStatus(codes.Ok, "invite code created")
 
@@ -344,62 +417,355 @@ func (app App) CreateInvite(w http.ResponseWriter, req *http.Request) {
 }
 
 func (app App) Join(writer http.ResponseWriter, req *http.Request) {
-	_, span := otel.Tracer("").Start(req.Context(), "JoinRoom")
+	ctx, span := otel.Tracer("").Start(req.Context(), "JoinRoom")
 	defer span.End()
 
-	inviteCode := strings.Split(req.URL.String(), "/api/room/join/")[1]
-	chatroomName, err := app.Invitations.getChatroom(inviteCode)
-	// TODO: I will need to handle multiple errors here
-	// inviteNoteFound
-	// DatabaseError
+	user := currentUser(req)
+
+	chatroomName, err := app.joinWithInvite(ctx, user, chi.URLParam(req, "code"))
+	if err != nil {
+		writeInviteError(writer, req, span, err)
+		return
+	}
+
+	// writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
+	name, err := json.Marshal(chatroomName)
 	if err != nil {
 		Sugar.Error(err)
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "")
-		writer.WriteHeader(http.StatusInternalServerError)
+		span.SetStatus(codes.Error, "error masharlling chatroom name")
+		writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	span.SetStatus(codes.Ok, "successfully joined chatroom")
+	_, err = writer.Write(name)
+	if err != nil {
+		Sugar.Error("error writing chatroom name in response: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error writing chatroom name in response")
+	}
+}
+
+// uses the invite to make the user a member of its room and returns the
+// room's name. the errors are the ones writeInviteError knows about
+func (app App) joinWithInvite(ctx context.Context, username string, inviteCode string) (string, error) {
+	invite, err := app.Invitations.getInvite(inviteCode)
+	if err == nil {
+		err = invite.usable(time.Now())
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// an invite is only as good as its creator's permission to invite people
+	allowed, err := app.canInvite(ctx, invite.Creator, invite.Chatroom)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", ErrInviteForbidden
+	}
+
+	// members following a link to their own room don't use up an invite
+	// meant for someone else
+	member, err := isRoomMember(ctx, app.ScyllaDb, username, invite.Chatroom)
+	if err != nil {
+		return "", err
+	}
+	if member {
+		return invite.Chatroom, nil
+	}
+
+	chatroomName, err := app.Invitations.useInvite(inviteCode)
+	if err != nil {
+		return "", err
+	}
 	Sugar.Info(inviteCode, chatroomName)
 
-	session, err := app.PgStore.Get(req, "session-name")
+	err = app.joinRoom(ctx, username, chatroomName)
+	if err != nil {
+		Sugar.Error("error adding chatroom to user: ", err)
+		return "", err
+	}
+
+	return chatroomName, nil
+}
+
+// makes the user a member of the room and starts sending them its messages
+// if they are connected
+func (app App) joinRoom(ctx context.Context, username string, roomName string) error {
+	err := addUserChatroom(ctx, app.ScyllaDb, username, roomName)
 	if err != nil {
-		Sugar.Error("err getting session name: ", err)
+		return err
+	}
+
+	app.publish(ctx, BrokerEvent{Kind: BrokerJoined, Room: roomName, User: username})
+	return nil
+}
+
+// responds with the status and error code that matches why an invite
+// couldn't be used
+func writeInviteError(w http.ResponseWriter, req *http.Request, span trace.Span, err error) {
+	var status int
+	var code string
+	switch err {
+	case ErrInviteNotFound:
+		status, code = http.StatusNotFound, "invite_not_found"
+	case ErrInviteExpired:
+		status, code = http.StatusGone, "invite_expired"
+	case ErrInviteRevoked:
+		status, code = http.StatusGone, "invite_revoked"
+	case ErrInviteExhausted:
+		status, code = http.StatusGone, "invite_exhausted"
+	case ErrInviteForbidden:
+		status, code = http.StatusForbidden, "invite_forbidden"
+	case ErrRoomNotFound:
+		status, code = http.StatusNotFound, "room_not_found"
+	default:
+		Sugar.Error(err)
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "error getting session name")
-		writer.WriteHeader(http.StatusInternalServerError)
+		span.SetStatus(codes.Error, "")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
 
-	user := session.Values["username"].(string)
-	client := ChatroomClient{Id: app.Clients[user].Id, Conn: app.Clients[user].Conn}
+	span.SetStatus(codes.Ok, err.Error())
+	writeError(w, req, status, ErrorResponse{Code: code, Detail: err.Error()})
+}
 
-	app.Chatrooms[chatroomName].Clients = append(app.Chatrooms[chatroomName].Clients, &client)
-	// todo add chatroom to user also
+type RoomSettings struct {
+	Owner            string `json:"owner"`
+	MembersCanInvite bool   `json:"members_can_invite"`
+}
 
-	// writer.WriteHeader(http.StatusInternalServerError)
-	name, err := json.Marshal(chatroomName)
+func (app App) getRoomSettings(roomName string) (RoomSettings, error) {
+	row := app.Pg.QueryRow(
+		`SELECT owner, members_can_invite FROM Rooms WHERE name=$1`,
+		roomName,
+	)
+
+	var settings RoomSettings
+	err := row.Scan(&settings.Owner, &settings.MembersCanInvite)
+	if err == sql.ErrNoRows {
+		return RoomSettings{}, ErrRoomNotFound
+	} else if err != nil {
+		Sugar.Error("err scanning row: ", err)
+		return RoomSettings{}, err
+	}
+
+	return settings, nil
+}
+
+// a user can invite people to a room if they are a member of it and either
+// own the room or the room lets its members invite people
+func (app App) canInvite(ctx context.Context, username string, roomName string) (bool, error) {
+	settings, err := app.getRoomSettings(roomName)
 	if err != nil {
-		Sugar.Error(err)
+		return false, err
+	}
+
+	member, err := isRoomMember(ctx, app.ScyllaDb, username, roomName)
+	if err != nil {
+		return false, err
+	}
+	if !member {
+		return false, nil
+	}
+
+	return settings.Owner == username || settings.MembersCanInvite, nil
+}
+
+func (app App) ListInvites(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ListInvites")
+	defer span.End()
+
+	roomName := roomParam(req)
+	if roomName == "" {
+		span.SetStatus(codes.Ok, "chatroom name was missing")
+		writeError(w, req, http.StatusBadRequest, invalidField("chatroom_name", "required", ""))
+		return
+	}
+
+	username := currentUser(req)
+
+	allowed, err := app.canInvite(ctx, username, roomName)
+	if err == ErrRoomNotFound {
+		span.SetStatus(codes.Ok, "room not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "room_not_found"})
+		return
+	} else if err != nil {
+		Sugar.Error("error checking invite permission: ", err)
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "error masharlling chatroom name")
-		writer.WriteHeader(http.StatusInternalServerError)
+		span.SetStatus(codes.Error, "error checking invite permission")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if !allowed {
+		span.SetStatus(codes.Ok, "user is not allowed to see the room's invites")
+		writeError(w, req, http.StatusForbidden, ErrorResponse{
+			Code:   "invite_forbidden",
+			Detail: "Only members allowed to invite people can see the room's invites",
+		})
 		return
 	}
 
-	writer.WriteHeader(http.StatusAccepted)
-	span.SetStatus(codes.Ok, "successfully joined chatroom")
-	_, err = writer.Write(name)
+	invites, err := app.Invitations.activeInvites(roomName)
 	if err != nil {
-		Sugar.Error("error writing chatroom name in response: ", err)
+		Sugar.Error("error getting active invites: ", err)
 		span.RecordError(err)
-		writer.WriteHeader(http.StatusInternalServerError)
-		span.SetStatus(codes.Error, "error writing chatroom name in response")
+		span.SetStatus(codes.Error, "error getting active invites")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	invitesJson, err := json.Marshal(invites)
+	if err != nil {
+		Sugar.Error("error marshalling invites: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error marshalling invites")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(invitesJson)
+}
+
+func (app App) RevokeInvite(w http.ResponseWriter, req *http.Request) {
+	_, span := otel.Tracer("").Start(req.Context(), "RevokeInvite")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for revoke invite: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error parsing form for revoke invite")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
+		return
+	}
+
+	username := currentUser(req)
+
+	// the legacy route takes the code from the form instead of the path
+	code := chi.URLParam(req, "code")
+	if code == "" {
+		code = req.FormValue("invite")
+	}
+	invite, err := app.Invitations.getInvite(code)
+	if err == ErrInviteNotFound {
+		span.SetStatus(codes.Ok, "invite not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "invite_not_found"})
+		return
+	} else if err != nil {
+		Sugar.Error("error getting invite: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error getting invite")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	// invites can be revoked by whoever created them or by the room's owner
+	if invite.Creator != username {
+		settings, err := app.getRoomSettings(invite.Chatroom)
+		if err != nil && err != ErrRoomNotFound {
+			Sugar.Error("error getting room settings: ", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "error getting room settings")
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
+		}
+		if settings.Owner != username {
+			span.SetStatus(codes.Ok, "user is not allowed to revoke the invite")
+			writeError(w, req, http.StatusForbidden, ErrorResponse{
+				Code:   "not_room_owner",
+				Detail: "Invites can only be revoked by their creator or the room's owner",
+			})
+			return
+		}
+	}
+
+	err = app.Invitations.revokeInvite(invite.Code)
+	if err != nil {
+		Sugar.Error("error revoking invite: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error revoking invite")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "invite revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lets the owner of a room decide whether its members can invite people
+func (app App) UpdateRoomSettings(w http.ResponseWriter, req *http.Request) {
+	_, span := otel.Tracer("").Start(req.Context(), "UpdateRoomSettings")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for room settings: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error parsing form for room settings")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
+		return
+	}
+	roomName := roomParam(req)
+
+	membersCanInvite, err := strconv.ParseBool(req.FormValue("members_can_invite"))
+	if err != nil {
+		span.SetStatus(codes.Ok, "members_can_invite was not a boolean")
+		writeError(w, req, http.StatusBadRequest, invalidField("members_can_invite", "boolean", ""))
+		return
+	}
+
+	username := currentUser(req)
+
+	settings, err := app.getRoomSettings(roomName)
+	if err == ErrRoomNotFound {
+		span.SetStatus(codes.Ok, "room not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "room_not_found"})
+		return
+	} else if err != nil {
+		Sugar.Error("error getting room settings: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error getting room settings")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if settings.Owner != username {
+		span.SetStatus(codes.Ok, "only the owner can change room settings")
+		writeError(w, req, http.StatusForbidden, ErrorResponse{
+			Code:   "not_room_owner",
+			Detail: "Only the room's owner can change its settings",
+		})
+		return
+	}
+
+	_, err = app.Pg.Exec(
+		`UPDATE Rooms SET members_can_invite=$1 WHERE name=$2`,
+		membersCanInvite,
+		roomName,
+	)
+	if err != nil {
+		Sugar.Error("error updating room settings: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error updating room settings")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
 	}
+
+	span.SetStatus(codes.Ok, "room settings updated")
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// TODO add channel that would allow breaking out of this function
-// might be necessary
-func RemoveExpiredInvites(db *sql.DB, interval time.Duration) {
+// deletes expired invites every interval until ctx is done
+func RemoveExpiredInvites(ctx context.Context, db *sql.DB, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 
 	defer func() {
@@ -408,10 +774,12 @@ func RemoveExpiredInvites(db *sql.DB, interval time.Duration) {
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 
 		case <-ticker.C:
-			_, err := db.Exec("DELETE FROM Invites WHERE expires < now()")
-			if err != nil {
+			_, err := db.ExecContext(ctx, "DELETE FROM Invites WHERE expires < now()")
+			if err != nil && ctx.Err() == nil {
 				log.Printf("Unable to delete invites: %v", err)
 			}
 		}
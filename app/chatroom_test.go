@@ -1,16 +1,23 @@
 package app
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/jackc/pgx"
 	"github.com/jackc/pgx/stdlib"
 	"github.com/joho/godotenv"
@@ -111,12 +118,46 @@ func TestMain(m *testing.M) {
 }
 
 func newTestApplication() *App {
+	return newTestNode(NodeConfig{})
+}
+
+// an application that can share its rooms with other test nodes through
+// the node's broker
+func newTestNode(node NodeConfig) *App {
 	InitLogger()
 	err := godotenv.Load("../.env")
 	if err != nil {
 		Sugar.Fatalw("Error loading .env file: ", err)
 	}
 
+	pgConfig := testPgConfig()
+
+	scyllaHost, ok := os.LookupEnv("SCYLLA_HOST")
+	if !ok {
+		Sugar.Fatal("Could not find SCYLLA_HOST env")
+	}
+	scyllaKeyspace, ok := os.LookupEnv("KEYSPACE")
+	if !ok {
+		Sugar.Fatal("Could not find KEYSPACE env")
+	}
+	scyConfig := ScyllaConfig{
+		Host:     scyllaHost,
+		Keyspace: scyllaKeyspace,
+	}
+
+	testApp := NewApp(pgConfig, scyConfig, node, "../templates/*.html")
+	spec, err := LoadOpenAPI("../api.yaml")
+	if err != nil {
+		Sugar.Fatal("Could not load api.yaml: ", err)
+	}
+	// fail any test whose responses aren't what api.yaml says they are
+	testApp.Spec = spec
+	testApp.CheckResponses = true
+	return testApp
+}
+
+// the test database, from the PGTEST variables in .env
+func testPgConfig() PgConfig {
 	pgHost, ok := os.LookupEnv("PGTEST_HOST")
 	if !ok {
 		Sugar.Fatal("Could not find POSTGRES_HOST env")
@@ -141,29 +182,38 @@ func newTestApplication() *App {
 	if err != nil {
 		Sugar.Fatalf("Could not convert POSTGRES_PORT to a number. %v", pgPortStr)
 	}
-	pgConfig := PgConfig{
+	return PgConfig{
 		Host:     pgHost,
 		Db:       pgDb,
 		User:     pgUser,
 		Password: pgPassword,
 		Port:     uint16(pgPort),
 	}
+}
 
-	scyllaHost, ok := os.LookupEnv("SCYLLA_HOST")
-	if !ok {
-		Sugar.Fatal("Could not find SCYLLA_HOST env")
-	}
-	scyllaKeyspace, ok := os.LookupEnv("KEYSPACE")
-	if !ok {
-		Sugar.Fatal("Could not find KEYSPACE env")
-	}
-	scyConfig := ScyllaConfig{
-		Host:     scyllaHost,
-		Keyspace: scyllaKeyspace,
+// sends the csrf cookie back in a header like the frontend does, making one
+// up when the server hasn't set it yet
+type csrfTransport struct {
+	base http.RoundTripper
+}
+
+func (transport csrfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if safeMethod(req.Method) || req.Header.Get(csrfHeader) != "" {
+		return transport.base.RoundTrip(req)
 	}
 
-	testApp := NewApp(pgConfig, scyConfig, "../templates/*.html")
-	return testApp
+	req = req.Clone(req.Context())
+	cookie, err := req.Cookie(csrfCookie)
+	if err != nil {
+		token, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		cookie = &http.Cookie{Name: csrfCookie, Value: token}
+		req.AddCookie(cookie)
+	}
+	req.Header.Set(csrfHeader, cookie.Value)
+	return transport.base.RoundTrip(req)
 }
 
 func serverSetup() (*httptest.Server, *http.Client, error) {
@@ -176,6 +226,7 @@ func serverSetup() (*httptest.Server, *http.Client, error) {
 	var err error
 
 	client := server.Client()
+	client.Transport = csrfTransport{client.Transport}
 	client.Jar, err = cookiejar.New(nil)
 	if err != nil {
 		return nil, nil, err
@@ -193,6 +244,7 @@ func authenticatedSetup() (*httptest.Server, *http.Client, *websocket.Conn, erro
 	var err error
 
 	client := server.Client()
+	client.Transport = csrfTransport{client.Transport}
 	client.Jar, err = cookiejar.New(nil)
 
 	// signup user
@@ -205,6 +257,10 @@ func authenticatedSetup() (*httptest.Server, *http.Client, *websocket.Conn, erro
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	err = verifyEmail(server.URL, client, "kup@gmail.com")
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	// login user
 	form = url.Values{}
@@ -230,6 +286,70 @@ func authenticatedSetup() (*httptest.Server, *http.Client, *websocket.Conn, erro
 	return server, client, conn, nil
 }
 
+// signs up and logs in another user with their own cookie jar
+func secondUserClient(serverUrl string, client *http.Client, username string, email string) (*http.Client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	other := &http.Client{Transport: client.Transport, Jar: jar}
+
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("email", email)
+	form.Set("password", "secretpassy")
+	form.Set("confirmPassword", "secretpassy")
+	_, err = other.PostForm(serverUrl+"/api/user/signup", form)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyEmail(serverUrl, other, email)
+	if err != nil {
+		return nil, err
+	}
+
+	form = url.Values{}
+	form.Set("email", email)
+	form.Set("password", "secretpassy")
+	_, err = other.PostForm(serverUrl+"/api/user/login", form)
+	if err != nil {
+		return nil, err
+	}
+
+	return other, nil
+}
+
+// the most recent email the test application sent to the address
+func lastMailTo(to string) (Mail, bool) {
+	sent := application.Mailer.(*MemoryMailer).Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To == to {
+			return sent[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+// follows the link in the verification email sent to the address
+func verifyEmail(serverUrl string, client *http.Client, to string) error {
+	mail, ok := lastMailTo(to)
+	if !ok {
+		return fmt.Errorf("no email was sent to %v", to)
+	}
+	link := regexp.MustCompile(`http\S+/api/user/verify\?token=\S+`).FindString(mail.Body)
+	if link == "" {
+		return fmt.Errorf("email to %v did not contain a verification link: %v", to, mail.Body)
+	}
+	path := link[strings.Index(link, "/api/"):]
+
+	res, err := client.Get(serverUrl + path)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
 func databaseReset() {
 	_, err := application.Pg.Exec("DROP TABLE IF EXISTS http_sessions")
 	if err != nil {
@@ -239,6 +359,62 @@ func databaseReset() {
 	if err != nil {
 		Sugar.Errorf("error dropping table invites: %v", err)
 	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS emailverifications")
+	if err != nil {
+		Sugar.Errorf("error dropping table emailverifications: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS passwordresets")
+	if err != nil {
+		Sugar.Errorf("error dropping table passwordresets: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS twofactor")
+	if err != nil {
+		Sugar.Errorf("error dropping table twofactor: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS recoverycodes")
+	if err != nil {
+		Sugar.Errorf("error dropping table recoverycodes: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS loginchallenges")
+	if err != nil {
+		Sugar.Errorf("error dropping table loginchallenges: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS oidclogins")
+	if err != nil {
+		Sugar.Errorf("error dropping table oidclogins: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS useridentities")
+	if err != nil {
+		Sugar.Errorf("error dropping table useridentities: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS accountjobs")
+	if err != nil {
+		Sugar.Errorf("error dropping table accountjobs: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS loginfailures")
+	if err != nil {
+		Sugar.Errorf("error dropping table loginfailures: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS securityevents")
+	if err != nil {
+		Sugar.Errorf("error dropping table securityevents: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS previoususernames")
+	if err != nil {
+		Sugar.Errorf("error dropping table previoususernames: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS usersessions")
+	if err != nil {
+		Sugar.Errorf("error dropping table usersessions: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS apitokens")
+	if err != nil {
+		Sugar.Errorf("error dropping table apitokens: %v", err)
+	}
+	_, err = application.Pg.Exec("DROP TABLE IF EXISTS userinvites")
+	if err != nil {
+		Sugar.Errorf("error dropping table userinvites: %v", err)
+	}
 	_, err = application.Pg.Exec("DROP TABLE IF EXISTS rooms")
 	if err != nil {
 		Sugar.Errorf("error dropping table rooms: %v", err)
@@ -285,6 +461,30 @@ func TestCreateRoom(t *testing.T) {
 	if err != nil {
 		t.Errorf("error closing body: %v", err)
 	}
+
+	// creating a room that exists doesn't make another user a member of it
+	bob, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+	res, err = bob.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var problem ErrorResponse
+	err = json.NewDecoder(res.Body).Decode(&problem)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict || err != nil || problem.Code != "room_exists" {
+		t.Errorf("Existing room was created again. Received status code %v and %+v, wanted %v room_exists", res.StatusCode, problem, http.StatusConflict)
+	}
+	res, err = bob.Get(server.URL + "/api/v1/rooms/" + url.PathEscape("test chatroom") + "/messages")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Creating an existing room made bob a member. Received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
 }
 
 func TestCreateRoomUnauthenticated(t *testing.T) {
@@ -300,3 +500,1057 @@ func TestCreateRoomUnauthenticated(t *testing.T) {
 		t.Errorf("handled returned wrong status code: got %v want %v", res.StatusCode, http.StatusInternalServerError)
 	}
 }
+
+// creates a room and an invite for it, returning the invite code
+func createRoomAndInvite(client *http.Client, serverUrl string, invite url.Values) (string, error) {
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err := client.PostForm(serverUrl+"/api/room/create", form)
+	if err != nil {
+		return "", err
+	}
+
+	invite.Set("chatroom_name", "test chatroom")
+	res, err := client.PostForm(serverUrl+"/api/room/invite", invite)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var inviteUrl string
+	err = json.NewDecoder(res.Body).Decode(&inviteUrl)
+	if err != nil {
+		return "", err
+	}
+
+	return inviteUrl[strings.LastIndex(inviteUrl, "/")+1:], nil
+}
+
+func TestJoinExhaustedInvite(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	invite := url.Values{}
+	invite.Set("invite_expiry", "1h")
+	invite.Set("max_uses", "1")
+	code, err := createRoomAndInvite(client, server.URL, invite)
+	if err != nil {
+		t.Fatalf("err creating invite: %v", err)
+	}
+
+	// a member following the link doesn't use it up
+	res, err := client.Post(server.URL+"/api/room/join/"+code, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	bob, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+	res, err = bob.Post(server.URL+"/api/room/join/"+code, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	carol, err := secondUserClient(server.URL, client, "carol", "carol@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up third user: %v", err)
+	}
+	res, err = carol.Post(server.URL+"/api/room/join/"+code, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusGone)
+	}
+}
+
+func TestRevokeInvite(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	invite := url.Values{}
+	invite.Set("invite_timelimit", "Forever")
+	code, err := createRoomAndInvite(client, server.URL, invite)
+	if err != nil {
+		t.Fatalf("err creating invite: %v", err)
+	}
+
+	res, err := client.Get(server.URL + "/api/room/invites?chatroom_name=" + url.QueryEscape("test chatroom"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var invites []Invite
+	err = json.NewDecoder(res.Body).Decode(&invites)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding invites: %v", err)
+	}
+	if len(invites) != 1 || invites[0].Code != code {
+		t.Fatalf("expected invite %v to be listed, got %v", code, invites)
+	}
+
+	form := url.Values{}
+	form.Set("invite", code)
+	res, err = client.PostForm(server.URL+"/api/room/invite/revoke", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	res, err = client.Post(server.URL+"/api/room/join/"+code, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusGone)
+	}
+}
+
+func TestJoinExpiredInvite(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	invite := url.Values{}
+	invite.Set("invite_expiry", "1ns")
+	code, err := createRoomAndInvite(client, server.URL, invite)
+	if err != nil {
+		t.Fatalf("err creating invite: %v", err)
+	}
+
+	res, err := client.Post(server.URL+"/api/room/join/"+code, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusGone)
+	}
+	var problem ErrorResponse
+	err = json.NewDecoder(res.Body).Decode(&problem)
+	res.Body.Close()
+	if err != nil || problem.Code != "invite_expired" {
+		t.Errorf("Expired invite had error code %q (%v), wanted invite_expired", problem.Code, err)
+	}
+
+	res, err = client.Post(server.URL+"/api/room/join/doesnotexist", "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCreateInviteForUnjoinedRoom(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	_, err = application.Pg.Exec(`INSERT INTO Rooms (name, owner) VALUES ('someone elses room', 'someone')`)
+	if err != nil {
+		t.Fatalf("err inserting room: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("chatroom_name", "someone elses room")
+	form.Set("invite_timelimit", "1 day")
+	res, err := client.PostForm(server.URL+"/api/room/invite", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestInviteCodeFormats(t *testing.T) {
+	tests := []struct {
+		format  InviteCodeFormat
+		pattern string
+	}{
+		{InviteCodeRandom, `^[a-zA-Z0-9]{10}$`},
+		{InviteCodeGrouped, `^[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}$`},
+		{InviteCodeWords, `^[a-z]+(-[a-z]+){4}$`},
+	}
+
+	for _, test := range tests {
+		config, err := NewInviteCodeConfig(test.format, 0, "")
+		if err != nil {
+			t.Fatalf("err creating %v invite code config: %v", test.format, err)
+		}
+
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			code, err := config.generate()
+			if err != nil {
+				t.Fatalf("err generating %v invite code: %v", test.format, err)
+			}
+			if !regexp.MustCompile(test.pattern).MatchString(code) {
+				t.Errorf("%v invite code %q did not match %v", test.format, code, test.pattern)
+			}
+			if seen[code] {
+				t.Errorf("%v invite code %q was generated twice", test.format, code)
+			}
+			seen[code] = true
+		}
+	}
+}
+
+func TestInviteCodeConfigValidation(t *testing.T) {
+	_, err := NewInviteCodeConfig(InviteCodeRandom, 2, "")
+	if err == nil {
+		t.Error("expected invite codes shorter than 4 to be rejected")
+	}
+	_, err = NewInviteCodeConfig(InviteCodeRandom, 8, "aab")
+	if err == nil {
+		t.Error("expected alphabet with repeated characters to be rejected")
+	}
+	_, err = NewInviteCodeConfig("emoji", 8, "")
+	if err == nil {
+		t.Error("expected unknown format to be rejected")
+	}
+	_, err = NewInviteCodeConfig(InviteCodeRandom, 4, "ab")
+	if err == nil {
+		t.Error("expected invite codes with only 16 possibilities to be rejected")
+	}
+	_, err = NewInviteCodeConfig(InviteCodeGrouped, 7, "")
+	if err == nil {
+		t.Error("expected grouped invite codes under 40 bits to be rejected")
+	}
+}
+
+func TestInviteCodeNormalization(t *testing.T) {
+	grouped, _ := NewInviteCodeConfig(InviteCodeGrouped, 0, "")
+	words, _ := NewInviteCodeConfig(InviteCodeWords, 0, "")
+	random := DefaultInviteCodeConfig()
+	tests := []struct {
+		config InviteCodeConfig
+		typed  string
+		code   string
+	}{
+		{grouped, "7KQD-M2XA", "7KQD-M2XA"},
+		{grouped, "7kqd-m2xa", "7KQD-M2XA"},
+		{grouped, " 7kqd m2xa ", "7KQD-M2XA"},
+		{grouped, "7KQDM2XA", "7KQD-M2XA"},
+		{grouped, "O1IL-l0oA", "0111-100A"},
+		{words, "Lamp River oak-hint  sand", "lamp-river-oak-hint-sand"},
+		{random, " aZ3kP9qXoL ", "aZ3kP9qXoL"},
+	}
+
+	for _, test := range tests {
+		if code := test.config.normalize(test.typed); code != test.code {
+			t.Errorf("%v invite code %q was read as %q, wanted %q", test.config.Format, test.typed, code, test.code)
+		}
+	}
+}
+
+func TestDeclineTargetedInvite(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	bob, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	form.Set("username", "bob")
+	res, err := client.PostForm(server.URL+"/api/room/invite/user", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusCreated)
+	}
+
+	res, err = bob.Get(server.URL + "/api/user/invitations")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var pending []TargetedInvite
+	err = json.NewDecoder(res.Body).Decode(&pending)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding invitations: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Inviter != "artemis" {
+		t.Fatalf("expected one pending invitation from artemis, got %v", pending)
+	}
+
+	res, err = bob.Post(
+		server.URL+"/api/user/invitations/"+strconv.FormatInt(pending[0].Id, 10)+"/decline",
+		"application/x-www-form-urlencoded",
+		strings.NewReader(""),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	res, err = client.Get(server.URL + "/api/user/invitations/sent")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var sent []TargetedInvite
+	err = json.NewDecoder(res.Body).Decode(&sent)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding sent invitations: %v", err)
+	}
+	if len(sent) != 1 || sent[0].Status != InvitationDeclined {
+		t.Errorf("expected the sent invitation to be declined, got %v", sent)
+	}
+}
+
+func TestAcceptInvitationAfterInvitesDisabled(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	code, err := createRoomAndInvite(client, server.URL, url.Values{})
+	if err != nil {
+		t.Fatalf("err creating room and invite: %v", err)
+	}
+	bob, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+	carol, err := secondUserClient(server.URL, client, "carol", "carol@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up third user: %v", err)
+	}
+	_, err = bob.Post(server.URL+"/api/room/join/"+code, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// bob invites carol as a member, then the owner stops members inviting
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	form.Set("username", "carol")
+	res, err := bob.PostForm(server.URL+"/api/room/invite/user", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusCreated)
+	}
+	form = url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	form.Set("members_can_invite", "false")
+	_, err = client.PostForm(server.URL+"/api/room/settings", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	res, err = carol.Get(server.URL + "/api/user/invitations")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var pending []TargetedInvite
+	err = json.NewDecoder(res.Body).Decode(&pending)
+	res.Body.Close()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected one pending invitation, got %v (%v)", pending, err)
+	}
+
+	res, err = carol.Post(
+		server.URL+"/api/user/invitations/"+strconv.FormatInt(pending[0].Id, 10)+"/accept",
+		"application/x-www-form-urlencoded",
+		strings.NewReader(""),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusGone)
+	}
+
+	member, err := isRoomMember(context.Background(), application.ScyllaDb, "carol", "test chatroom")
+	if err != nil || member {
+		t.Errorf("Invitation from a member who can't invite anymore let carol join (%v)", err)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	// api.yaml gives room names a minimum length so this never reaches the handler
+	form := url.Values{}
+	form.Set("chatroom_name", "abc")
+	res, err := client.PostForm(server.URL+"/api/room/create", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var errorResponse ErrorResponse
+	err = json.NewDecoder(res.Body).Decode(&errorResponse)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding error response: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest || errorResponse.Code != "validation_failed" {
+		t.Fatalf("Received status code %v and code %v, wanted %v and validation_failed",
+			res.StatusCode, errorResponse.Code, http.StatusBadRequest)
+	}
+	if len(errorResponse.Fields) != 1 ||
+		errorResponse.Fields[0].Field != "chatroom_name" ||
+		errorResponse.Fields[0].Code != "min" ||
+		errorResponse.Fields[0].Param != "4" {
+		t.Errorf("Expected chatroom_name to fail the min rule, got %v", errorResponse.Fields)
+	}
+
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(`{"email": 5, "password": "secretpassy"}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errorResponse = ErrorResponse{}
+	err = json.NewDecoder(res.Body).Decode(&errorResponse)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding error response: %v", err)
+	}
+	if len(errorResponse.Fields) != 1 || errorResponse.Fields[0].Field != "email" || errorResponse.Fields[0].Code != "type" {
+		t.Errorf("Expected email to fail the type rule, got %v", errorResponse.Fields)
+	}
+
+	res, err = client.Post(server.URL+"/api/auth/login", "application/json", strings.NewReader(`{"email": `))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errorResponse = ErrorResponse{}
+	err = json.NewDecoder(res.Body).Decode(&errorResponse)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding error response: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest || errorResponse.Code != "malformed_json" {
+		t.Errorf("Received status code %v and code %v, wanted %v and malformed_json",
+			res.StatusCode, errorResponse.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	spec, err := ParseOpenAPI([]byte(`
+servers:
+  - url: http://localhost/api/
+paths:
+  /rooms/{id}:
+    get:
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [name]
+                properties:
+                  name:
+                    type: string
+`))
+	if err != nil {
+		t.Fatalf("err parsing spec: %v", err)
+	}
+	operation, params, ok := spec.find(http.MethodGet, "/api/rooms/42")
+	if !ok || params["id"] != "42" {
+		t.Fatalf("Expected /api/rooms/42 to match /rooms/{id}, got %v %v", ok, params)
+	}
+
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	err = spec.validateResponse(operation, http.StatusOK, header, []byte(`{"name": "room"}`))
+	if err != nil {
+		t.Errorf("Documented response was rejected: %v", err)
+	}
+	err = spec.validateResponse(operation, http.StatusOK, header, []byte(`{"name": 5}`))
+	if err == nil {
+		t.Errorf("Response with the wrong type of name was accepted")
+	}
+	err = spec.validateResponse(operation, http.StatusNotFound, header, nil)
+	if err == nil {
+		t.Errorf("Undocumented status was accepted")
+	}
+}
+
+func TestUndocumentedRoutes(t *testing.T) {
+	spec, err := ParseOpenAPI([]byte(`
+servers:
+  - url: http://localhost/api/
+paths:
+  /rooms/{id}:
+    get:
+      responses:
+        "204":
+          description: "ok"
+`))
+	if err != nil {
+		t.Fatalf("err parsing spec: %v", err)
+	}
+	app := App{Spec: spec, CheckResponses: true}
+	router := chi.NewRouter()
+	router.Route("/api", func(router chi.Router) {
+		router.Use(app.ValidateRequests)
+		noContent := func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		router.Get("/rooms/{id}", noContent)
+		router.Get("/users/{id}", noContent)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/api/rooms/42", http.StatusNoContent},
+		{"/api/users/42", http.StatusInternalServerError},
+		{"/api/nothing", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		res, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("GET %v returned status %v, wanted %v", test.path, res.StatusCode, test.status)
+		}
+	}
+
+	// every route the app serves has to be in api.yaml
+	err = chi.Walk(application.Routes(), func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if _, _, ok := application.Spec.find(method, route); !ok {
+			t.Errorf("%v %v is not documented in api.yaml", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err walking routes: %v", err)
+	}
+}
+
+func TestApiV1Routes(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	res, err := client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusCreated)
+	}
+	if res.Header.Get("Deprecation") != "" {
+		t.Errorf("/api/v1 response was marked deprecated")
+	}
+
+	res, err = client.Get(server.URL + "/api/v1/rooms/" + url.PathEscape("test chatroom") + "/messages")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var messages []OutgoingMessage
+	err = json.NewDecoder(res.Body).Decode(&messages)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("err decoding messages: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusOK)
+	}
+
+	// the legacy route still works and points at its replacement
+	res, err = client.PostForm(server.URL+"/api/room/messages", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusOK)
+	}
+	if deprecation := res.Header.Get("Deprecation"); !strings.HasPrefix(deprecation, "@") {
+		t.Errorf("Legacy response had Deprecation %q, wanted a date like @1792368000", deprecation)
+	}
+	sunset, err := http.ParseTime(res.Header.Get("Sunset"))
+	if err != nil || !sunset.Equal(application.LegacySunset) {
+		t.Errorf("Legacy response had Sunset %q, wanted %v", res.Header.Get("Sunset"), application.LegacySunset)
+	}
+	link := `</api/v1/rooms/test%20chatroom/messages>; rel="successor-version"`
+	if res.Header.Get("Link") != link {
+		t.Errorf("Legacy response had Link %q, wanted %q", res.Header.Get("Link"), link)
+	}
+}
+
+// reads server-sent events until one with data, returning its id and data
+func readEvent(reader *bufio.Reader) (string, string, error) {
+	var id, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			return id, data, nil
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/events", nil)
+	stream, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err opening event stream: %v", err)
+	}
+	defer stream.Body.Close()
+	if contentType := stream.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Event stream had content type %v, wanted text/event-stream", contentType)
+	}
+
+	form = url.Values{}
+	form.Set("message", "hello")
+	res, err := client.PostForm(server.URL+"/api/v1/rooms/"+url.PathEscape("test chatroom")+"/messages", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	// the websocket and the event stream get the same message
+	_, wsMessage, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("err reading message: %v", err)
+	}
+	id, data, err := readEvent(bufio.NewReader(stream.Body))
+	if err != nil {
+		t.Fatalf("err reading event: %v", err)
+	}
+	if data != string(wsMessage) {
+		t.Errorf("Event stream sent %v, wanted the websocket's %s", data, wsMessage)
+	}
+	var message OutgoingMessage
+	err = json.Unmarshal([]byte(data), &message)
+	if err != nil || message.Content != "hello" || message.UserId != "artemis" {
+		t.Errorf("Event stream sent %v (%v), wanted hello from artemis", data, err)
+	}
+
+	// a stream resuming from before the message gets it again
+	lastId, _ := strconv.ParseUint(id, 10, 64)
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/events", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(lastId-1, 10))
+	resumed, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err opening event stream: %v", err)
+	}
+	defer resumed.Body.Close()
+	resumedId, resumedData, err := readEvent(bufio.NewReader(resumed.Body))
+	if err != nil {
+		t.Fatalf("err reading event: %v", err)
+	}
+	if resumedId != id || resumedData != data {
+		t.Errorf("Resumed stream sent event %v %v, wanted %v %v", resumedId, resumedData, id, data)
+	}
+
+	// messages too long for the broker to carry are refused
+	long := url.Values{}
+	long.Set("message", strings.Repeat("a", maxMessageLength+1))
+	res, err = client.PostForm(server.URL+"/api/v1/rooms/"+url.PathEscape("test chatroom")+"/messages", long)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Long message was sent. Received status code %v, wanted %v", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// only members can send messages to a room
+	bob, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+	res, err = bob.PostForm(server.URL+"/api/v1/rooms/"+url.PathEscape("test chatroom")+"/messages", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Non member sent a message. Received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+
+	// or read its messages
+	res, err = bob.Get(server.URL + "/api/v1/rooms/" + url.PathEscape("test chatroom") + "/messages")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Non member read the room's messages. Received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+	legacyForm := url.Values{}
+	legacyForm.Set("chatroom_name", "test chatroom")
+	res, err = bob.PostForm(server.URL+"/api/room/messages", legacyForm)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Non member read the room's messages from the legacy route. Received status code %v, wanted %v", res.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	poll := func(query string) (PollResponse, error) {
+		var response PollResponse
+		res, err := client.Get(server.URL + "/api/v1/events/poll?" + query)
+		if err != nil {
+			return response, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return response, fmt.Errorf("handler returned wrong status code: got %v want %v", res.StatusCode, http.StatusOK)
+		}
+		err = json.NewDecoder(res.Body).Decode(&response)
+		return response, err
+	}
+
+	// nothing happens so the poll times out empty
+	start := time.Now()
+	empty, err := poll("timeout=1")
+	if err != nil {
+		t.Fatalf("err polling: %v", err)
+	}
+	if len(empty.Events) != 0 || time.Since(start) < time.Second {
+		t.Fatalf("Poll returned %v after %v, wanted no events after a second", empty.Events, time.Since(start))
+	}
+
+	// a held poll is answered as soon as a message arrives
+	polled := make(chan PollResponse)
+	pollErr := make(chan error, 1)
+	go func() {
+		response, err := poll("timeout=10&after=" + strconv.FormatUint(empty.Cursor, 10))
+		pollErr <- err
+		polled <- response
+	}()
+	time.Sleep(100 * time.Millisecond)
+	message, _ := json.Marshal(TestMessage{ChatroomName: "test chatroom", Message: "hello"})
+	err = conn.Write(context.Background(), websocket.MessageText, message)
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+
+	if err = <-pollErr; err != nil {
+		t.Fatalf("err polling: %v", err)
+	}
+	response := <-polled
+	if len(response.Events) != 1 || response.Cursor != response.Events[0].Id {
+		t.Fatalf("Poll returned %v with cursor %v, wanted the message", response.Events, response.Cursor)
+	}
+	var outgoing OutgoingMessage
+	err = json.Unmarshal(response.Events[0].Data, &outgoing)
+	if err != nil || outgoing.Content != "hello" {
+		t.Errorf("Poll returned %s (%v), wanted hello", response.Events[0].Data, err)
+	}
+
+	// polling from the old cursor again gets the same message
+	again, err := poll("timeout=1&after=" + strconv.FormatUint(empty.Cursor, 10))
+	if err != nil {
+		t.Fatalf("err polling: %v", err)
+	}
+	if len(again.Events) != 1 || again.Events[0].Id != response.Events[0].Id {
+		t.Errorf("Repeated poll returned %v, wanted the same message", again.Events)
+	}
+}
+
+func TestProtobufWebsocket(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	binary, _, err := websocket.Dial(ctx, server.URL+"/api/v1/ws", &websocket.DialOptions{
+		HTTPClient:   client,
+		Subprotocols: []string{ProtobufSubprotocol, JSONSubprotocol},
+	})
+	if err != nil {
+		t.Fatalf("err opening websocket: %v", err)
+	}
+	defer binary.Close(websocket.StatusNormalClosure, "")
+	if binary.Subprotocol() != ProtobufSubprotocol {
+		t.Fatalf("Websocket negotiated %q, wanted %v", binary.Subprotocol(), ProtobufSubprotocol)
+	}
+
+	request := &ChatRequest{Room: "test chatroom", Message: "hello"}
+	err = binary.Write(ctx, websocket.MessageBinary, request.marshalProto())
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+
+	messageType, data, err := binary.Read(ctx)
+	if err != nil {
+		t.Fatalf("err reading message: %v", err)
+	}
+	event := &ChatEvent{}
+	err = event.unmarshalProto(data)
+	if messageType != websocket.MessageBinary || err != nil || event.Message == nil || event.Message.Content != "hello" {
+		t.Fatalf("Protobuf websocket sent %v %v (%v), wanted a binary hello", messageType, event, err)
+	}
+
+	// the json websocket still gets json
+	messageType, data, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("err reading message: %v", err)
+	}
+	var outgoing OutgoingMessage
+	err = json.Unmarshal(data, &outgoing)
+	if messageType != websocket.MessageText || err != nil || outgoing.Content != "hello" {
+		t.Errorf("Json websocket sent %v %s (%v), wanted hello", messageType, data, err)
+	}
+}
+
+func TestPayloadEncodedOnce(t *testing.T) {
+	payload := NewPayload(OutgoingMessage{ChatroomName: "test chatroom", UserId: "artemis", Content: "hello"})
+	for _, format := range []WireFormat{JSONFormat, ProtobufFormat} {
+		first, err := payload.Encode(format)
+		if err != nil {
+			t.Fatalf("err encoding %v: %v", format, err)
+		}
+		second, _ := payload.Encode(format)
+		if &first[0] != &second[0] {
+			t.Errorf("%v was encoded twice", format)
+		}
+	}
+}
+
+func TestWebsocketCloseCodes(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = conn.Write(ctx, websocket.MessageText, []byte("not json"))
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+	_, _, err = conn.Read(ctx)
+	if websocket.CloseStatus(err) != CloseProtocolError {
+		t.Errorf("Unparseable message closed the websocket with %v, wanted %v", websocket.CloseStatus(err), CloseProtocolError)
+	}
+
+	// answered pings keep the websocket open but a client that sends
+	// nothing is still closed once it's idle
+	idleApp := *application
+	idleApp.Websockets = WebsocketConfig{
+		PingInterval: 50 * time.Millisecond,
+		ReadTimeout:  time.Second,
+		IdleTimeout:  500 * time.Millisecond,
+	}
+	idleServer := httptest.NewServer(idleApp.Routes())
+	defer idleServer.Close()
+
+	idle, _, err := websocket.Dial(ctx, idleServer.URL+"/api/v1/ws", &websocket.DialOptions{HTTPClient: client})
+	if err != nil {
+		t.Fatalf("err opening websocket: %v", err)
+	}
+	defer idle.Close(websocket.StatusNormalClosure, "")
+	opened := time.Now()
+	_, _, err = idle.Read(ctx)
+	if websocket.CloseStatus(err) != CloseTimeout {
+		t.Errorf("Idle websocket was closed with %v (%v), wanted %v", websocket.CloseStatus(err), err, CloseTimeout)
+	}
+	if time.Since(opened) < 500*time.Millisecond {
+		t.Errorf("Websocket was closed after %v, before its idle timeout", time.Since(opened))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, client, conn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("chatroom_name", "test chatroom")
+	_, err = client.PostForm(server.URL+"/api/v1/rooms", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	message, _ := json.Marshal(TestMessage{ChatroomName: "test chatroom", Message: "hello"})
+	err = conn.Write(ctx, websocket.MessageText, message)
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+	_, _, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("err reading message: %v", err)
+	}
+
+	err = application.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown did not finish: %v", err)
+	}
+	_, _, err = conn.Read(ctx)
+	if websocket.CloseStatus(err) != CloseServerShutdown {
+		t.Errorf("Websocket was closed with %v (%v), wanted %v", websocket.CloseStatus(err), err, CloseServerShutdown)
+	}
+
+	err = application.sendMessage(ctx, "artemis", "test chatroom", "too late")
+	if err != ErrShuttingDown {
+		t.Errorf("Message sent after shutdown returned %v, wanted %v", err, ErrShuttingDown)
+	}
+	messages, err := application.roomMessages("test chatroom")
+	if err != nil || len(messages) != 1 || messages[0].Content != "hello" {
+		t.Errorf("Room had %v (%v) after shutdown, wanted the hello message", messages, err)
+	}
+}
+
+func TestSendMessageWithoutMachineId(t *testing.T) {
+	// sonyflake finds no machine id on hosts without a private ip
+	app := App{}
+	err := app.sendMessage(context.Background(), "artemis", "test chatroom", "hello")
+	if err != ErrNoMachineId {
+		t.Errorf("Message sent without a machine id returned %v, wanted %v", err, ErrNoMachineId)
+	}
+}
@@ -4,108 +4,139 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"nhooyr.io/websocket"
 )
 
+const InvitationEventType = "invitation"
+
+// sent over a user's websocket when someone invites them to a room
+type InvitationEvent struct {
+	Type       string
+	Invitation TargetedInvite
+}
+
+// sends the event to the user if they are connected to any node
+func (app App) notifyUser(ctx context.Context, username string, event InvitationEvent) error {
+	return app.Broker.Publish(ctx, BrokerEvent{Kind: BrokerInvitation, User: username, Invitation: &event})
+}
+
 func (app App) OpenWsConnection(writer http.ResponseWriter, req *http.Request) {
 	ctx, openWsSpan := otel.Tracer("").Start(req.Context(), "OpenWsConnection")
 	Sugar.Info("making ws connection")
-	// right now this doesn't handle dealing with the request origin
-	conn, err := websocket.Accept(writer, req, nil)
+
+	auth, _ := authFromContext(req.Context())
+	chatUser, err := app.connectUser(ctx, auth.Username)
+	if err != nil {
+		openWsSpan.RecordError(err)
+		openWsSpan.End()
+		writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	// only events from after the websocket opened are sent over it
+	after := chatUser.Events.lastId()
+
+	// pages from other origins could otherwise open a websocket with the
+	// user's session cookie. a rejected origin is answered with a 403
+	conn, err := websocket.Accept(writer, req, &websocket.AcceptOptions{
+		OriginPatterns: app.AllowedOrigins,
+		Subprotocols:   wireSubprotocols,
+	})
 	if err != nil {
 		Sugar.Error("upgrade error: ", err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		openWsSpan.End()
 		return
 	}
-	defer conn.Close(websocket.StatusInternalError, "")
+	// the other close codes are sent where the connection is closed, this
+	// is for when the client went away on its own
+	defer conn.Close(websocket.StatusNormalClosure, "")
 
 	openWsSpan.AddEvent("Connection upgraded to WebSocket")
 	Sugar.Info("connection ugraded to ws")
+	format := subprotocolFormat(conn.Subprotocol())
 
-	session, err := app.PgStore.Get(req, "session-name")
-	if err != nil {
-		openWsSpan.RecordError(err)
-		Sugar.Error("err getting session name: ", err)
-	}
-	clientName := session.Values["username"].(string)
+	connection := chatUser.addConnection(auth.SessionId, func(code websocket.StatusCode, reason string) error {
+		return conn.Close(code, reason)
+	})
+	defer chatUser.removeConnection(connection)
 
-	if err != nil {
-		openWsSpan.RecordError(err)
-		Sugar.Error("could not parse Message struct")
-	}
-	// TODO: function that retrieves chatrooms user is part of and joins them
-	chatUser := User{
-		Conn:      conn,
-		Id:        clientName,
-		Chatrooms: make([]string, 0),
-	}
-	app.Clients[clientName] = &chatUser
-	stmt := "SELECT chatroom FROM users WHERE user = ?;"
-	values := []string{"user"}
-	query := app.ScyllaDb.Query(stmt, values)
-	query.Bind(clientName)
-
-	var chatrooms []string
-	err = query.SelectRelease(&chatrooms)
-	if err != nil {
-		// TODO: Figure out why i'm doing this
-		if err.Error() != "" {
-			openWsSpan.RecordError(err)
-			Sugar.Error("Error finding all chatrooms for user: ", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
+	ctx, stopWriting := context.WithCancel(ctx)
+	defer stopWriting()
+	go func() {
+		err := chatUser.Events.stream(ctx, after, func(event Event) error {
+			data, err := event.Payload.Encode(format)
+			if err != nil {
+				Sugar.Error("error encoding event: ", err)
+				return nil
+			}
+			return conn.Write(ctx, format.messageType(), data)
+		})
+		if err != nil && err != context.Canceled {
+			Sugar.Error("error writing message to user ws connection: ", err)
 		}
-	}
-	for _, name := range chatrooms {
-		app.Chatrooms[name].addUser(conn, clientName)
+	}()
+
+	go app.Websockets.heartbeat(ctx, conn)
+	// reading doesn't time out by itself, a client that stops sending is
+	// closed once it has been idle for too long
+	resetIdle := func() {}
+	if app.Websockets.IdleTimeout > 0 {
+		idle := time.AfterFunc(app.Websockets.IdleTimeout, func() {
+			conn.Close(CloseTimeout, "idle timeout")
+		})
+		defer idle.Stop()
+		resetIdle = func() { idle.Reset(app.Websockets.IdleTimeout) }
 	}
 
 	openWsSpan.End()
 	tracer := otel.Tracer("")
 	for {
 		// messageType, message, err := conn.ReadMessage()
-		_, message, err := conn.Read(ctx)
+		messageType, message, err := conn.Read(ctx)
 		// ctx, span := tracer.Start(ctx, clientName)
 		// maybe have unique ID for this user and their connection
 		// or maybe use the chatroom derived from the message
 		// as the name of the tracer
-		ctx, span := tracer.Start(context.Background(), clientName)
+		ctx, span := tracer.Start(context.Background(), chatUser.name())
 
 		if err != nil {
 			span.RecordError(err)
 			Sugar.Error("connection closed: ", err)
+			span.End()
 			break
 		}
+		resetIdle()
 		// spew.Dump(messageType, message)
 		// println(message)
 		// userMessage := UserMessage{}
 		testMessage := TestMessage{}
 
-		err = json.Unmarshal([]byte(message), &testMessage)
+		// clients using the protobuf subprotocol send ChatRequests in
+		// binary frames, everyone else sends json
+		if messageType == websocket.MessageBinary {
+			var request ChatRequest
+			err = request.unmarshalProto(message)
+			testMessage.ChatroomName = request.Room
+			testMessage.Message = request.Message
+		} else {
+			err = json.Unmarshal([]byte(message), &testMessage)
+		}
 		if err != nil {
 			span.RecordError(err)
-			Sugar.Error("error json parsing user message: ", err)
+			Sugar.Error("error parsing user message: ", err)
+			span.End()
+			conn.Close(CloseProtocolError, "message could not be parsed")
 			break
 		}
 
-		userMessage := IncomingMessage{}
-		userMessage.User = chatUser.Id
-		userMessage.Message = testMessage.Message
-		userMessage.ChatroomName = testMessage.ChatroomName
-
-		// fmt.Println("message type: ", messageType)
-		// spew.Dump(userMessage)
-		// fmt.Println()
-		// spew.Dump(ChatroomChannels)
-		// ChatroomChannels[userMessage.ChatroomName] <- userMessage
-		app.ChatroomChannels[userMessage.ChatroomName] <- MessageWithCtx{Message: userMessage, Ctx: ctx}
-		// if err != nil {
-		// 	app.Sugar.Error("could not parse Message struct: ", err)
-		// 	break
-		// }
+		// the user could have changed their name while connected
+		err = app.sendMessage(ctx, chatUser.name(), testMessage.ChatroomName, testMessage.Message)
+		if err != nil {
+			span.RecordError(err)
+			Sugar.Error("could not send message: ", err)
+		}
 		span.End()
 	}
-	delete(app.Clients, clientName)
 }
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookie = "csrf-token"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// how cookies set by the app are flagged. browsers only send Secure cookies
+// over https so it has to stay off for local development
+type CookieConfig struct {
+	Secure   bool
+	SameSite http.SameSite
+	// empty to only send cookies to the host that set them
+	Domain string
+}
+
+func DefaultCookieConfig() CookieConfig {
+	return CookieConfig{
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (config CookieConfig) Validate() error {
+	if config.SameSite == http.SameSiteNoneMode && !config.Secure {
+		return errors.New("SameSite=None cookies must also be Secure")
+	}
+	return nil
+}
+
+// the cookie holding the token isn't HttpOnly since pages read it to send
+// it back with their requests
+func (app App) setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Domain:   app.Cookies.Domain,
+		Secure:   app.Cookies.Secure,
+		SameSite: app.Cookies.SameSite,
+	})
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// the token the page sent back, from the header for fetch requests or
+// from a hidden field for plain html forms
+func submittedCSRFToken(req *http.Request) string {
+	if token := req.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return req.PostFormValue(csrfField)
+	}
+	return ""
+}
+
+// protects cookie authenticated requests with double submit cookies. every
+// client gets a random token in a cookie and requests that change anything
+// have to repeat it in a header or form field, which other sites can't do
+// since they can't read our cookies. requests with an api token don't send
+// cookies so they aren't checked
+func (app App) CSRFProtection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := ""
+		if cookie, err := req.Cookie(csrfCookie); err == nil {
+			token = cookie.Value
+		}
+		if token == "" {
+			newToken, err := randomToken()
+			if err != nil {
+				Sugar.Error("error generating csrf token: ", err)
+				writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+				return
+			}
+			app.setCSRFCookie(w, newToken)
+		}
+
+		if _, ok := bearerToken(req); ok || safeMethod(req.Method) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		submitted := submittedCSRFToken(req)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+			writeError(w, req, http.StatusForbidden, ErrorResponse{
+				Code:   "csrf_failed",
+				Detail: "Missing or incorrect " + csrfHeader + " header",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
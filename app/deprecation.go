@@ -0,0 +1,63 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// when the routes outside /api/v1 were deprecated in favor of it
+var legacyApiDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// clients get six months to move to /api/v1 before the legacy routes can be removed
+var defaultLegacySunset = legacyApiDeprecated.AddDate(0, 6, 0)
+
+// rooms are named in the path in /api/v1 and by a chatroom_name form field
+// or query parameter on the legacy routes
+func roomParam(req *http.Request) string {
+	if name := chi.URLParam(req, "room"); name != "" {
+		// chi matches against the escaped path when the decoded one would
+		// be ambiguous, like when the name has a slash in it
+		if req.URL.RawPath != "" {
+			if unescaped, err := url.PathUnescape(name); err == nil {
+				return unescaped
+			}
+		}
+		return name
+	}
+	return req.FormValue("chatroom_name")
+}
+
+// the /api/v1 path that replaced a legacy request, with its parameters
+// filled in from the legacy request's path or, for {room} and {code},
+// the form fields the legacy routes took them from
+func legacySuccessor(req *http.Request, successor string) string {
+	if routeContext := chi.RouteContext(req.Context()); routeContext != nil {
+		params := routeContext.URLParams
+		for i, key := range params.Keys {
+			successor = strings.ReplaceAll(successor, "{"+key+"}", url.PathEscape(params.Values[i]))
+		}
+	}
+	successor = strings.ReplaceAll(successor, "{room}", url.PathEscape(req.FormValue("chatroom_name")))
+	successor = strings.ReplaceAll(successor, "{code}", url.PathEscape(req.FormValue("invite")))
+	return successor
+}
+
+// marks a legacy route as deprecated (RFC 9745) with the date it will stop
+// working (RFC 8594) and links to the route replacing it. the headers are
+// set before the handler runs so they are on error responses too
+func (app App) Deprecated(successor string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			header := w.Header()
+			header.Set("Deprecation", fmt.Sprintf("@%d", legacyApiDeprecated.Unix()))
+			header.Set("Sunset", app.LegacySunset.UTC().Format(http.TimeFormat))
+			header.Add("Link", fmt.Sprintf(`<%v>; rel="successor-version"`, legacySuccessor(req, successor)))
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// how long an email verification link can be used for
+const emailVerificationExpiry = time.Hour * 24
+
+var ErrInvalidVerificationToken = errors.New("email verification token is invalid, expired or already used")
+
+// emails the user a link that proves they own the email address
+func (app App) sendVerification(ctx context.Context, username string, email string) error {
+	token, err := randomToken()
+	if err != nil {
+		Sugar.Error("error generating email verification token: ", err)
+		return err
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO EmailVerifications (username, email, token_hash, expires) VALUES ($1, $2, $3, $4)`,
+		username,
+		email,
+		hashToken(token),
+		time.Now().Add(emailVerificationExpiry),
+	)
+	if err != nil {
+		Sugar.Error("error inserting email verification: ", err)
+		return err
+	}
+
+	verifyUrl := webUrl + "/api/user/verify?token=" + url.QueryEscape(token)
+	err = app.Mailer.Send(ctx, Mail{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf(
+			"Welcome %s!\n\n"+
+				"Use this link within %v to confirm your email address:\n%s\n\n"+
+				"Until then you won't be able to create rooms or invite people.\n",
+			username,
+			emailVerificationExpiry,
+			verifyUrl,
+		),
+	})
+	if err != nil {
+		Sugar.Error("error sending email verification: ", err)
+	}
+	return err
+}
+
+// marks the email the token was sent to as verified, making it the user's
+// email if they asked to change it
+func (app App) verifyEmail(ctx context.Context, token string) (string, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`UPDATE EmailVerifications SET used = true
+		WHERE token_hash=$1 AND NOT used AND expires > now()
+		RETURNING username, email`,
+		hashToken(token),
+	)
+
+	var username string
+	var email string
+	err := row.Scan(&username, &email)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidVerificationToken
+	} else if err != nil {
+		Sugar.Error("error using email verification: ", err)
+		return "", err
+	}
+
+	// someone else could have taken the email since the link was sent
+	result, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE Users SET email=$2, verified = true
+		WHERE username=$1 AND NOT EXISTS (SELECT 1 FROM Users WHERE email=$2 AND username <> $1)`,
+		username,
+		email,
+	)
+	if err != nil {
+		Sugar.Error("error verifying user: ", err)
+		return "", err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return "", ErrInvalidVerificationToken
+	}
+
+	// links sent to other addresses shouldn't be able to change it back
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`UPDATE EmailVerifications SET used = true WHERE username=$1 AND NOT used`,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error invalidating email verifications: ", err)
+		return "", err
+	}
+
+	return username, nil
+}
+
+func (app App) isVerified(ctx context.Context, username string) (bool, error) {
+	row := app.Pg.QueryRowContext(ctx, `SELECT verified FROM Users WHERE username=$1`, username)
+
+	var verified bool
+	err := row.Scan(&verified)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	return verified, err
+}
+
+// rejects requests from users that haven't confirmed their email yet
+// it has to come after UserSession
+func (app App) RequireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		verified, err := app.isVerified(req.Context(), currentUser(req))
+		if err != nil {
+			Sugar.Error("error checking whether user is verified: ", err)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
+		}
+		if !verified {
+			writeError(w, req, http.StatusForbidden, ErrorResponse{
+				Code:   "email_not_verified",
+				Detail: "Confirm your email address to do this",
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// the emailed verification link points here
+func (app App) VerifyEmail(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "VerifyEmail")
+	defer span.End()
+
+	_, err := app.verifyEmail(ctx, req.URL.Query().Get("token"))
+	if err == ErrInvalidVerificationToken {
+		span.SetStatus(codes.Ok, "Invalid email verification token.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "invalid_token",
+			Detail: "This verification link is invalid, expired or has already been used",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error verifying email.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Email verified.")
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+}
+
+// sends a new verification link to the current user's email, for when
+// the first one expired or got lost
+func (app App) ResendVerification(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ResendVerification")
+	defer span.End()
+
+	username := currentUser(req)
+	row := app.Pg.QueryRowContext(ctx, `SELECT email, verified FROM Users WHERE username=$1`, username)
+	var email string
+	var verified bool
+	err := row.Scan(&email, &verified)
+	if err != nil {
+		Sugar.Error("err scanning row: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error getting user email.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	if verified {
+		span.SetStatus(codes.Ok, "Email already verified.")
+		writeError(w, req, http.StatusConflict, ErrorResponse{Code: "already_verified"})
+		return
+	}
+
+	err = app.sendVerification(ctx, username, email)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error sending email verification.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Email verification sent.")
+	w.WriteHeader(http.StatusAccepted)
+}
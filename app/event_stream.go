@@ -0,0 +1,247 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"nhooyr.io/websocket"
+)
+
+// idle event streams get a comment this often so proxies don't time them out
+const eventStreamKeepAlive = 15 * time.Second
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+// streams the user's events as server-sent events for clients that can't
+// keep a websocket open. each event's id is the one to send back in
+// Last-Event-ID when reconnecting, and events missed in between are sent
+// first as long as they're still queued. messages are sent with SendMessage
+func (app App) StreamEvents(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "StreamEvents")
+	defer span.End()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Sugar.Error("response writer can't stream events")
+		span.SetStatus(codes.Error, "response writer can't stream events")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	auth, _ := authFromContext(ctx)
+	chatUser, err := app.connectUser(ctx, auth.Username)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error connecting user")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	after := chatUser.Events.lastId()
+	// browsers send the header when they reconnect on their own. the query
+	// parameter is for clients that can't set headers
+	lastEventId := req.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = req.URL.Query().Get("last_event_id")
+	}
+	if lastEventId != "" {
+		after, err = strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			span.SetStatus(codes.Ok, "last event id was not a number")
+			writeError(w, req, http.StatusBadRequest, invalidField("Last-Event-ID", "number", ""))
+			return
+		}
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	connection := chatUser.addConnection(auth.SessionId, func(websocket.StatusCode, string) error {
+		stop()
+		return nil
+	})
+	defer chatUser.removeConnection(connection)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stops nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	span.SetStatus(codes.Ok, "")
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		events, pushed := chatUser.Events.after(after)
+		for _, event := range events {
+			after = event.Id
+			data, err := event.Payload.Encode(JSONFormat)
+			if err != nil {
+				Sugar.Error("error encoding event: ", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.Id, data)
+			if err != nil {
+				Sugar.Info("error writing event stream: ", err)
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-pushed:
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				Sugar.Info("error writing event stream: ", err)
+				return
+			}
+		}
+	}
+}
+
+type PolledEvent struct {
+	Id   uint64          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+type PollResponse struct {
+	// what to send as after in the next poll
+	Cursor uint64        `json:"cursor"`
+	Events []PolledEvent `json:"events"`
+}
+
+// answers with the user's events after the cursor, holding the request until
+// there are some or the timeout is up, for clients that can't stream at all.
+// without a cursor only events from after the request arrived are sent
+func (app App) PollEvents(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "PollEvents")
+	defer span.End()
+
+	auth, _ := authFromContext(ctx)
+	chatUser, err := app.connectUser(ctx, auth.Username)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error connecting user")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	after := chatUser.Events.lastId()
+	if value := req.URL.Query().Get("after"); value != "" {
+		after, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			span.SetStatus(codes.Ok, "cursor was not a number")
+			writeError(w, req, http.StatusBadRequest, invalidField("after", "number", ""))
+			return
+		}
+	}
+	timeout := defaultPollTimeout
+	if value := req.URL.Query().Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPollTimeout {
+			span.SetStatus(codes.Ok, "timeout was out of range")
+			writeError(w, req, http.StatusBadRequest, invalidField(
+				"timeout",
+				"range",
+				"Timeout must be a number of seconds from 1 to 60",
+			))
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	ctx, stop := context.WithTimeout(ctx, timeout)
+	defer stop()
+	// a revoked session's poll is answered straight away, and the next one
+	// is turned away
+	connection := chatUser.addConnection(auth.SessionId, func(websocket.StatusCode, string) error {
+		stop()
+		return nil
+	})
+	defer chatUser.removeConnection(connection)
+
+	events, pushed := chatUser.Events.after(after)
+	if len(events) == 0 {
+		select {
+		case <-ctx.Done():
+		case <-pushed:
+			events, _ = chatUser.Events.after(after)
+		}
+	}
+
+	response := PollResponse{Cursor: after, Events: make([]PolledEvent, 0, len(events))}
+	for _, event := range events {
+		response.Cursor = event.Id
+		data, err := event.Payload.Encode(JSONFormat)
+		if err != nil {
+			Sugar.Error("error encoding event: ", err)
+			continue
+		}
+		response.Events = append(response.Events, PolledEvent{Id: event.Id, Data: data})
+	}
+	span.SetStatus(codes.Ok, "")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sends a message to a room, like a message sent over the websocket
+func (app App) SendMessage(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "SendMessage")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for send message: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error parsing form for send message")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_form"})
+		return
+	}
+	content := req.PostFormValue("message")
+	if content == "" {
+		span.SetStatus(codes.Ok, "message was empty")
+		writeError(w, req, http.StatusBadRequest, invalidField("message", "required", ""))
+		return
+	}
+
+	err = app.sendMessage(ctx, currentUser(req), roomParam(req), content)
+	if err == ErrMessageTooLong {
+		span.SetStatus(codes.Ok, "message was too long")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: []FieldError{{Field: "message", Code: "max", Param: strconv.Itoa(maxMessageLength)}},
+		})
+		return
+	} else if err == ErrRoomNotFound {
+		span.SetStatus(codes.Ok, "room not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "room_not_found"})
+		return
+	} else if err == ErrNotRoomMember {
+		span.SetStatus(codes.Ok, "user is not a member of the room")
+		writeError(w, req, http.StatusForbidden, ErrorResponse{
+			Code:   "not_room_member",
+			Detail: "Only members of the room can send messages to it",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error sending message")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "message sent")
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,286 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+)
+
+// how many of a user's recent events are kept for clients resuming a stream
+const eventQueueSize = 256
+
+// the most characters a message can have. even when every character is
+// escaped the message's broker event stays under maxNotifyPayload, so the
+// postgres broker can deliver it to the other nodes
+const maxMessageLength = 1000
+
+var ErrNotRoomMember = errors.New("user is not a member of the room")
+var ErrMessageTooLong = errors.New("message is too long")
+
+// sonyflake couldn't find a machine id, so message ids can't be made
+var ErrNoMachineId = errors.New("no machine id for message ids, MACHINE_ID has to be set")
+
+// a message or notification for one user. the payload can be shared with
+// the same event in other users' queues, the id is only for this user
+type Event struct {
+	Id      uint64
+	Payload *Payload
+}
+
+// the events going to one user. rooms push their messages onto the queues of
+// their members and each connection the user has open, whatever its
+// transport, reads from the queue, so every transport gets the same events
+type EventQueue struct {
+	mutex  sync.Mutex
+	events []Event
+	nextId uint64
+	// closed and replaced every time an event is pushed
+	pushed chan struct{}
+}
+
+func NewEventQueue() *EventQueue {
+	return &EventQueue{
+		// ids start at the time the queue was made so ids handed out before
+		// a restart are always older than the new ones. microseconds keep
+		// them small enough for javascript numbers
+		nextId: uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		pushed: make(chan struct{}),
+	}
+}
+
+func (queue *EventQueue) push(payload *Payload) Event {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	event := Event{Id: queue.nextId, Payload: payload}
+	queue.nextId++
+	queue.events = append(queue.events, event)
+	if len(queue.events) > eventQueueSize {
+		queue.events = queue.events[len(queue.events)-eventQueueSize:]
+	}
+
+	close(queue.pushed)
+	queue.pushed = make(chan struct{})
+	return event
+}
+
+// the kept events that came after the id, along with a channel that is
+// closed when the next event is pushed
+func (queue *EventQueue) after(id uint64) ([]Event, <-chan struct{}) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	i := sort.Search(len(queue.events), func(i int) bool {
+		return queue.events[i].Id > id
+	})
+	events := make([]Event, len(queue.events)-i)
+	copy(events, queue.events[i:])
+	return events, queue.pushed
+}
+
+// the id of the newest event, for connections that only want what comes next
+func (queue *EventQueue) lastId() uint64 {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.nextId - 1
+}
+
+// calls send with each event after the id as they're pushed, until sending
+// fails or the context is done
+func (queue *EventQueue) stream(ctx context.Context, after uint64, send func(Event) error) error {
+	for {
+		events, pushed := queue.after(after)
+		for _, event := range events {
+			err := send(event)
+			if err != nil {
+				return err
+			}
+			after = event.Id
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pushed:
+		}
+	}
+}
+
+// a websocket, event stream or grpc stream the user has open
+type Connection struct {
+	// the session it was opened with, empty for api tokens
+	SessionId string
+	// websockets are closed with the code, other transports just end
+	close func(code websocket.StatusCode, reason string) error
+}
+
+func (user *User) addConnection(sessionId string, close func(code websocket.StatusCode, reason string) error) *Connection {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+
+	connection := &Connection{SessionId: sessionId, close: close}
+	user.Connections = append(user.Connections, connection)
+	return connection
+}
+
+func (user *User) removeConnection(connection *Connection) {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+
+	connections := user.Connections[:0]
+	for _, other := range user.Connections {
+		if other != connection {
+			connections = append(connections, other)
+		}
+	}
+	user.Connections = connections
+}
+
+// the user's current name, which a rename from any node can change while
+// they're connected
+func (user *User) name() string {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	return user.Id
+}
+
+// closes the connections opened with the session
+func (user *User) closeSession(sessionId string, reason string) {
+	user.closeConnections(CloseSessionRevoked, reason, func(connection *Connection) bool {
+		return connection.SessionId == sessionId
+	})
+}
+
+func (user *User) closeAll(code websocket.StatusCode, reason string) {
+	user.closeConnections(code, reason, func(*Connection) bool {
+		return true
+	})
+}
+
+func (user *User) closeConnections(code websocket.StatusCode, reason string, matches func(*Connection) bool) {
+	user.mutex.Lock()
+	var closing []*Connection
+	for _, connection := range user.Connections {
+		if matches(connection) {
+			closing = append(closing, connection)
+		}
+	}
+	user.mutex.Unlock()
+
+	// closing can wait on the connection so the lock isn't held for it
+	for _, connection := range closing {
+		err := connection.close(code, reason)
+		if err != nil {
+			Sugar.Info("error closing connection: ", err)
+		}
+	}
+}
+
+// gets the user ready to receive events, subscribing their event queue to
+// every room they're in the first time they connect
+func (app App) connectUser(ctx context.Context, username string) (*User, error) {
+	app.clientsMutex.RLock()
+	chatUser, ok := app.Clients[username]
+	app.clientsMutex.RUnlock()
+	if ok && chatUser.Events != nil {
+		return chatUser, nil
+	}
+
+	stmt := "SELECT chatroom FROM users WHERE user = ?;"
+	values := []string{"user"}
+	query := app.ScyllaDb.Query(stmt, values)
+	query.Bind(username)
+
+	var chatrooms []string
+	err := query.SelectRelease(&chatrooms)
+	if err != nil {
+		Sugar.Error("Error finding all chatrooms for user: ", err)
+		return nil, err
+	}
+
+	// the user could have connected, been renamed or joined a room while
+	// their rooms were being found
+	app.clientsMutex.Lock()
+	defer app.clientsMutex.Unlock()
+	chatUser, ok = app.Clients[username]
+	if ok && chatUser.Events != nil {
+		return chatUser, nil
+	}
+	if !ok {
+		chatUser = &User{}
+	}
+
+	chatUser.mutex.Lock()
+	chatUser.Id = username
+	chatUser.mutex.Unlock()
+	chatUser.Chatrooms = chatrooms
+	chatUser.Events = NewEventQueue()
+	for _, name := range chatrooms {
+		app.startRoom(name).addUser(chatUser.Events, username)
+	}
+	app.Clients[username] = chatUser
+
+	return chatUser, nil
+}
+
+// keeps a place for a user who has just signed up, so events for them aren't
+// missed before they connect
+func (app App) addClient(username string) {
+	app.clientsMutex.Lock()
+	defer app.clientsMutex.Unlock()
+	if _, ok := app.Clients[username]; !ok {
+		app.Clients[username] = &User{}
+	}
+}
+
+// hands the message to the room, which saves it and sends it to its members
+func (app App) sendMessage(ctx context.Context, username string, roomName string, content string) error {
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return ErrMessageTooLong
+	}
+	// the room would crash the server making the message's id
+	if app.Snowflake == nil {
+		return ErrNoMachineId
+	}
+
+	app.clientsMutex.RLock()
+	channel, ok := app.ChatroomChannels[roomName]
+	app.clientsMutex.RUnlock()
+	if !ok {
+		// the room could have been made on another node
+		_, err := app.getRoomSettings(roomName)
+		if err != nil {
+			return err
+		}
+		channel = app.localRoom(roomName).Channel
+	}
+
+	member, err := isRoomMember(ctx, app.ScyllaDb, username, roomName)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrNotRoomMember
+	}
+
+	// rooms stop taking messages once they've saved the ones waiting when
+	// the server started shutting down
+	select {
+	case channel <- MessageWithCtx{
+		Message: IncomingMessage{
+			Message:      content,
+			User:         username,
+			ChatroomName: roomName,
+		},
+		Ctx: ctx,
+	}:
+		return nil
+	case <-app.Background.stopping():
+		return ErrShuttingDown
+	}
+}
@@ -0,0 +1,467 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"nhooyr.io/websocket"
+)
+
+const chatServiceName = "chat.v1.ChatService"
+
+// the scope an api token needs for each method, like the http routes
+var grpcScopes = map[string]string{
+	"/" + chatServiceName + "/CreateRoom":   ScopeWrite,
+	"/" + chatServiceName + "/ListRooms":    ScopeRead,
+	"/" + chatServiceName + "/GetMessages":  ScopeRead,
+	"/" + chatServiceName + "/CreateInvite": ScopeWrite,
+	"/" + chatServiceName + "/JoinRoom":     ScopeWrite,
+	"/" + chatServiceName + "/Chat":         ScopeChat,
+}
+
+// the ChatService in proto/chat.proto
+type ChatServiceServer interface {
+	CreateRoom(context.Context, *CreateRoomRequest) (*Room, error)
+	ListRooms(context.Context, *ListRoomsRequest) (*ListRoomsResponse, error)
+	GetMessages(context.Context, *GetMessagesRequest) (*GetMessagesResponse, error)
+	CreateInvite(context.Context, *CreateInviteRequest) (*InviteLink, error)
+	JoinRoom(context.Context, *JoinRoomRequest) (*Room, error)
+	Chat(ChatService_ChatServer) error
+}
+
+type ChatService_ChatServer interface {
+	Send(*ChatEvent) error
+	Recv() (*ChatRequest, error)
+	grpc.ServerStream
+}
+
+type chatChatServer struct {
+	grpc.ServerStream
+}
+
+func (stream chatChatServer) Send(event *ChatEvent) error {
+	return stream.ServerStream.SendMsg(event)
+}
+
+func (stream chatChatServer) Recv() (*ChatRequest, error) {
+	request := &ChatRequest{}
+	err := stream.ServerStream.RecvMsg(request)
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// decodes the request into a new message from newRequest before calling the
+// method through the interceptors
+func unaryMethod(
+	name string,
+	newRequest func() interface{},
+	call func(server ChatServiceServer, ctx context.Context, request interface{}) (interface{}, error),
+) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(server interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := newRequest()
+			err := decode(request)
+			if err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, request interface{}) (interface{}, error) {
+				return call(server.(ChatServiceServer), ctx, request)
+			}
+			if interceptor == nil {
+				return handler(ctx, request)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     server,
+				FullMethod: "/" + chatServiceName + "/" + name,
+			}
+			return interceptor(ctx, request, info, handler)
+		},
+	}
+}
+
+var chatServiceDesc = grpc.ServiceDesc{
+	ServiceName: chatServiceName,
+	HandlerType: (*ChatServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("CreateRoom", func() interface{} { return &CreateRoomRequest{} },
+			func(server ChatServiceServer, ctx context.Context, request interface{}) (interface{}, error) {
+				return server.CreateRoom(ctx, request.(*CreateRoomRequest))
+			}),
+		unaryMethod("ListRooms", func() interface{} { return &ListRoomsRequest{} },
+			func(server ChatServiceServer, ctx context.Context, request interface{}) (interface{}, error) {
+				return server.ListRooms(ctx, request.(*ListRoomsRequest))
+			}),
+		unaryMethod("GetMessages", func() interface{} { return &GetMessagesRequest{} },
+			func(server ChatServiceServer, ctx context.Context, request interface{}) (interface{}, error) {
+				return server.GetMessages(ctx, request.(*GetMessagesRequest))
+			}),
+		unaryMethod("CreateInvite", func() interface{} { return &CreateInviteRequest{} },
+			func(server ChatServiceServer, ctx context.Context, request interface{}) (interface{}, error) {
+				return server.CreateInvite(ctx, request.(*CreateInviteRequest))
+			}),
+		unaryMethod("JoinRoom", func() interface{} { return &JoinRoomRequest{} },
+			func(server ChatServiceServer, ctx context.Context, request interface{}) (interface{}, error) {
+				return server.JoinRoom(ctx, request.(*JoinRoomRequest))
+			}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Chat",
+			Handler: func(server interface{}, stream grpc.ServerStream) error {
+				return server.(ChatServiceServer).Chat(chatChatServer{stream})
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/chat.proto",
+}
+
+// a grpc server for the ChatService. calls are authenticated with the same
+// api tokens and session cookies as the http api
+func (app App) GrpcServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.CustomCodec(protoCodec{}),
+		grpc.UnaryInterceptor(app.grpcUnaryAuth),
+		grpc.StreamInterceptor(app.grpcStreamAuth),
+	)
+	server.RegisterService(&chatServiceDesc, chatServer{app: app})
+	return server
+}
+
+// authenticates a call from the authorization or cookie metadata, which are
+// checked the way UserSession checks the http headers of the same name
+func (app App) grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range []string{"authorization", "cookie"} {
+		for _, value := range md.Get(key) {
+			req.Header.Add(key, value)
+		}
+	}
+
+	auth, err := app.authenticateRequest(ctx, req)
+	if err == ErrInvalidToken || err == ErrSessionNotFound || err == ErrLoginRequired {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	} else if err != nil {
+		Sugar.Error("Could not authenticate grpc call: ", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	if scope := grpcScopes[method]; !auth.HasScope(scope) {
+		return nil, status.Error(codes.PermissionDenied, "Api token needs the "+scope+" scope")
+	}
+
+	return context.WithValue(ctx, authKey, auth), nil
+}
+
+func (app App) grpcUnaryAuth(
+	ctx context.Context,
+	request interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, span := otel.Tracer("").Start(ctx, info.FullMethod)
+	defer span.End()
+
+	ctx, err := app.grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		span.SetStatus(otelcodes.Ok, "call was not authenticated")
+		return nil, err
+	}
+
+	response, err := handler(ctx, request)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, status.Code(err).String())
+	} else {
+		span.SetStatus(otelcodes.Ok, "")
+	}
+	return response, err
+}
+
+// the stream's context is replaced to carry the Auth
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream authenticatedStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (app App) grpcStreamAuth(
+	server interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, span := otel.Tracer("").Start(stream.Context(), info.FullMethod)
+	ctx, err := app.grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		span.SetStatus(otelcodes.Ok, "call was not authenticated")
+		span.End()
+		return err
+	}
+	// the span only covers opening the stream, like OpenWsConnection's
+	span.End()
+
+	return handler(server, authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// converts the errors shared with the http handlers to grpc statuses
+func grpcError(err error) error {
+	switch err {
+	case ErrRoomNotFound, ErrInviteNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrInviteExpired, ErrInviteRevoked, ErrInviteExhausted:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case ErrInviteForbidden, ErrNotRoomMember:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case ErrRoomExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	Sugar.Error(err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+type chatServer struct {
+	app App
+}
+
+// the http routes that create things are only open to verified users
+func (server chatServer) requireVerified(ctx context.Context, username string) error {
+	verified, err := server.app.isVerified(ctx, username)
+	if err != nil {
+		Sugar.Error("error checking whether user is verified: ", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	if !verified {
+		return status.Error(codes.PermissionDenied, "Confirm your email address to do this")
+	}
+	return nil
+}
+
+func (server chatServer) CreateRoom(ctx context.Context, request *CreateRoomRequest) (*Room, error) {
+	auth, _ := authFromContext(ctx)
+
+	err := Validate.Var(request.Name, roomNameRules)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Chatroom names are 4 to 29 ascii characters")
+	}
+	err = server.requireVerified(ctx, auth.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := server.app.createRoom(ctx, auth.Username, request.Name)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &Room{Name: room.Id}, nil
+}
+
+func (server chatServer) ListRooms(ctx context.Context, request *ListRoomsRequest) (*ListRoomsResponse, error) {
+	auth, _ := authFromContext(ctx)
+
+	// users without any rooms aren't in the table yet
+	chatrooms, err := getUserChatrooms(ctx, server.app.ScyllaDb, auth.Username)
+	if err != nil && err.Error() != "not found" {
+		return nil, grpcError(err)
+	}
+	currentRoom, err := getUserCurrentRoom(ctx, server.app.ScyllaDb, auth.Username)
+	if err != nil && err.Error() != "not found" {
+		return nil, grpcError(err)
+	}
+
+	return &ListRoomsResponse{Rooms: chatrooms, CurrentRoom: currentRoom}, nil
+}
+
+func outgoingChatMessage(message OutgoingMessage) *ChatMessage {
+	return &ChatMessage{
+		Room:      message.ChatroomName,
+		User:      message.UserId,
+		Content:   message.Content,
+		Timestamp: message.Timestamp,
+	}
+}
+
+func (server chatServer) GetMessages(ctx context.Context, request *GetMessagesRequest) (*GetMessagesResponse, error) {
+	auth, _ := authFromContext(ctx)
+
+	member, err := isRoomMember(ctx, server.app.ScyllaDb, auth.Username, request.Room)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if !member {
+		return nil, status.Error(codes.PermissionDenied, "Only members of the room can read its messages")
+	}
+
+	messages, err := server.app.roomMessages(request.Room)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &GetMessagesResponse{}
+	for _, message := range messages {
+		response.Messages = append(response.Messages, outgoingChatMessage(message))
+	}
+	return response, nil
+}
+
+func (server chatServer) CreateInvite(ctx context.Context, request *CreateInviteRequest) (*InviteLink, error) {
+	auth, _ := authFromContext(ctx)
+
+	if request.ExpirySeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Expiry must be 0 or more seconds")
+	}
+	if request.MaxUses < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Max uses must be a number that is 0 or greater")
+	}
+	err := server.requireVerified(ctx, auth.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := server.app.canInvite(ctx, auth.Username, request.Room)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if !allowed {
+		return nil, status.Error(codes.PermissionDenied, "Only members allowed to invite people can create invites")
+	}
+
+	code, err := server.app.Invitations.createInvite(request.Room, InviteOptions{
+		Creator: auth.Username,
+		Expiry:  time.Duration(request.ExpirySeconds) * time.Second,
+		MaxUses: int(request.MaxUses),
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &InviteLink{Code: code, Url: webUrl + "/room/join/" + code}, nil
+}
+
+func (server chatServer) JoinRoom(ctx context.Context, request *JoinRoomRequest) (*Room, error) {
+	auth, _ := authFromContext(ctx)
+
+	roomName, err := server.app.joinWithInvite(ctx, auth.Username, request.Code)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &Room{Name: roomName}, nil
+}
+
+// a payload's value as it's sent on the Chat stream, or nil for values it
+// doesn't carry
+func chatEvent(id uint64, value interface{}) *ChatEvent {
+	switch value := value.(type) {
+	case OutgoingMessage:
+		return &ChatEvent{Id: id, Message: outgoingChatMessage(value)}
+	case InvitationEvent:
+		invitation := value.Invitation
+		return &ChatEvent{Id: id, Invitation: &Invitation{
+			Id:      invitation.Id,
+			Room:    invitation.Chatroom,
+			Inviter: invitation.Inviter,
+			Invitee: invitation.Invitee,
+			Status:  invitation.Status,
+			Created: invitation.Created.Format(time.RFC3339),
+			Expires: invitation.Expires.Format(time.RFC3339),
+		}}
+	}
+	return nil
+}
+
+// the grpc version of OpenWsConnection. messages received on the stream are
+// sent to their rooms while the user's events are sent back on it
+func (server chatServer) Chat(stream ChatService_ChatServer) error {
+	ctx := stream.Context()
+	auth, _ := authFromContext(ctx)
+
+	chatUser, err := server.app.connectUser(ctx, auth.Username)
+	if err != nil {
+		return grpcError(err)
+	}
+	// only events from after the stream opened are sent on it
+	after := chatUser.Events.lastId()
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	// the status the stream ends with when the server closes it
+	closed := make(chan error, 1)
+	connection := chatUser.addConnection(auth.SessionId, func(code websocket.StatusCode, reason string) error {
+		grpcCode := codes.Unauthenticated
+		if code == CloseServerShutdown {
+			grpcCode = codes.Unavailable
+		}
+		select {
+		case closed <- status.Error(grpcCode, reason):
+		default:
+		}
+		stop()
+		return nil
+	})
+	defer chatUser.removeConnection(connection)
+
+	var recvErr error
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		defer stop()
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				recvErr = err
+				return
+			}
+
+			// the user could have changed their name while connected
+			err = server.app.sendMessage(ctx, chatUser.name(), request.Room, request.Message)
+			if err != nil {
+				Sugar.Error("could not send message: ", err)
+			}
+		}
+	}()
+
+	err = chatUser.Events.stream(ctx, after, func(event Event) error {
+		// the ids are the user's own so these can't share the payload's
+		// protobuf encoding
+		if message := chatEvent(event.Id, event.Payload.Value); message != nil {
+			return stream.Send(message)
+		}
+		return nil
+	})
+
+	select {
+	case err := <-closed:
+		return err
+	default:
+	}
+	if ctx.Err() == nil {
+		Sugar.Info("error sending event on grpc stream: ", err)
+		return err
+	}
+
+	// the client closed its side of the stream or went away
+	<-received
+	if recvErr == io.EOF {
+		return nil
+	}
+	return recvErr
+}
@@ -0,0 +1,470 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"nhooyr.io/websocket"
+)
+
+// serves the test application's grpc api and connects to it
+func grpcSetup(t *testing.T) *grpc.ClientConn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err listening: %v", err)
+	}
+	server := application.GrpcServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		listener.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{})),
+	)
+	if err != nil {
+		t.Fatalf("err dialing grpc server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// a context that sends the client's cookies with grpc calls
+func withCookies(ctx context.Context, serverUrl string, client *http.Client) context.Context {
+	u, _ := url.Parse(serverUrl)
+	var cookies []string
+	for _, cookie := range client.Jar.Cookies(u) {
+		cookies = append(cookies, cookie.String())
+	}
+	return metadata.AppendToOutgoingContext(ctx, "cookie", strings.Join(cookies, "; "))
+}
+
+func TestGrpcApi(t *testing.T) {
+	server, client, wsConn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		wsConn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+	conn := grpcSetup(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	call := func(ctx context.Context, method string, request interface{}, response interface{}) error {
+		return conn.Invoke(ctx, "/chat.v1.ChatService/"+method, request, response)
+	}
+
+	err = call(ctx, "ListRooms", &ListRoomsRequest{}, &ListRoomsResponse{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Call without credentials returned %v, wanted %v", status.Code(err), codes.Unauthenticated)
+	}
+
+	artemis := withCookies(ctx, server.URL, client)
+	room := &Room{}
+	err = call(artemis, "CreateRoom", &CreateRoomRequest{Name: "test chatroom"}, room)
+	if err != nil || room.Name != "test chatroom" {
+		t.Fatalf("CreateRoom returned %v (%v), wanted test chatroom", room.Name, err)
+	}
+	err = call(artemis, "CreateRoom", &CreateRoomRequest{Name: "no"}, &Room{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Short room name returned %v, wanted %v", status.Code(err), codes.InvalidArgument)
+	}
+
+	rooms := &ListRoomsResponse{}
+	err = call(artemis, "ListRooms", &ListRoomsRequest{}, rooms)
+	if err != nil || len(rooms.Rooms) != 1 || rooms.Rooms[0] != "test chatroom" {
+		t.Errorf("ListRooms returned %v (%v), wanted test chatroom", rooms.Rooms, err)
+	}
+
+	// messages sent on the stream come back on it and on the websocket
+	stream, err := conn.NewStream(artemis, &chatServiceDesc.Streams[0], "/chat.v1.ChatService/Chat")
+	if err != nil {
+		t.Fatalf("err opening chat stream: %v", err)
+	}
+	err = stream.SendMsg(&ChatRequest{Room: "test chatroom", Message: "hello"})
+	if err != nil {
+		t.Fatalf("err sending message: %v", err)
+	}
+	event := &ChatEvent{}
+	err = stream.RecvMsg(event)
+	if err != nil || event.Message == nil || event.Message.Content != "hello" || event.Message.User != "artemis" {
+		t.Fatalf("Chat stream sent %v (%v), wanted hello from artemis", event, err)
+	}
+	_, _, err = wsConn.Read(ctx)
+	if err != nil {
+		t.Errorf("err reading message from websocket: %v", err)
+	}
+
+	history := &GetMessagesResponse{}
+	err = call(artemis, "GetMessages", &GetMessagesRequest{Room: "test chatroom"}, history)
+	if err != nil || len(history.Messages) != 1 || history.Messages[0].Content != "hello" {
+		t.Errorf("GetMessages returned %v (%v), wanted the hello message", history.Messages, err)
+	}
+
+	invite := &InviteLink{}
+	err = call(artemis, "CreateInvite", &CreateInviteRequest{Room: "test chatroom", MaxUses: 1}, invite)
+	if err != nil || invite.Code == "" {
+		t.Fatalf("CreateInvite returned %v (%v), wanted an invite code", invite, err)
+	}
+
+	bobClient, err := secondUserClient(server.URL, client, "bob", "bob@gmail.com")
+	if err != nil {
+		t.Fatalf("err setting up second user: %v", err)
+	}
+	bob := withCookies(ctx, server.URL, bobClient)
+	err = call(bob, "CreateInvite", &CreateInviteRequest{Room: "test chatroom"}, &InviteLink{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Non member created an invite. Returned %v, wanted %v", status.Code(err), codes.PermissionDenied)
+	}
+	err = call(bob, "GetMessages", &GetMessagesRequest{Room: "test chatroom"}, &GetMessagesResponse{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Non member read the room's messages. Returned %v, wanted %v", status.Code(err), codes.PermissionDenied)
+	}
+
+	joined := &Room{}
+	err = call(bob, "JoinRoom", &JoinRoomRequest{Code: invite.Code}, joined)
+	if err != nil || joined.Name != "test chatroom" {
+		t.Errorf("JoinRoom returned %v (%v), wanted test chatroom", joined.Name, err)
+	}
+	err = call(bob, "JoinRoom", &JoinRoomRequest{Code: invite.Code}, &Room{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Used up invite returned %v, wanted %v", status.Code(err), codes.FailedPrecondition)
+	}
+
+	err = stream.CloseSend()
+	if err != nil {
+		t.Errorf("err closing chat stream: %v", err)
+	}
+	err = stream.RecvMsg(&ChatEvent{})
+	if err == nil {
+		t.Errorf("Chat stream stayed open after the client closed it")
+	}
+}
+
+func TestGrpcApiToken(t *testing.T) {
+	server, _, wsConn, err := authenticatedSetup()
+	if err != nil {
+		t.Errorf("Setting up server and database was a failure: %v", err)
+	}
+	t.Cleanup(func() {
+		wsConn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+		databaseReset()
+	})
+	conn := grpcSetup(t)
+
+	_, token, err := application.createToken(context.Background(), "artemis", NewApiToken{
+		Name:   "reader bot",
+		Scopes: []string{ScopeRead},
+	})
+	if err != nil {
+		t.Fatalf("err creating token: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+
+	err = conn.Invoke(ctx, "/chat.v1.ChatService/ListRooms", &ListRoomsRequest{}, &ListRoomsResponse{})
+	if err != nil {
+		t.Errorf("Read token could not list rooms: %v", err)
+	}
+	err = conn.Invoke(ctx, "/chat.v1.ChatService/CreateRoom", &CreateRoomRequest{Name: "test chatroom"}, &Room{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Read token created a room. Returned %v, wanted %v", status.Code(err), codes.PermissionDenied)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer not-a-token")
+	err = conn.Invoke(ctx, "/chat.v1.ChatService/ListRooms", &ListRoomsRequest{}, &ListRoomsResponse{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Invalid token returned %v, wanted %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+// the scalar types used in proto/chat.proto
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+}
+
+// builds the descriptor of a .proto file that only has messages with scalar,
+// message, repeated and oneof fields, which is all chat.proto uses, since
+// protoc isn't needed to build the app. services are skipped
+func parseProtoFile(name string, source string) (protoreflect.FileDescriptor, error) {
+	var lines []string
+	for _, line := range strings.Split(source, "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	replacer := strings.NewReplacer("{", " { ", "}", " } ", ";", " ; ", "=", " = ")
+	tokens := strings.Fields(replacer.Replace(strings.Join(lines, "\n")))
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:   proto.String(name),
+		Syntax: proto.String("proto3"),
+	}
+	next := func() string {
+		if len(tokens) == 0 {
+			return ""
+		}
+		token := tokens[0]
+		tokens = tokens[1:]
+		return token
+	}
+	skipPast := func(end string) {
+		for token := next(); token != end && token != ""; token = next() {
+		}
+	}
+	skipBlock := func() {
+		skipPast("{")
+		for depth := 1; depth > 0 && len(tokens) > 0; {
+			switch next() {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+		}
+	}
+
+	for len(tokens) > 0 {
+		switch token := next(); token {
+		case "syntax", "option", "import":
+			skipPast(";")
+		case "package":
+			file.Package = proto.String(next())
+			skipPast(";")
+		case "service":
+			skipBlock()
+		case "message":
+			message := &descriptorpb.DescriptorProto{Name: proto.String(next())}
+			if next() != "{" {
+				return nil, fmt.Errorf("message %v has no body", message.GetName())
+			}
+			var oneof *int32
+			for token := next(); token != "}" || oneof != nil; token = next() {
+				switch {
+				case token == "":
+					return nil, fmt.Errorf("message %v is not closed", message.GetName())
+				case token == "}":
+					oneof = nil
+					continue
+				case token == "oneof":
+					message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String(next())})
+					oneof = proto.Int32(int32(len(message.OneofDecl) - 1))
+					next()
+					continue
+				}
+
+				field := &descriptorpb.FieldDescriptorProto{
+					Label:      descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					OneofIndex: oneof,
+				}
+				if token == "repeated" {
+					field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					token = next()
+				}
+				if scalar, ok := protoScalarTypes[token]; ok {
+					field.Type = scalar.Enum()
+				} else {
+					field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+					field.TypeName = proto.String("." + file.GetPackage() + "." + token)
+				}
+				field.Name = proto.String(next())
+				if next() != "=" {
+					return nil, fmt.Errorf("field %v.%v has no number", message.GetName(), field.GetName())
+				}
+				number, err := strconv.Atoi(next())
+				if err != nil {
+					return nil, fmt.Errorf("field %v.%v: %w", message.GetName(), field.GetName(), err)
+				}
+				field.Number = proto.Int32(int32(number))
+				field.JsonName = proto.String(protoCamelCase(field.GetName()))
+				skipPast(";")
+				message.Field = append(message.Field, field)
+			}
+			file.MessageType = append(file.MessageType, message)
+		default:
+			return nil, fmt.Errorf("unexpected %q in %v", token, name)
+		}
+	}
+
+	return protodesc.NewFile(file, new(protoregistry.Files))
+}
+
+// current_room becomes currentRoom, the way the go field is CurrentRoom
+func protoCamelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.Title(parts[i])
+	}
+	return strings.Join(parts, "")
+}
+
+// checks every field the .proto gives the message has the same value in the
+// hand written struct
+func compareProtoFields(t *testing.T, path string, value reflect.Value, message protoreflect.Message) {
+	fields := message.Descriptor().Fields()
+	if value.NumField() != fields.Len() {
+		t.Errorf("%v has %v fields, chat.proto has %v", path, value.NumField(), fields.Len())
+	}
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		name := path + "." + string(field.Name())
+		goField := value.FieldByName(strings.Title(protoCamelCase(string(field.Name()))))
+		if !goField.IsValid() {
+			t.Errorf("%v is missing from the go struct", name)
+			continue
+		}
+
+		switch {
+		case field.IsList():
+			list := message.Get(field).List()
+			if list.Len() != goField.Len() {
+				t.Errorf("%v decoded with %v items, wanted %v", name, list.Len(), goField.Len())
+				continue
+			}
+			for j := 0; j < list.Len(); j++ {
+				item := fmt.Sprintf("%v[%v]", name, j)
+				if field.Kind() == protoreflect.MessageKind {
+					compareProtoFields(t, item, goField.Index(j).Elem(), list.Get(j).Message())
+				} else if list.Get(j).Interface() != goField.Index(j).Interface() {
+					t.Errorf("%v decoded as %v, wanted %v", item, list.Get(j).Interface(), goField.Index(j).Interface())
+				}
+			}
+		case field.Kind() == protoreflect.MessageKind:
+			if goField.IsNil() {
+				if message.Has(field) {
+					t.Errorf("%v was set, wanted it left out", name)
+				}
+				continue
+			}
+			if !message.Has(field) {
+				t.Errorf("%v was left out", name)
+				continue
+			}
+			compareProtoFields(t, name, goField.Elem(), message.Get(field).Message())
+		default:
+			if message.Get(field).Interface() != goField.Interface() {
+				t.Errorf("%v decoded as %v, wanted %v", name, message.Get(field).Interface(), goField.Interface())
+			}
+		}
+	}
+}
+
+// the messages in chat_proto.go are encoded by hand, so each one is checked
+// against proto/chat.proto by decoding it with a message built from the
+// .proto file and encoding it back
+func TestProtoConformance(t *testing.T) {
+	source, err := ioutil.ReadFile("../proto/chat.proto")
+	if err != nil {
+		t.Fatalf("err reading chat.proto: %v", err)
+	}
+	file, err := parseProtoFile("chat.proto", string(source))
+	if err != nil {
+		t.Fatalf("err parsing chat.proto: %v", err)
+	}
+
+	// every field is set, each to a different value so fields with
+	// swapped numbers are caught
+	message := &ChatMessage{Room: "test chatroom", User: "artemis", Content: "hello", Timestamp: "2021-05-01T10:00:00Z"}
+	invitation := &Invitation{
+		Id:      42,
+		Room:    "test chatroom",
+		Inviter: "artemis",
+		Invitee: "bob",
+		Status:  InvitationPending,
+		Created: "2021-05-01T10:00:00Z",
+		Expires: "2021-05-08T10:00:00Z",
+	}
+	samples := []protoMessage{
+		&Room{Name: "test chatroom"},
+		&CreateRoomRequest{Name: "test chatroom"},
+		&ListRoomsRequest{},
+		&ListRoomsResponse{Rooms: []string{"test chatroom", "other room"}, CurrentRoom: "other room"},
+		&GetMessagesRequest{Room: "test chatroom"},
+		&GetMessagesResponse{Messages: []*ChatMessage{
+			message,
+			{Room: "test chatroom", User: "bob", Content: "hi", Timestamp: "2021-05-01T10:01:00Z"},
+		}},
+		message,
+		&CreateInviteRequest{Room: "test chatroom", ExpirySeconds: 3600, MaxUses: 5},
+		&InviteLink{Code: "brave-otter", Url: "http://localhost:8000/room/join/brave-otter"},
+		&JoinRoomRequest{Code: "brave-otter"},
+		&ChatRequest{Room: "test chatroom", Message: "hello"},
+		&ChatEvent{Id: 7, Message: message},
+		&ChatEvent{Id: 8, Invitation: invitation},
+		invitation,
+	}
+
+	checked := map[protoreflect.Name]bool{}
+	for _, sample := range samples {
+		goType := reflect.TypeOf(sample).Elem()
+		descriptor := file.Messages().ByName(protoreflect.Name(goType.Name()))
+		if descriptor == nil {
+			t.Errorf("%v is not in chat.proto", goType.Name())
+			continue
+		}
+		checked[descriptor.Name()] = true
+
+		dynamic := dynamicpb.NewMessage(descriptor)
+		err = proto.Unmarshal(sample.marshalProto(), dynamic)
+		if err != nil {
+			t.Errorf("%v could not be decoded with chat.proto: %v", goType.Name(), err)
+			continue
+		}
+		if unknown := dynamic.GetUnknown(); len(unknown) > 0 {
+			t.Errorf("%v has fields chat.proto doesn't: %v", goType.Name(), unknown)
+		}
+		compareProtoFields(t, goType.Name(), reflect.ValueOf(sample).Elem(), dynamic)
+
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(dynamic)
+		if err != nil {
+			t.Fatalf("err encoding %v: %v", goType.Name(), err)
+		}
+		decoded := reflect.New(goType).Interface().(protoMessage)
+		err = decoded.unmarshalProto(data)
+		if err != nil {
+			t.Errorf("%v encoded from chat.proto could not be decoded: %v", goType.Name(), err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, sample) {
+			t.Errorf("%v decoded as %+v, wanted %+v", goType.Name(), decoded, sample)
+		}
+	}
+
+	for i := 0; i < file.Messages().Len(); i++ {
+		if name := file.Messages().Get(i).Name(); !checked[name] {
+			t.Errorf("%v in chat.proto is not checked", name)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package app
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"errors"
+	"fmt"
 	"math"
-	"math/rand"
+	"math/big"
+	"strings"
 	"time"
+	"unicode"
 )
 
 const (
@@ -13,12 +18,61 @@ const (
 	Day   = 1
 )
 
+var (
+	ErrInviteNotFound  = errors.New("invite not found")
+	ErrInviteExpired   = errors.New("invite has expired")
+	ErrInviteRevoked   = errors.New("invite has been revoked")
+	ErrInviteExhausted = errors.New("invite has reached its maximum number of uses")
+	ErrInviteForbidden = errors.New("invite creator is not allowed to invite people to the room")
+)
+
 type InviteTimeLimit struct {
 	limit int32
 }
 
+// converts one of the fixed time limits into an expiry duration
+// a duration of 0 means the invite never expires
+func (timeLimit InviteTimeLimit) duration() time.Duration {
+	return time.Hour * 24 * time.Duration(timeLimit.limit)
+}
+
+type Invite struct {
+	Code     string `json:"code"`
+	Chatroom string `json:"chatroom"`
+	Creator  string `json:"creator"`
+	// nil when the invite never expires
+	Expires *time.Time `json:"expires"`
+	// 0 means the invite can be used an unlimited number of times
+	MaxUses int  `json:"max_uses"`
+	Uses    int  `json:"uses"`
+	Revoked bool `json:"revoked"`
+}
+
+// returns an error describing why the invite can't be used
+// or nil if it can still be used to join its room
+func (invite Invite) usable(now time.Time) error {
+	if invite.Revoked {
+		return ErrInviteRevoked
+	}
+	if invite.Expires != nil && !invite.Expires.After(now) {
+		return ErrInviteExpired
+	}
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return ErrInviteExhausted
+	}
+	return nil
+}
+
+type InviteOptions struct {
+	Creator string
+	// 0 means the invite never expires
+	Expiry  time.Duration
+	MaxUses int
+}
+
 type Invitations struct {
-	pg *sql.DB
+	pg         *sql.DB
+	CodeConfig InviteCodeConfig
 	// will store some information on client to interface with url generation service
 	// when it gets to that point
 	// rigth now  this won't hold anything
@@ -27,81 +81,370 @@ type Invitations struct {
 
 // this will return a new unique invite string
 // it will return an error if there was an issue creating the invite
-func (self Invitations) createInvite(roomName string, timeLimit InviteTimeLimit) (string, error) {
-	inviteCode := generateInvite()
-
-	now := time.Now()
-	inviteTimeLimit := time.Time{}
-	forever := 0.0
-	switch timeLimit.limit {
-	case Day:
-		inviteTimeLimit = now.Add(time.Hour * 24)
-	case Week:
-		inviteTimeLimit = now.Add(time.Hour * 24 * 7)
-	case Never:
-		forever = math.Inf(1)
-	}
-
-	if forever == math.Inf(1) {
-		_, err := self.pg.Exec(
-			`INSERT INTO Invites (invite, chatroom, expires) VALUES ($1, $2, $3)`,
-			inviteCode,
-			roomName,
-			"infinity",
-		)
+func (self Invitations) createInvite(roomName string, options InviteOptions) (string, error) {
+	// infinity is a valid postgres timestamp and is used for invites
+	// that never expire
+	var expires interface{} = "infinity"
+	if options.Expiry > 0 {
+		expires = time.Now().Add(options.Expiry)
+	}
+
+	// a new code is generated whenever it collides with an existing one
+	for attempt := 0; attempt < maxInviteCodeAttempts; attempt++ {
+		inviteCode, err := self.CodeConfig.generate()
 		if err != nil {
-			Sugar.Error("error inserting invite into invites table: ", err)
+			Sugar.Error("error generating invite code: ", err)
 			return "", err
 		}
-	} else {
-		_, err := self.pg.Exec(
-			`INSERT INTO Invites (invite, chatroom, expires) VALUES ($1, $2, $3)`,
+
+		result, err := self.pg.Exec(
+			`INSERT INTO Invites (invite, chatroom, expires, creator, max_uses) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (invite) DO NOTHING`,
 			inviteCode,
 			roomName,
-			inviteTimeLimit,
+			expires,
+			options.Creator,
+			options.MaxUses,
 		)
 		if err != nil {
 			Sugar.Error("error inserting invite into invites table: ", err)
 			return "", err
 		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return "", err
+		}
+		if count == 1 {
+			return inviteCode, nil
+		}
+		Sugar.Warn("invite code collided with an existing invite, attempt: ", attempt+1)
 	}
 
-	return inviteCode, nil
+	return "", ErrInviteCodeCollision
 }
 
-// this will check if an invite exists and if it does
-// which room it belongs to
-func (self Invitations) getChatroom(inviteCode string) (string, error) {
-
+// this will check if an invite exists and return it
+func (self Invitations) getInvite(inviteCode string) (Invite, error) {
+	inviteCode = self.CodeConfig.normalize(inviteCode)
 	row := self.pg.QueryRow(
-		`SELECT chatroom, expires FROM Invites WHERE invite=$1`,
+		`SELECT invite, chatroom, creator, NULLIF(expires, 'infinity'), max_uses, uses, revoked
+		FROM Invites WHERE invite=$1`,
 		inviteCode,
 	)
 
-	var chatroomName string
-	// TODO: use this to figure out whether invite is past its expiration
-	// before allowing user to use it
-	var inviteExpiration string
-	err := row.Scan(&chatroomName, &inviteExpiration)
+	var invite Invite
+	err := row.Scan(
+		&invite.Code,
+		&invite.Chatroom,
+		&invite.Creator,
+		&invite.Expires,
+		&invite.MaxUses,
+		&invite.Uses,
+		&invite.Revoked,
+	)
 	if err == sql.ErrNoRows {
-		Sugar.Error("invite not found: ", err)
-		return "", err
+		Sugar.Info("invite not found: ", inviteCode)
+		return Invite{}, ErrInviteNotFound
 	} else if err != nil {
 		Sugar.Error("err scanning row: ", err)
+		return Invite{}, err
+	}
+
+	return invite, nil
+}
+
+// this will count a use of the invite and return the room it belongs to
+// it returns an error describing why the invite can't be used if it is
+// revoked, expired, or has no uses left
+func (self Invitations) useInvite(inviteCode string) (string, error) {
+	inviteCode = self.CodeConfig.normalize(inviteCode)
+	row := self.pg.QueryRow(
+		`UPDATE Invites SET uses = uses + 1
+		WHERE invite=$1 AND NOT revoked AND expires > now() AND (max_uses = 0 OR uses < max_uses)
+		RETURNING chatroom`,
+		inviteCode,
+	)
+
+	var chatroomName string
+	err := row.Scan(&chatroomName)
+	if err == nil {
+		return chatroomName, nil
+	} else if err != sql.ErrNoRows {
+		Sugar.Error("err using invite: ", err)
 		return "", err
 	}
 
-	return chatroomName, nil
+	// the invite couldn't be used so find out why
+	invite, err := self.getInvite(inviteCode)
+	if err != nil {
+		return "", err
+	}
+	err = invite.usable(time.Now())
+	if err == nil {
+		// the update didn't match but the invite looks usable, so it
+		// must have expired in between the two queries
+		err = ErrInviteExpired
+	}
+	return "", err
 }
 
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+// returns the invites for a room that can still be used
+func (self Invitations) activeInvites(roomName string) ([]Invite, error) {
+	rows, err := self.pg.Query(
+		`SELECT invite, chatroom, creator, NULLIF(expires, 'infinity'), max_uses, uses, revoked
+		FROM Invites
+		WHERE chatroom=$1 AND NOT revoked AND expires > now() AND (max_uses = 0 OR uses < max_uses)
+		ORDER BY id`,
+		roomName,
+	)
+	if err != nil {
+		Sugar.Error("error querying active invites: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		err = rows.Scan(
+			&invite.Code,
+			&invite.Chatroom,
+			&invite.Creator,
+			&invite.Expires,
+			&invite.MaxUses,
+			&invite.Uses,
+			&invite.Revoked,
+		)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}
+
+// marks an invite as revoked so it can no longer be used to join its room
+func (self Invitations) revokeInvite(inviteCode string) error {
+	inviteCode = self.CodeConfig.normalize(inviteCode)
+	result, err := self.pg.Exec(
+		`UPDATE Invites SET revoked = true WHERE invite=$1`,
+		inviteCode,
+	)
+	if err != nil {
+		Sugar.Error("error revoking invite: ", err)
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrInviteNotFound
+	}
+
+	return nil
+}
 
-// I will have to find a truly random sampler, but this should work for now
-func generateInvite() string {
-	b := make([]rune, 8)
+type InviteCodeFormat string
+
+const (
+	// characters picked at random from the alphabet, like "aZ3kP9qX"
+	InviteCodeRandom InviteCodeFormat = "random"
+	// random characters split into groups of four, like "7KQD-M2XA"
+	InviteCodeGrouped InviteCodeFormat = "grouped"
+	// random words, like "lamp-river-oak-hint"
+	InviteCodeWords InviteCodeFormat = "words"
+)
+
+const maxInviteCodeAttempts = 5
+
+const inviteCodeGroupSize = 4
+
+// guessing a code has to take at least 2^40 tries
+const minInviteCodeBits = 40
+
+var ErrInviteCodeCollision = errors.New("could not generate an invite code that isn't already in use")
+
+// letters and digits that can't be mistaken for one another when read aloud
+// or handwritten, from Crockford's base32
+const readableAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// the letters Crockford's base32 reads as the digits they look like
+var readableLookalikes = map[rune]rune{'O': '0', 'I': '1', 'L': '1'}
+
+const defaultAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+type InviteCodeConfig struct {
+	Format InviteCodeFormat
+	// number of characters in the code, or number of words for the words format
+	Length int
+	// characters the code is made of, ignored by the words format
+	Alphabet string
+}
+
+func DefaultInviteCodeConfig() InviteCodeConfig {
+	return InviteCodeConfig{
+		Format:   InviteCodeRandom,
+		Length:   10,
+		Alphabet: defaultAlphabet,
+	}
+}
+
+// NewInviteCodeConfig fills in the length and alphabet that suit the format
+// when they aren't given and checks the result can produce usable codes
+func NewInviteCodeConfig(format InviteCodeFormat, length int, alphabet string) (InviteCodeConfig, error) {
+	config := InviteCodeConfig{
+		Format:   format,
+		Length:   length,
+		Alphabet: alphabet,
+	}
+
+	switch format {
+	case InviteCodeRandom:
+		if config.Length == 0 {
+			config.Length = 10
+		}
+		if config.Alphabet == "" {
+			config.Alphabet = defaultAlphabet
+		}
+	case InviteCodeGrouped:
+		if config.Length == 0 {
+			config.Length = 8
+		}
+		if config.Alphabet == "" {
+			config.Alphabet = readableAlphabet
+		}
+	case InviteCodeWords:
+		if config.Length == 0 {
+			config.Length = 5
+		}
+	default:
+		return InviteCodeConfig{}, fmt.Errorf("unknown invite code format: %v", format)
+	}
+
+	if config.Length < 4 {
+		return InviteCodeConfig{}, fmt.Errorf("invite codes must be at least 4 long, got %v", config.Length)
+	}
+
+	symbols := len(inviteWords)
+	if format != InviteCodeWords {
+		seen := make(map[rune]bool)
+		for _, char := range config.Alphabet {
+			if seen[char] {
+				return InviteCodeConfig{}, fmt.Errorf("invite code alphabet repeats %q", char)
+			}
+			seen[char] = true
+		}
+		if len(seen) < 2 {
+			return InviteCodeConfig{}, errors.New("invite code alphabet needs at least 2 characters")
+		}
+		symbols = len(seen)
+	}
+
+	bits := float64(config.Length) * math.Log2(float64(symbols))
+	if bits < minInviteCodeBits {
+		return InviteCodeConfig{}, fmt.Errorf(
+			"invite codes need at least %v bits of randomness, %v picked from %v gives %.1f",
+			minInviteCodeBits, config.Length, symbols, bits,
+		)
+	}
+
+	return config, nil
+}
+
+// creates a new invite code using a cryptographically secure random source
+func (config InviteCodeConfig) generate() (string, error) {
+	switch config.Format {
+	case InviteCodeWords:
+		words := make([]string, config.Length)
+		for i := range words {
+			idx, err := randomIndex(len(inviteWords))
+			if err != nil {
+				return "", err
+			}
+			words[i] = inviteWords[idx]
+		}
+		return strings.Join(words, "-"), nil
+	case InviteCodeGrouped:
+		code, err := randomString(config.Alphabet, config.Length)
+		if err != nil {
+			return "", err
+		}
+		return groupCode(code), nil
+	default:
+		code, err := randomString(config.Alphabet, config.Length)
+		if err != nil {
+			return "", err
+		}
+		return string(code), nil
+	}
+}
+
+// splits the code into groups of four joined by dashes
+func groupCode(code []rune) string {
+	groups := make([]string, 0, len(code)/inviteCodeGroupSize+1)
+	for len(code) > inviteCodeGroupSize {
+		groups = append(groups, string(code[:inviteCodeGroupSize]))
+		code = code[inviteCodeGroupSize:]
+	}
+	groups = append(groups, string(code))
+	return strings.Join(groups, "-")
+}
+
+// turns a code someone typed after hearing it or reading it off a note into
+// the code that was generated. grouped codes can be in any case, with or
+// without dashes, and with the letters Crockford's base32 mistakes for
+// digits. words codes can be in any case and separated by spaces
+func (config InviteCodeConfig) normalize(code string) string {
+	code = strings.TrimSpace(code)
+	switch config.Format {
+	case InviteCodeGrouped:
+		chars := make([]rune, 0, len(code))
+		for _, char := range code {
+			if !strings.ContainsRune(config.Alphabet, char) {
+				char = unicode.ToUpper(char)
+				if lookalike, ok := readableLookalikes[char]; ok && !strings.ContainsRune(config.Alphabet, char) {
+					char = lookalike
+				}
+			}
+			// dashes, spaces and anything else that can't be in a code
+			if strings.ContainsRune(config.Alphabet, char) {
+				chars = append(chars, char)
+			}
+		}
+		return groupCode(chars)
+	case InviteCodeWords:
+		words := strings.FieldsFunc(strings.ToLower(code), func(char rune) bool {
+			return char == '-' || unicode.IsSpace(char)
+		})
+		return strings.Join(words, "-")
+	default:
+		return code
+	}
+}
+
+func randomString(alphabet string, length int) ([]rune, error) {
+	letters := []rune(alphabet)
+	b := make([]rune, length)
 	for i := range b {
-		idx := rand.Intn(len(letterRunes))
-		b[i] = letterRunes[idx]
+		idx, err := randomIndex(len(letters))
+		if err != nil {
+			return nil, err
+		}
+		b[i] = letters[idx]
+	}
+	return b, nil
+}
+
+// returns a uniformly distributed number in [0, n)
+func randomIndex(n int) (int, error) {
+	idx, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
 	}
-	return string(b)
+	return int(idx.Int64()), nil
 }
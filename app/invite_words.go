@@ -0,0 +1,32 @@
+package app
+
+// short, distinct words used for invite codes that are easy to read aloud
+// there are exactly 256 so each word carries 8 bits of randomness
+var inviteWords = []string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby", "back", "ball",
+	"band", "bank", "base", "bath", "bear", "beat", "bell", "belt", "bird", "blue",
+	"boat", "body", "bone", "book", "boot", "born", "boss", "both", "bowl", "bulk",
+	"burn", "bush", "busy", "cake", "call", "calm", "came", "camp", "card", "care",
+	"cart", "case", "cash", "cast", "cell", "chat", "chip", "city", "clay", "club",
+	"coal", "coat", "code", "cold", "cook", "cool", "copy", "corn", "cost", "crew",
+	"crop", "dark", "data", "date", "dawn", "deal", "deep", "deer", "desk", "dial",
+	"diet", "dirt", "dish", "dock", "door", "dose", "down", "draw", "drop", "drum",
+	"duck", "dust", "duty", "each", "earn", "east", "easy", "edge", "else", "even",
+	"ever", "face", "fact", "fair", "fall", "farm", "fast", "fear", "feed", "feel",
+	"fern", "file", "fill", "film", "find", "fine", "fire", "firm", "fish", "five",
+	"flag", "flat", "flow", "folk", "food", "foot", "fork", "form", "fort", "four",
+	"free", "frog", "fuel", "full", "fund", "gain", "game", "gate", "gear", "gift",
+	"girl", "give", "glad", "glow", "goal", "goat", "gold", "golf", "good", "gray",
+	"grew", "grow", "gulf", "hair", "half", "hall", "hand", "hang", "hard", "harm",
+	"hawk", "head", "heat", "held", "help", "herb", "hero", "high", "hill", "hint",
+	"hold", "hole", "home", "hook", "hope", "horn", "host", "hour", "huge", "idea",
+	"inch", "iron", "item", "jazz", "join", "joke", "jump", "jury", "keen", "keep",
+	"kept", "kind", "king", "kite", "knee", "knot", "lake", "lamp", "land", "lane",
+	"last", "late", "lawn", "lead", "leaf", "left", "lens", "life", "lift", "like",
+	"lime", "line", "link", "lion", "list", "live", "load", "loan", "lock", "long",
+	"loop", "lord", "love", "luck", "lung", "made", "mail", "main", "make", "mall",
+	"many", "mark", "mask", "mass", "meal", "meat", "melt", "menu", "mild", "milk",
+	"mill", "mind", "mint", "miss", "mode", "moon", "more", "moss", "most", "move",
+	"much", "nail", "name", "navy", "near", "neat", "neck", "need", "nest", "news",
+	"next", "nice", "nine", "node", "none", "noon",
+}
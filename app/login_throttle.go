@@ -0,0 +1,249 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	// failures are counted per email so accounts that don't exist are
+	// throttled the same way and can't be told apart
+	throttleAccount = "account"
+	throttleIp      = "ip"
+
+	SecurityEventAccountLocked = "account_locked"
+	SecurityEventIpLocked      = "ip_locked"
+)
+
+// how many failed logins are allowed before logins are locked and for how long.
+// each failure past the limit doubles the lockout up to MaxLockout
+type LoginThrottleConfig struct {
+	AccountLimit int
+	IpLimit      int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+	// failures older than this are forgotten
+	Window time.Duration
+}
+
+func DefaultLoginThrottleConfig() LoginThrottleConfig {
+	return LoginThrottleConfig{
+		AccountLimit: 5,
+		IpLimit:      20,
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		Window:       time.Hour,
+	}
+}
+
+func (config LoginThrottleConfig) lockout(failures int, limit int) time.Duration {
+	if failures < limit {
+		return 0
+	}
+	lockout := config.BaseLockout
+	for i := limit; i < failures && lockout < config.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > config.MaxLockout {
+		lockout = config.MaxLockout
+	}
+	return lockout
+}
+
+// returned instead of checking the password while logins are locked
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (err *LoginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %v", err.RetryAfter)
+}
+
+type SecurityEvent struct {
+	Id      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Ip      string    `json:"ip"`
+	Detail  string    `json:"detail"`
+	Created time.Time `json:"created"`
+}
+
+func (app App) recordSecurityEvent(ctx context.Context, username string, kind string, ip string, detail string) {
+	_, err := app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO SecurityEvents (username, kind, ip, detail) VALUES ($1, $2, $3, $4)`,
+		username,
+		kind,
+		ip,
+		detail,
+	)
+	if err != nil {
+		Sugar.Error("error inserting security event: ", err)
+	}
+}
+
+// returns how long until logins for the email or from the ip are allowed again
+func (app App) loginLockout(ctx context.Context, email string, ip string) (time.Duration, error) {
+	return app.throttleLockout(ctx, throttleAccount, email, throttleIp, ip)
+}
+
+// returns how long until the email's and the ip's keys of the kinds are both
+// unlocked
+func (app App) throttleLockout(ctx context.Context, emailKind string, email string, ipKind string, ip string) (time.Duration, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT max(locked_until) FROM LoginFailures
+		WHERE ((kind=$1 AND key=$2) OR (kind=$3 AND key=$4)) AND locked_until > now()`,
+		emailKind,
+		strings.ToLower(email),
+		ipKind,
+		ip,
+	)
+	var lockedUntil sql.NullTime
+	err := row.Scan(&lockedUntil)
+	if err != nil {
+		Sugar.Error("error getting lockout: ", err)
+		return 0, err
+	}
+	if !lockedUntil.Valid {
+		return 0, nil
+	}
+	return time.Until(lockedUntil.Time), nil
+}
+
+// counts a failed login against the key and locks it once there are too many
+func (app App) countLoginFailure(ctx context.Context, kind string, key string, limit int) (int, time.Duration, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`INSERT INTO LoginFailures (kind, key, failures, last_failure) VALUES ($1, $2, 1, now())
+		ON CONFLICT (kind, key) DO UPDATE SET
+			failures = CASE WHEN LoginFailures.last_failure < $3 THEN 1 ELSE LoginFailures.failures + 1 END,
+			last_failure = now()
+		RETURNING failures`,
+		kind,
+		key,
+		time.Now().Add(-app.LoginThrottle.Window),
+	)
+	var failures int
+	err := row.Scan(&failures)
+	if err != nil {
+		Sugar.Error("error counting login failure: ", err)
+		return 0, 0, err
+	}
+
+	lockout := app.LoginThrottle.lockout(failures, limit)
+	if lockout == 0 {
+		return failures, 0, nil
+	}
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`UPDATE LoginFailures SET locked_until=$3 WHERE kind=$1 AND key=$2`,
+		kind,
+		key,
+		time.Now().Add(lockout),
+	)
+	if err != nil {
+		Sugar.Error("error locking logins: ", err)
+		return 0, 0, err
+	}
+	return failures, lockout, nil
+}
+
+func (app App) recordLoginFailure(ctx context.Context, email string, username string, ip string) error {
+	failures, lockout, err := app.countLoginFailure(ctx, throttleAccount, strings.ToLower(email), app.LoginThrottle.AccountLimit)
+	if err != nil {
+		return err
+	}
+	if lockout > 0 {
+		app.recordSecurityEvent(
+			ctx,
+			username,
+			SecurityEventAccountLocked,
+			ip,
+			fmt.Sprintf("logins for %v locked for %v after %v failed attempts", email, lockout, failures),
+		)
+	}
+
+	failures, lockout, err = app.countLoginFailure(ctx, throttleIp, ip, app.LoginThrottle.IpLimit)
+	if err != nil {
+		return err
+	}
+	if lockout > 0 {
+		app.recordSecurityEvent(
+			ctx,
+			"",
+			SecurityEventIpLocked,
+			ip,
+			fmt.Sprintf("logins from %v locked for %v after %v failed attempts", ip, lockout, failures),
+		)
+	}
+	return nil
+}
+
+// a successful login forgets the account's failures but not the ip's
+// so one good password doesn't unlock guessing at other accounts
+func (app App) clearLoginFailures(ctx context.Context, email string) error {
+	_, err := app.Pg.ExecContext(
+		ctx,
+		`DELETE FROM LoginFailures WHERE kind=$1 AND key=$2`,
+		throttleAccount,
+		strings.ToLower(email),
+	)
+	if err != nil {
+		Sugar.Error("error clearing login failures: ", err)
+	}
+	return err
+}
+
+// sets Retry-After for a throttled login, rounded up to whole seconds
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds())
+	if time.Duration(seconds)*time.Second < retryAfter {
+		seconds++
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+func (app App) ListSecurityEvents(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ListSecurityEvents")
+	defer span.End()
+
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT id, kind, ip, detail, created FROM SecurityEvents
+		WHERE username=$1 ORDER BY created DESC LIMIT 100`,
+		currentUser(req),
+	)
+	if err != nil {
+		Sugar.Error("error querying security events: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error listing security events.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var event SecurityEvent
+		err = rows.Scan(&event.Id, &event.Kind, &event.Ip, &event.Detail, &event.Created)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Error listing security events.")
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
+		}
+		events = append(events, event)
+	}
+
+	span.SetStatus(codes.Ok, "")
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// sends emails to users, like password reset links
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+func formatMail(from string, mail Mail) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.Replace(mail.Body, "\n", "\r\n", -1))
+	return message.Bytes()
+}
+
+// sends mail through an smtp server
+// a local stand in like MailHog can be used with no auth
+type SMTPMailer struct {
+	// host and port of the smtp server, like localhost:1025
+	Addr string
+	From string
+	// nil when the server doesn't require authentication
+	Auth smtp.Auth
+}
+
+func (mailer SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	return smtp.SendMail(mailer.Addr, mailer.Auth, mailer.From, []string{mail.To}, formatMail(mailer.From, mail))
+}
+
+// writes every mail as a .eml file in a directory instead of sending it
+// which is useful for working on the application offline
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (mailer FileMailer) Send(ctx context.Context, mail Mail) error {
+	err := os.MkdirAll(mailer.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(mail.To, "@", "_at_", -1))
+	return ioutil.WriteFile(filepath.Join(mailer.Dir, name), formatMail(mailer.From, mail), 0644)
+}
+
+// keeps every mail in memory so tests can read them
+type MemoryMailer struct {
+	mutex sync.Mutex
+	sent  []Mail
+}
+
+func (mailer *MemoryMailer) Send(ctx context.Context, mail Mail) error {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	mailer.sent = append(mailer.sent, mail)
+	return nil
+}
+
+// returns the mail sent so far, oldest first
+func (mailer *MemoryMailer) Sent() []Mail {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	sent := make([]Mail, len(mailer.sent))
+	copy(sent, mailer.sent)
+	return sent
+}
@@ -0,0 +1,365 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far the provider's clock can be off from ours when checking id token times
+const oidcClockSkew = time.Minute
+
+var (
+	ErrOIDCNotConfigured = errors.New("no OpenID Connect provider is configured")
+	ErrInvalidIdToken    = errors.New("id token is invalid")
+)
+
+type OIDCConfig struct {
+	// the provider's issuer url, its discovery document is read from
+	// <Issuer>/.well-known/openid-configuration
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// where the provider sends the user back to, it has to be registered
+	// with the provider and point at /api/user/oidc/callback
+	RedirectUrl string
+	// openid is always requested
+	Scopes []string
+}
+
+// the parts of the discovery document the login flow needs
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// the claims of a validated id token
+type IdTokenClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+// talks to an OpenID Connect provider. the discovery document and signing
+// keys are fetched the first time they are needed and cached after that
+type OIDCProvider struct {
+	Config     OIDCConfig
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		Config:     config,
+		HTTPClient: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+func (provider *OIDCProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := provider.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", endpoint, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (provider *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(provider.Config.Issuer, "/")
+	var discovery oidcDiscovery
+	err := provider.getJSON(ctx, issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %v, wanted %v", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, errors.New("discovery document is missing an endpoint")
+	}
+
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+// returns the key the provider signs with under the key id. the keys are
+// fetched again when the id isn't known in case the provider rotated them
+func (provider *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	discovery, err := provider.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = provider.getJSON(ctx, discovery.JwksUri, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	provider.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("provider has no signing key %q", kid)
+	}
+	return key, nil
+}
+
+// the S256 PKCE challenge for the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// the url the user is sent to so they can log in at the provider
+func (provider *OIDCProvider) authCodeUrl(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	discovery, err := provider.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := []string{"openid"}
+	for _, scope := range provider.Config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.Config.ClientId)
+	query.Set("redirect_uri", provider.Config.RedirectUrl)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// trades the authorization code for tokens and returns the id token's claims
+// once it has been validated
+func (provider *OIDCProvider) exchange(ctx context.Context, code string, verifier string, nonce string) (IdTokenClaims, error) {
+	discovery, err := provider.discover(ctx)
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.Config.RedirectUrl)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", provider.Config.ClientId)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.Config.ClientId), url.QueryEscape(provider.Config.ClientSecret))
+	}
+
+	res, err := provider.HTTPClient.Do(req)
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return IdTokenClaims{}, fmt.Errorf("token endpoint returned %v: %s", res.Status, body)
+	}
+
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+	if tokens.IdToken == "" {
+		return IdTokenClaims{}, errors.New("token response has no id token")
+	}
+
+	return provider.verifyIdToken(ctx, tokens.IdToken, nonce, time.Now())
+}
+
+// checks the id token's RS256 signature, issuer, audience, expiry and nonce
+func (provider *OIDCProvider) verifyIdToken(ctx context.Context, idToken string, nonce string, now time.Time) (IdTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+	if header.Alg != "RS256" {
+		return IdTokenClaims{}, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIdToken, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+	key, err := provider.key(ctx, header.Kid)
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return IdTokenClaims{}, fmt.Errorf("%w: bad signature", ErrInvalidIdToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+	var claims IdTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+	// the claims that can have more than one type or are only needed here
+	var registered struct {
+		Audience  json.RawMessage `json:"aud"`
+		Azp       string          `json:"azp"`
+		Expires   int64           `json:"exp"`
+		IssuedAt  int64           `json:"iat"`
+		NotBefore int64           `json:"nbf"`
+	}
+	err = json.Unmarshal(payload, &registered)
+	if err != nil {
+		return IdTokenClaims{}, ErrInvalidIdToken
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(provider.Config.Issuer, "/") {
+		return IdTokenClaims{}, fmt.Errorf("%w: wrong issuer %q", ErrInvalidIdToken, claims.Issuer)
+	}
+
+	var audience []string
+	if json.Unmarshal(registered.Audience, &audience) != nil {
+		var single string
+		if json.Unmarshal(registered.Audience, &single) != nil {
+			return IdTokenClaims{}, ErrInvalidIdToken
+		}
+		audience = []string{single}
+	}
+	found := false
+	for _, aud := range audience {
+		if aud == provider.Config.ClientId {
+			found = true
+		}
+	}
+	if !found || (len(audience) > 1 && registered.Azp != provider.Config.ClientId) {
+		return IdTokenClaims{}, fmt.Errorf("%w: not issued for this client", ErrInvalidIdToken)
+	}
+
+	if registered.Expires == 0 || now.After(time.Unix(registered.Expires, 0).Add(oidcClockSkew)) {
+		return IdTokenClaims{}, fmt.Errorf("%w: expired", ErrInvalidIdToken)
+	}
+	if registered.NotBefore != 0 && now.Add(oidcClockSkew).Before(time.Unix(registered.NotBefore, 0)) {
+		return IdTokenClaims{}, fmt.Errorf("%w: not valid yet", ErrInvalidIdToken)
+	}
+	if registered.IssuedAt != 0 && now.Add(oidcClockSkew).Before(time.Unix(registered.IssuedAt, 0)) {
+		return IdTokenClaims{}, fmt.Errorf("%w: issued in the future", ErrInvalidIdToken)
+	}
+	if claims.Nonce != nonce {
+		return IdTokenClaims{}, fmt.Errorf("%w: wrong nonce", ErrInvalidIdToken)
+	}
+	if claims.Subject == "" {
+		return IdTokenClaims{}, fmt.Errorf("%w: no subject", ErrInvalidIdToken)
+	}
+
+	return claims, nil
+}
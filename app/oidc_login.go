@@ -0,0 +1,424 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// how long the user has to log in at the provider before they have to start over
+const oidcLoginExpiry = time.Minute * 10
+
+// holds the state of a login started by this browser so the callback can
+// check the provider is answering a request it made
+const oidcStateCookie = "oidc-state"
+
+var (
+	ErrInvalidOIDCState = errors.New("OpenID Connect login state is invalid or expired")
+	// a local account already uses the email but the provider hasn't verified
+	// it, so linking it could let someone take over the account
+	ErrOIDCEmailTaken = errors.New("email belongs to an account that can't be linked")
+	ErrOIDCNoEmail    = errors.New("identity provider did not share an email")
+)
+
+// stores what the callback needs to finish the login and returns
+// the state sent to the provider
+func (app App) startOIDCLogin(ctx context.Context, nonce string, verifier string) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO OIDCLogins (state_hash, nonce, verifier, expires) VALUES ($1, $2, $3, $4)`,
+		hashToken(state),
+		nonce,
+		verifier,
+		time.Now().Add(oidcLoginExpiry),
+	)
+	if err != nil {
+		Sugar.Error("error inserting oidc login: ", err)
+		return "", err
+	}
+
+	return state, nil
+}
+
+// returns the nonce and PKCE verifier for the state. each state can only be used once
+func (app App) finishOIDCLogin(ctx context.Context, state string) (string, string, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`DELETE FROM OIDCLogins WHERE state_hash=$1 AND expires > now() RETURNING nonce, verifier`,
+		hashToken(state),
+	)
+
+	var nonce string
+	var verifier string
+	err := row.Scan(&nonce, &verifier)
+	if err == sql.ErrNoRows {
+		return "", "", ErrInvalidOIDCState
+	} else if err != nil {
+		Sugar.Error("error getting oidc login: ", err)
+		return "", "", err
+	}
+	return nonce, verifier, nil
+}
+
+// turns whatever the provider calls the user into a valid local username
+func oidcUsername(claims IdTokenClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name = strings.Split(claims.Email, "@")[0]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.') {
+			return r
+		}
+		return -1
+	}, name)
+	if len(name) > 25 {
+		name = name[:25]
+	}
+	for len(name) < 3 {
+		name += "_"
+	}
+	return name
+}
+
+// finds a username no one has taken yet by adding a number to the end
+func (app App) availableUsername(ctx context.Context, name string) (string, error) {
+	candidate := name
+	for i := 2; i < 100; i++ {
+		_, usernameExists := app.checkUserExists(ctx, "", candidate)
+		if !usernameExists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+	return "", fmt.Errorf("no username available for %v", name)
+}
+
+// returns the local user for the provider's user, linking an existing
+// account with the same verified email or creating a new one. both sides have
+// to have verified the email, otherwise whoever signed up with an address
+// they don't own would keep their password on the owner's account
+func (app App) linkOIDCUser(ctx context.Context, claims IdTokenClaims) (string, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT username FROM UserIdentities WHERE issuer=$1 AND subject=$2`,
+		claims.Issuer,
+		claims.Subject,
+	)
+	var username string
+	err := row.Scan(&username)
+	if err == nil {
+		return username, nil
+	} else if err != sql.ErrNoRows {
+		Sugar.Error("error getting user identity: ", err)
+		return "", err
+	}
+
+	if claims.Email == "" {
+		return "", ErrOIDCNoEmail
+	}
+
+	row = app.Pg.QueryRowContext(ctx, `SELECT username, verified FROM Users WHERE email=$1`, claims.Email)
+	var verified bool
+	err = row.Scan(&username, &verified)
+	if err == nil {
+		if !claims.EmailVerified || !verified {
+			return "", ErrOIDCEmailTaken
+		}
+		return username, app.addIdentity(ctx, app.Pg, claims, username)
+	} else if err != sql.ErrNoRows {
+		Sugar.Error("error getting user by email: ", err)
+		return "", err
+	}
+
+	return app.createOIDCUser(ctx, claims)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (app App) addIdentity(ctx context.Context, db execer, claims IdTokenClaims, username string) error {
+	_, err := db.ExecContext(
+		ctx,
+		`INSERT INTO UserIdentities (issuer, subject, username, email) VALUES ($1, $2, $3, $4)`,
+		claims.Issuer,
+		claims.Subject,
+		username,
+		claims.Email,
+	)
+	if err != nil {
+		Sugar.Error("error inserting user identity: ", err)
+	}
+	return err
+}
+
+// creates a user that logs in through the provider. they get a random
+// password they can replace with a password reset
+func (app App) createOIDCUser(ctx context.Context, claims IdTokenClaims) (string, error) {
+	username, err := app.availableUsername(ctx, oidcUsername(claims))
+	if err != nil {
+		return "", err
+	}
+	password, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	hash, err := app.hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := app.Pg.BeginTx(ctx, nil)
+	if err != nil {
+		Sugar.Error("error starting transaction: ", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO Users (email, username, password, verified) VALUES ($1, $2, $3, $4)`,
+		claims.Email,
+		username,
+		hash,
+		claims.EmailVerified,
+	)
+	if err != nil {
+		Sugar.Error("error inserting new user: ", err)
+		return "", err
+	}
+	err = app.addIdentity(ctx, tx, claims, username)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		Sugar.Error("error committing new oidc user: ", err)
+		return "", err
+	}
+	app.addClient(username)
+
+	if !claims.EmailVerified {
+		// the user can ask for another email if this one doesn't arrive
+		app.sendVerification(ctx, username, claims.Email)
+	}
+
+	return username, nil
+}
+
+func (app App) renderLoginError(w http.ResponseWriter, status int, message string) error {
+	w.WriteHeader(status)
+	return app.Tmpl.ExecuteTemplate(w, "login.html", struct {
+		Email        string
+		ErrorMessage string
+	}{"", message})
+}
+
+// sends the user to the identity provider to log in
+func (app App) OIDCLogin(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "OIDCLogin")
+	defer span.End()
+
+	if app.OIDC == nil {
+		span.SetStatus(codes.Ok, "OIDC is not configured.")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "oidc_not_configured"})
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error generating nonce.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error generating PKCE verifier.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	state, err := app.startOIDCLogin(ctx, nonce, verifier)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error starting OIDC login.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	authUrl, err := app.OIDC.authCodeUrl(ctx, state, nonce, verifier)
+	if err != nil {
+		Sugar.Error("error building oidc authorization url: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error discovering OIDC provider.")
+		writeError(w, req, http.StatusBadGateway, ErrorResponse{})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/user/oidc",
+		MaxAge:   int(oidcLoginExpiry.Seconds()),
+		Secure:   app.Cookies.Secure,
+		HttpOnly: true,
+		// the cookie has to be sent when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	span.SetStatus(codes.Ok, "Redirecting to OIDC provider.")
+	http.Redirect(w, req, authUrl, http.StatusFound)
+}
+
+// the identity provider sends the user back here after they logged in
+func (app App) OIDCCallback(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "OIDCCallback")
+	defer span.End()
+
+	if app.OIDC == nil {
+		span.SetStatus(codes.Ok, "OIDC is not configured.")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "oidc_not_configured"})
+		return
+	}
+
+	query := req.URL.Query()
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/user/oidc", MaxAge: -1})
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		span.SetStatus(codes.Ok, "OIDC provider returned an error: "+providerErr)
+		err := app.renderLoginError(w, http.StatusUnauthorized, "Login with your identity provider was cancelled")
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		span.SetStatus(codes.Ok, "OIDC state did not match.")
+		err = app.renderLoginError(w, http.StatusBadRequest, "Login expired, try again")
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	}
+
+	nonce, verifier, err := app.finishOIDCLogin(ctx, state)
+	if err == ErrInvalidOIDCState {
+		span.SetStatus(codes.Ok, "OIDC state is invalid.")
+		err = app.renderLoginError(w, http.StatusBadRequest, "Login expired, try again")
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error finishing OIDC login.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	claims, err := app.OIDC.exchange(ctx, query.Get("code"), verifier, nonce)
+	if err != nil {
+		Sugar.Error("error exchanging oidc code: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error exchanging OIDC code.")
+		err = app.renderLoginError(w, http.StatusBadGateway, "Could not log in with your identity provider")
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+		}
+		return
+	}
+
+	username, err := app.linkOIDCUser(ctx, claims)
+	if err == ErrOIDCEmailTaken || err == ErrOIDCNoEmail {
+		span.SetStatus(codes.Ok, err.Error())
+		message := "An account with this email already exists, log in with your password"
+		if err == ErrOIDCNoEmail {
+			message = "Your identity provider did not share your email"
+		}
+		err = app.renderLoginError(w, http.StatusConflict, message)
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error linking OIDC user.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	twoFactor, err := app.twoFactorEnabled(ctx, username)
+	if err != nil {
+		span.RecordError(err)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error checking two factor.")
+		return
+	}
+	if twoFactor {
+		challenge, err := app.createLoginChallenge(ctx, username, app.clientIp(req))
+		var throttled *LoginThrottledError
+		if errors.As(err, &throttled) {
+			setRetryAfter(w, throttled.RetryAfter)
+			span.SetStatus(codes.Ok, "Too many failed logins.")
+			err = app.renderLoginError(w, http.StatusTooManyRequests, "Too many failed logins, try again later")
+			if err != nil {
+				Sugar.Error("error executing template: ", err)
+				span.RecordError(err)
+			}
+			return
+		} else if err != nil {
+			span.RecordError(err)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			span.SetStatus(codes.Error, "Error creating login challenge.")
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		span.SetStatus(codes.Ok, "Two factor code required.")
+		err = app.Tmpl.ExecuteTemplate(w, "login_2fa.html", struct {
+			Challenge    string
+			ErrorMessage string
+		}{challenge, ""})
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	}
+
+	err = app.startSession(w, req, username)
+	if err != nil {
+		span.RecordError(err)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error saving session to DB.")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Successfully logged in.")
+	http.Redirect(w, req, "/chat", http.StatusSeeOther)
+}
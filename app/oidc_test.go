@@ -0,0 +1,302 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a minimal OpenID Connect provider that logs in whoever is set as its user
+// without asking
+type mockOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientId string
+
+	mu       sync.Mutex
+	user     IdTokenClaims
+	requests map[string]url.Values
+}
+
+func newMockOIDCProvider(t *testing.T, clientId string) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err generating rsa key: %v", err)
+	}
+	mock := &mockOIDCProvider{
+		key:      key,
+		clientId: clientId,
+		requests: make(map[string]url.Values),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mock.server.URL,
+			"authorization_endpoint": mock.server.URL + "/authorize",
+			"token_endpoint":         mock.server.URL + "/token",
+			"jwks_uri":               mock.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jsonWebKey{{
+				Kty: "RSA",
+				Kid: "test-key",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("client_id") != clientId || query.Get("code_challenge_method") != "S256" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken()
+		mock.mu.Lock()
+		mock.requests[code] = query
+		mock.mu.Unlock()
+
+		redirect := url.Values{}
+		redirect.Set("code", code)
+		redirect.Set("state", query.Get("state"))
+		http.Redirect(w, req, query.Get("redirect_uri")+"?"+redirect.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		mock.mu.Lock()
+		query, ok := mock.requests[req.PostForm.Get("code")]
+		delete(mock.requests, req.PostForm.Get("code"))
+		user := mock.user
+		mock.mu.Unlock()
+
+		if !ok ||
+			req.PostForm.Get("redirect_uri") != query.Get("redirect_uri") ||
+			pkceChallenge(req.PostForm.Get("code_verifier")) != query.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		user.Nonce = query.Get("nonce")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     mock.idToken(t, user, clientId, time.Now()),
+		})
+	})
+	mock.server = httptest.NewServer(mux)
+
+	return mock
+}
+
+func (mock *mockOIDCProvider) idToken(t *testing.T, user IdTokenClaims, audience string, issued time.Time) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss":                mock.server.URL,
+		"sub":                user.Subject,
+		"aud":                audience,
+		"exp":                issued.Add(time.Minute * 5).Unix(),
+		"iat":                issued.Unix(),
+		"nonce":              user.Nonce,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified,
+		"preferred_username": user.PreferredUsername,
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, mock.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("err signing id token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (mock *mockOIDCProvider) setUser(user IdTokenClaims) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.user = user
+}
+
+func oidcServerSetup(t *testing.T) (*httptest.Server, *mockOIDCProvider) {
+	mock := newMockOIDCProvider(t, "chat-app")
+
+	application = newTestApplication()
+	application.OIDC = NewOIDCProvider(OIDCConfig{
+		Issuer:   mock.server.URL,
+		ClientId: "chat-app",
+		Scopes:   []string{"openid", "email", "profile"},
+	})
+	server := httptest.NewUnstartedServer(application.Routes())
+	application.OIDC.Config.RedirectUrl = "http://" + server.Listener.Addr().String() + "/api/user/oidc/callback"
+	server.Start()
+
+	return server, mock
+}
+
+// logs in through the mock provider with a new browser and returns
+// the path the login ended on
+func oidcLogin(t *testing.T, server *httptest.Server) (*http.Client, string) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client := &http.Client{Transport: csrfTransport{http.DefaultTransport}, Jar: jar}
+
+	res, err := client.Get(server.URL + "/api/user/oidc/login")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res.Body.Close()
+	return client, res.Request.URL.Path
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	server, mock := oidcServerSetup(t)
+	t.Cleanup(func() {
+		server.Close()
+		mock.server.Close()
+		databaseReset()
+	})
+
+	mock.setUser(IdTokenClaims{
+		Subject:           "1234",
+		Email:             "alice@example.com",
+		EmailVerified:     true,
+		PreferredUsername: "alice smith",
+	})
+
+	client, path := oidcLogin(t, server)
+	if path != "/chat" {
+		t.Fatalf("OIDC login ended at %v, wanted /chat", path)
+	}
+
+	var username string
+	var verified bool
+	row := application.Pg.QueryRow(`SELECT username, verified FROM Users WHERE email=$1`, "alice@example.com")
+	err := row.Scan(&username, &verified)
+	if err != nil {
+		t.Fatalf("User was not created: %v", err)
+	}
+	if username != "alicesmith" || !verified {
+		t.Errorf("Created user %v (verified %v), wanted verified alicesmith", username, verified)
+	}
+
+	res, err := client.Get(server.URL + "/api/user/sessions")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("OIDC login did not start a session. Received status code %v, wanted %v", res.StatusCode, http.StatusOK)
+	}
+
+	// logging in again finds the same user
+	_, path = oidcLogin(t, server)
+	if path != "/chat" {
+		t.Fatalf("Second OIDC login ended at %v, wanted /chat", path)
+	}
+	var count int
+	row = application.Pg.QueryRow(`SELECT count(*) FROM Users`)
+	err = row.Scan(&count)
+	if err != nil || count != 1 {
+		t.Errorf("Expected one user after logging in twice, got %v (%v)", count, err)
+	}
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	server, mock := oidcServerSetup(t)
+	t.Cleanup(func() {
+		server.Close()
+		mock.server.Close()
+		databaseReset()
+	})
+
+	form := url.Values{}
+	form.Set("username", "artemis")
+	form.Set("email", "kup@gmail.com")
+	form.Set("password", "secretpassy")
+	form.Set("confirmPassword", "secretpassy")
+	client := &http.Client{Transport: csrfTransport{http.DefaultTransport}}
+	_, err := client.PostForm(server.URL+"/api/user/signup", form)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// the provider not vouching for the email isn't enough to take over the account
+	mock.setUser(IdTokenClaims{Subject: "5678", Email: "kup@gmail.com", EmailVerified: false})
+	_, path := oidcLogin(t, server)
+	if path == "/chat" {
+		t.Fatalf("Unverified email was linked to an existing account")
+	}
+
+	// nor is the provider vouching for it before the local account has
+	mock.setUser(IdTokenClaims{Subject: "5678", Email: "kup@gmail.com", EmailVerified: true})
+	_, path = oidcLogin(t, server)
+	if path == "/chat" {
+		t.Fatalf("Email was linked to an existing account that hasn't verified it")
+	}
+
+	err = verifyEmail(server.URL, client, "kup@gmail.com")
+	if err != nil {
+		t.Fatalf("err verifying email: %v", err)
+	}
+	_, path = oidcLogin(t, server)
+	if path != "/chat" {
+		t.Fatalf("OIDC login ended at %v, wanted /chat", path)
+	}
+
+	var username string
+	row := application.Pg.QueryRow(`SELECT username FROM UserIdentities WHERE subject=$1`, "5678")
+	err = row.Scan(&username)
+	if err != nil || username != "artemis" {
+		t.Errorf("Identity was linked to %v (%v), wanted artemis", username, err)
+	}
+}
+
+func TestVerifyIdToken(t *testing.T) {
+	mock := newMockOIDCProvider(t, "chat-app")
+	t.Cleanup(mock.server.Close)
+	provider := NewOIDCProvider(OIDCConfig{Issuer: mock.server.URL, ClientId: "chat-app"})
+
+	user := IdTokenClaims{Subject: "1234", Nonce: "nonce"}
+	now := time.Now()
+
+	_, err := provider.verifyIdToken(context.Background(), mock.idToken(t, user, "chat-app", now), "nonce", now)
+	if err != nil {
+		t.Fatalf("Valid id token was rejected: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		now   time.Time
+	}{
+		{"wrong audience", mock.idToken(t, user, "other-app", now), "nonce", now},
+		{"wrong nonce", mock.idToken(t, user, "chat-app", now), "other", now},
+		{"expired", mock.idToken(t, user, "chat-app", now.Add(-time.Hour)), "nonce", now},
+		{"tampered", mock.idToken(t, user, "chat-app", now) + "x", "nonce", now},
+	}
+	for _, test := range tests {
+		_, err = provider.verifyIdToken(context.Background(), test.token, test.nonce, test.now)
+		if err == nil {
+			t.Errorf("%v id token was accepted", test.name)
+		}
+	}
+}
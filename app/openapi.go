@@ -0,0 +1,617 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"gopkg.in/yaml.v2"
+)
+
+// the parts of an OpenAPI 3 document needed to check requests and
+// responses against it. anything else in api.yaml is ignored
+type OpenAPI struct {
+	Servers []struct {
+		Url string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      map[string]map[string]*Operation `yaml:"paths"`
+	Components struct {
+		Schemas   map[string]*Schema   `yaml:"schemas"`
+		Responses map[string]*Response `yaml:"responses"`
+	} `yaml:"components"`
+
+	basePath string
+	routes   []specRoute
+}
+
+type Operation struct {
+	Parameters  []Parameter          `yaml:"parameters"`
+	RequestBody *RequestBody         `yaml:"requestBody"`
+	Responses   map[string]*Response `yaml:"responses"`
+}
+
+type Parameter struct {
+	Name     string  `yaml:"name"`
+	In       string  `yaml:"in"`
+	Required bool    `yaml:"required"`
+	Schema   *Schema `yaml:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `yaml:"required"`
+	Content  map[string]MediaType `yaml:"content"`
+}
+
+type Response struct {
+	Ref         string               `yaml:"$ref"`
+	Description string               `yaml:"description"`
+	Content     map[string]MediaType `yaml:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `yaml:"schema"`
+}
+
+type Schema struct {
+	Ref        string             `yaml:"$ref"`
+	Type       string             `yaml:"type"`
+	Format     string             `yaml:"format"`
+	Required   []string           `yaml:"required"`
+	Properties map[string]*Schema `yaml:"properties"`
+	Items      *Schema            `yaml:"items"`
+	Enum       []interface{}      `yaml:"enum"`
+	MinLength  *int               `yaml:"minLength"`
+	MaxLength  *int               `yaml:"maxLength"`
+	Minimum    *float64           `yaml:"minimum"`
+	Maximum    *float64           `yaml:"maximum"`
+}
+
+type specRoute struct {
+	method    string
+	segments  []string
+	operation *Operation
+}
+
+func LoadOpenAPI(path string) (*OpenAPI, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseOpenAPI(data)
+}
+
+func ParseOpenAPI(data []byte) (*OpenAPI, error) {
+	spec := new(OpenAPI)
+	err := yaml.Unmarshal(data, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// paths are relative to the server, like /room/create for /api/room/create
+	if len(spec.Servers) > 0 {
+		serverUrl, err := url.Parse(spec.Servers[0].Url)
+		if err != nil {
+			return nil, fmt.Errorf("server url %q: %w", spec.Servers[0].Url, err)
+		}
+		spec.basePath = strings.TrimSuffix(serverUrl.Path, "/")
+	}
+
+	for path, operations := range spec.Paths {
+		for method, operation := range operations {
+			spec.routes = append(spec.routes, specRoute{
+				method:    strings.ToUpper(method),
+				segments:  strings.Split(strings.Trim(path, "/"), "/"),
+				operation: operation,
+			})
+		}
+	}
+
+	return spec, nil
+}
+
+func (spec *OpenAPI) schema(schema *Schema) (*Schema, error) {
+	for schema != nil && schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		ref, ok := spec.Components.Schemas[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown schema %v", schema.Ref)
+		}
+		schema = ref
+	}
+	return schema, nil
+}
+
+func (spec *OpenAPI) response(response *Response) (*Response, error) {
+	for response != nil && response.Ref != "" {
+		name := strings.TrimPrefix(response.Ref, "#/components/responses/")
+		ref, ok := spec.Components.Responses[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown response %v", response.Ref)
+		}
+		response = ref
+	}
+	return response, nil
+}
+
+// finds the operation for the request along with the values of its path
+// parameters. requests outside the document aren't checked
+func (spec *OpenAPI) find(method string, path string) (*Operation, map[string]string, bool) {
+	if !strings.HasPrefix(path, spec.basePath+"/") {
+		return nil, nil, false
+	}
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(path, spec.basePath), "/"), "/")
+
+	for _, route := range spec.routes {
+		if route.method != method || len(route.segments) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		matched := true
+		for i, segment := range route.segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				params[segment[1:len(segment)-1]] = segments[i]
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route.operation, params, true
+		}
+	}
+	return nil, nil, false
+}
+
+// the request couldn't be read as the media type it said it was
+type malformedBodyError struct {
+	code string
+	err  error
+}
+
+func (err *malformedBodyError) Error() string {
+	return err.err.Error()
+}
+
+// checks the request's parameters and body against the operation. the body
+// is put back so the handler can still read it
+func (spec *OpenAPI) validateRequest(req *http.Request, operation *Operation, pathParams map[string]string) ([]FieldError, error) {
+	fieldErrors := []FieldError{}
+
+	for _, param := range operation.Parameters {
+		var value string
+		var present bool
+		switch param.In {
+		case "path":
+			value, present = pathParams[param.Name]
+		case "query":
+			values, ok := req.URL.Query()[param.Name]
+			if ok && len(values) > 0 {
+				value, present = values[0], true
+			}
+		case "header":
+			value = req.Header.Get(param.Name)
+			present = value != ""
+		default:
+			continue
+		}
+		if !present || value == "" {
+			if param.Required {
+				fieldErrors = append(fieldErrors, FieldError{Field: param.Name, Code: "required"})
+			}
+			continue
+		}
+		schema, err := spec.schema(param.Schema)
+		if err != nil {
+			return nil, err
+		}
+		spec.validateString(schema, param.Name, value, &fieldErrors)
+	}
+
+	if operation.RequestBody == nil {
+		return fieldErrors, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	content, ok := operation.RequestBody.Content[mediaType]
+	if !ok {
+		// the handler decides what to do with media types the document
+		// doesn't describe, like multipart forms sent by the web client
+		return fieldErrors, nil
+	}
+	schema, err := spec.schema(content.Schema)
+	if err != nil || schema == nil {
+		return fieldErrors, err
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		err = req.ParseForm()
+		if err != nil {
+			return nil, &malformedBodyError{"invalid_form", err}
+		}
+		for _, name := range schema.Required {
+			if req.PostForm.Get(name) == "" {
+				fieldErrors = append(fieldErrors, FieldError{Field: name, Code: "required"})
+			}
+		}
+		for name, property := range schema.Properties {
+			if value := req.PostForm.Get(name); value != "" {
+				property, err = spec.schema(property)
+				if err != nil {
+					return nil, err
+				}
+				spec.validateString(property, name, value, &fieldErrors)
+			}
+		}
+	case "application/json":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, &malformedBodyError{"malformed_json", err}
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if len(bytes.TrimSpace(body)) == 0 {
+			if operation.RequestBody.Required {
+				fieldErrors = append(fieldErrors, FieldError{Field: "body", Code: "required"})
+			}
+			return fieldErrors, nil
+		}
+
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, &malformedBodyError{"malformed_json", err}
+		}
+		err = spec.validateValue(schema, "", value, &fieldErrors)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fieldErrors, nil
+}
+
+// form fields and parameters are strings, so they're converted to the
+// type the schema wants before being checked
+func (spec *OpenAPI) validateString(schema *Schema, name string, raw string, fieldErrors *[]FieldError) {
+	if schema == nil {
+		return
+	}
+	var value interface{} = raw
+	switch schema.Type {
+	case "integer", "number":
+		number := json.Number(raw)
+		if _, err := number.Float64(); err != nil {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "type", Param: schema.Type})
+			return
+		}
+		value = number
+	case "boolean":
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "type", Param: schema.Type})
+			return
+		}
+		value = parsed
+	}
+	spec.validateValue(schema, name, value, fieldErrors)
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+
+// checks a decoded json value against the schema. nested fields are named
+// like parent.child
+func (spec *OpenAPI) validateValue(schema *Schema, name string, value interface{}, fieldErrors *[]FieldError) error {
+	schema, err := spec.schema(schema)
+	if err != nil || schema == nil {
+		return err
+	}
+
+	typeError := func() error {
+		*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "type", Param: schema.Type})
+		return nil
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return typeError()
+		}
+		for _, required := range schema.Required {
+			if field, ok := object[required]; !ok || field == nil {
+				*fieldErrors = append(*fieldErrors, FieldError{Field: joinField(name, required), Code: "required"})
+			}
+		}
+		for property, propertySchema := range schema.Properties {
+			if field, ok := object[property]; ok && field != nil {
+				err = spec.validateValue(propertySchema, joinField(name, property), field, fieldErrors)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return typeError()
+		}
+		for i, item := range items {
+			err = spec.validateValue(schema.Items, fmt.Sprintf("%v[%v]", name, i), item, fieldErrors)
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return typeError()
+		}
+		length := len([]rune(str))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "min", Param: strconv.Itoa(*schema.MinLength)})
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "max", Param: strconv.Itoa(*schema.MaxLength)})
+		}
+		if schema.Format == "email" && !emailPattern.MatchString(str) {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "email"})
+		}
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			return typeError()
+		}
+		float, err := number.Float64()
+		if err != nil {
+			return typeError()
+		}
+		if schema.Type == "integer" && float != float64(int64(float)) {
+			return typeError()
+		}
+		if schema.Minimum != nil && float < *schema.Minimum {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "min", Param: number.String()})
+		}
+		if schema.Maximum != nil && float > *schema.Maximum {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "max", Param: number.String()})
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return typeError()
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		allowed := make([]string, 0, len(schema.Enum))
+		found := false
+		for _, option := range schema.Enum {
+			allowed = append(allowed, fmt.Sprint(option))
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			*fieldErrors = append(*fieldErrors, FieldError{Field: name, Code: "oneof", Param: strings.Join(allowed, " ")})
+		}
+	}
+
+	return nil
+}
+
+func joinField(parent string, field string) string {
+	if parent == "" {
+		return field
+	}
+	return parent + "." + field
+}
+
+// event streams never finish and websockets take over the connection, so
+// their responses can't be held back and checked
+func (spec *OpenAPI) streams(operation *Operation) bool {
+	if _, ok := operation.Responses["101"]; ok {
+		return true
+	}
+	for _, response := range operation.Responses {
+		response, err := spec.response(response)
+		if err != nil {
+			continue
+		}
+		if _, ok := response.Content["text/event-stream"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that the status is documented for the operation and that json
+// bodies match the documented schema
+func (spec *OpenAPI) validateResponse(operation *Operation, status int, header http.Header, body []byte) error {
+	response, ok := operation.Responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = operation.Responses[fmt.Sprintf("%vXX", status/100)]
+	}
+	if !ok {
+		response, ok = operation.Responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("status %v is not documented", status)
+	}
+	response, err := spec.response(response)
+	if err != nil {
+		return err
+	}
+
+	if len(response.Content) == 0 || len(body) == 0 {
+		return nil
+	}
+	// net/http sniffs the type of bodies written without one, like
+	// rendered templates, so the recorder has to as well
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	content, ok := response.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("status %v is documented without content type %q", status, mediaType)
+	}
+	if content.Schema == nil || !strings.HasSuffix(mediaType, "json") {
+		return nil
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	if err != nil {
+		return fmt.Errorf("status %v body is not json: %w", status, err)
+	}
+	fieldErrors := []FieldError{}
+	err = spec.validateValue(content.Schema, "", value, &fieldErrors)
+	if err != nil {
+		return err
+	}
+	if len(fieldErrors) > 0 {
+		return fmt.Errorf("status %v body does not match its schema: %+v", status, fieldErrors)
+	}
+	return nil
+}
+
+// holds on to a response so it can be checked before being sent
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (recorder *responseRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.body.Write(data)
+}
+
+func (recorder *responseRecorder) flush(w http.ResponseWriter) {
+	for key, values := range recorder.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(recorder.status)
+	w.Write(recorder.body.Bytes())
+}
+
+// finds the operation for the request, trying the escaped path too since
+// room names can have slashes in them
+func (spec *OpenAPI) findRequest(req *http.Request) (*Operation, map[string]string, bool) {
+	operation, pathParams, ok := spec.find(req.Method, req.URL.Path)
+	if ok || req.URL.RawPath == "" {
+		return operation, pathParams, ok
+	}
+	operation, pathParams, ok = spec.find(req.Method, req.URL.RawPath)
+	for name, value := range pathParams {
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			pathParams[name] = unescaped
+		}
+	}
+	return operation, pathParams, ok
+}
+
+// whether the router has a handler for the request, matching the path the
+// way chi does
+func routed(req *http.Request) bool {
+	routeContext := chi.RouteContext(req.Context())
+	if routeContext == nil || routeContext.Routes == nil {
+		return false
+	}
+	path := req.URL.Path
+	if req.URL.RawPath != "" {
+		path = req.URL.RawPath
+	}
+	return routeContext.Routes.Match(chi.NewRouteContext(), req.Method, path)
+}
+
+// rejects requests that don't match api.yaml with a 400 before they reach
+// the handler. with CheckResponses the handler's response is held back and
+// replaced with a 500 if it isn't documented, and so are requests to routes
+// the document is missing, which is how the tests catch the document
+// drifting from the code
+func (app App) ValidateRequests(next http.Handler) http.Handler {
+	if app.Spec == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		operation, pathParams, ok := app.Spec.findRequest(req)
+		if !ok && app.CheckResponses && routed(req) {
+			Sugar.Errorf("%v %v is not documented in api.yaml", req.Method, req.URL.Path)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{
+				Code:   "undocumented_route",
+				Detail: req.Method + " " + req.URL.Path + " is not in api.yaml",
+			})
+			return
+		} else if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		fieldErrors, err := app.Spec.validateRequest(req, operation, pathParams)
+		if malformed, ok := err.(*malformedBodyError); ok {
+			writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: malformed.code, Detail: malformed.Error()})
+			return
+		} else if err != nil {
+			Sugar.Error("error validating request against api.yaml: ", err)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
+		}
+		if len(fieldErrors) > 0 {
+			sort.Slice(fieldErrors, func(i, j int) bool {
+				return fieldErrors[i].Field < fieldErrors[j].Field
+			})
+			writeError(w, req, http.StatusBadRequest, ErrorResponse{
+				Code:   "validation_failed",
+				Fields: fieldErrors,
+			})
+			return
+		}
+
+		if !app.CheckResponses || app.Spec.streams(operation) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		recorder := &responseRecorder{header: http.Header{}}
+		next.ServeHTTP(recorder, req)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		err = app.Spec.validateResponse(operation, recorder.status, recorder.header, recorder.body.Bytes())
+		if err != nil {
+			Sugar.Errorf("%v %v response does not match api.yaml: %v", req.Method, req.URL.Path, err)
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{
+				Code:   "response_mismatch",
+				Detail: err.Error(),
+			})
+			return
+		}
+		recorder.flush(w)
+	})
+}
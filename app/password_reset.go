@@ -0,0 +1,308 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// how long a password reset link can be used for
+const passwordResetExpiry = time.Hour
+
+// requests for reset emails are counted like failed logins, so an address
+// can't be flooded with them. once there are this many within the login
+// throttle's window, more are refused until the lockout is over
+const (
+	throttleResetEmail      = "reset_email"
+	throttleResetIp         = "reset_ip"
+	passwordResetEmailLimit = 3
+	passwordResetIpLimit    = 20
+)
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrInvalidResetToken = errors.New("password reset token is invalid, expired or already used")
+)
+
+type ForgotPassword struct {
+	Email string `form:"email" json:"email" validate:"required,email,max=50"`
+}
+
+type ResetPassword struct {
+	Token           string `form:"token" json:"token" validate:"required"`
+	Password        string `form:"password" json:"password" validate:"required,eqfield=ConfirmPassword,min=8,max=50"`
+	ConfirmPassword string `form:"confirmPassword" json:"confirmPassword" validate:"required,min=8,max=50"`
+}
+
+// creates a single use token that lets whoever holds it set a new password
+// for the user with the email
+func (app App) createPasswordReset(ctx context.Context, email string) (string, error) {
+	row := app.Pg.QueryRowContext(ctx, `SELECT username FROM Users WHERE email=$1`, email)
+	var username string
+	err := row.Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		Sugar.Error("err scanning row: ", err)
+		return "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		Sugar.Error("error generating password reset token: ", err)
+		return "", err
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO PasswordResets (username, token_hash, expires) VALUES ($1, $2, $3)`,
+		username,
+		hashToken(token),
+		time.Now().Add(passwordResetExpiry),
+	)
+	if err != nil {
+		Sugar.Error("error inserting password reset: ", err)
+		return "", err
+	}
+
+	return token, nil
+}
+
+// marks the token as used and returns the user it was created for. the
+// user's other reset links stop working too
+func (app App) usePasswordReset(ctx context.Context, token string) (string, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`UPDATE PasswordResets SET used = true
+		WHERE token_hash=$1 AND NOT used AND expires > now()
+		RETURNING username`,
+		hashToken(token),
+	)
+
+	var username string
+	err := row.Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidResetToken
+	} else if err != nil {
+		Sugar.Error("error using password reset: ", err)
+		return "", err
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`UPDATE PasswordResets SET used = true WHERE username=$1 AND NOT used`,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error using the user's other password resets: ", err)
+		return "", err
+	}
+
+	return username, nil
+}
+
+func (app App) setPassword(ctx context.Context, username string, password string) error {
+	hash, err := app.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`UPDATE Users SET password=$1 WHERE username=$2`,
+		hash,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error updating password: ", err)
+	}
+	return err
+}
+
+// emails a password reset link to the user. the email is sent in the
+// background and requests are throttled by email whether or not it belongs
+// to a user, so neither the response nor how long it takes can be used to
+// find out who has an account
+func (app App) ForgotPassword(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ForgotPassword")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("Error parsing form: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form ForgotPassword
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	ip := app.clientIp(req)
+	retryAfter, err := app.throttleLockout(ctx, throttleResetEmail, form.Email, throttleResetIp, ip)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking password reset lockout.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
+		span.SetStatus(codes.Ok, "Too many password resets.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_requests",
+			Detail: "Too many password resets were asked for, try again later",
+		})
+		return
+	}
+
+	_, _, err = app.countLoginFailure(ctx, throttleResetEmail, strings.ToLower(form.Email), passwordResetEmailLimit)
+	if err == nil {
+		_, _, err = app.countLoginFailure(ctx, throttleResetIp, ip, passwordResetIpLimit)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error counting password reset.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	app.Background.Go(func(ctx context.Context) {
+		app.sendPasswordReset(ctx, form.Email)
+	})
+
+	span.SetStatus(codes.Ok, "Password reset requested.")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// creates a reset link and emails it, if a user has the email
+func (app App) sendPasswordReset(ctx context.Context, email string) {
+	ctx, span := otel.Tracer("").Start(ctx, "SendPasswordReset")
+	defer span.End()
+
+	token, err := app.createPasswordReset(ctx, email)
+	if err == ErrUserNotFound {
+		span.SetStatus(codes.Ok, "No user with email.")
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error creating password reset.")
+		return
+	}
+
+	resetUrl := webUrl + "/api/user/password/reset?token=" + url.QueryEscape(token)
+	err = app.Mailer.Send(ctx, Mail{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for your account.\n\n"+
+				"Use this link within %v to choose a new password:\n%s\n\n"+
+				"If it wasn't you, you can ignore this email.\n",
+			passwordResetExpiry,
+			resetUrl,
+		),
+	})
+	if err != nil {
+		Sugar.Error("error sending password reset email: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error sending password reset email.")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Password reset sent.")
+}
+
+// shows the form for choosing a new password that the emailed link points to
+func (app App) ResetPasswordPage(w http.ResponseWriter, req *http.Request) {
+	err := app.Tmpl.ExecuteTemplate(w, "reset_password.html", struct {
+		Token string
+	}{req.URL.Query().Get("token")})
+	if err != nil {
+		Sugar.Error("error executing template: ", err)
+	}
+}
+
+// sets a new password using a token from a password reset email
+// every session of the user is revoked since one of them might belong
+// to whoever the password is being reset to keep out
+func (app App) ResetPassword(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ResetPassword")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("Error parsing form: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form ResetPassword
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	username, err := app.usePasswordReset(ctx, form.Token)
+	if err == ErrInvalidResetToken {
+		span.SetStatus(codes.Ok, "Invalid password reset token.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "invalid_token",
+			Detail: "This password reset link is invalid, expired or has already been used",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error using password reset.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	err = app.setPassword(ctx, username, form.Password)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error setting password.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	err = app.revokeOtherSessions(ctx, username, "")
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error revoking sessions.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Password was reset.")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordAlgorithm string
+
+const (
+	Bcrypt   PasswordAlgorithm = "bcrypt"
+	Argon2id PasswordAlgorithm = "argon2id"
+)
+
+var ErrUnknownPasswordHash = errors.New("password hash is in an unknown format")
+
+// how new password hashes are made. hashes made with other settings still
+// work and are replaced the next time their user logs in
+type PasswordConfig struct {
+	Algorithm  PasswordAlgorithm
+	BcryptCost int
+	// argon2id parameters, memory is in KiB
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+func DefaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{
+		Algorithm:  Bcrypt,
+		BcryptCost: bcrypt.DefaultCost,
+		// the parameters RFC 9106 suggests for memory constrained servers
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 4,
+	}
+}
+
+// checks the settings make hashes that are both valid and worth having
+func (config PasswordConfig) Validate() error {
+	switch config.Algorithm {
+	case Bcrypt:
+		if config.BcryptCost < bcrypt.DefaultCost || config.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.DefaultCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		if config.Argon2Time < 1 || config.Argon2Memory < 8*1024 || config.Argon2Threads < 1 {
+			return errors.New("argon2id needs at least 1 pass, 8MiB of memory and 1 thread")
+		}
+	default:
+		return fmt.Errorf("unknown password algorithm %q", config.Algorithm)
+	}
+	return nil
+}
+
+const argon2KeyLength = 32
+
+// a hash for each config of a password no one has. it's checked when there
+// is no user with the email, so logins take as long either way and can't be
+// timed to find out who has an account
+var dummyHashes sync.Map
+
+func (config PasswordConfig) dummyHash() (string, error) {
+	if hash, ok := dummyHashes.Load(config); ok {
+		return hash.(string), nil
+	}
+	password, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	hash, err := config.hash(password)
+	if err != nil {
+		return "", err
+	}
+	dummyHashes.Store(config, hash)
+	return hash, nil
+}
+
+func (config PasswordConfig) hash(password string) (string, error) {
+	if config.Algorithm == Argon2id {
+		salt := make([]byte, 16)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, config.Argon2Time, config.Argon2Memory, config.Argon2Threads, argon2KeyLength)
+		// the PHC string format other argon2 libraries read
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version,
+			config.Argon2Memory,
+			config.Argon2Time,
+			config.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), config.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// reports whether the password matches the hash and whether the hash
+// should be replaced because it was made with different settings
+func (config PasswordConfig) verify(hash string, password string) (bool, bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false, ErrUnknownPasswordHash
+		}
+		_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+		if err != nil || version != argon2.Version {
+			return false, false, ErrUnknownPasswordHash
+		}
+		_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+		if err != nil {
+			return false, false, ErrUnknownPasswordHash
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false, ErrUnknownPasswordHash
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false, ErrUnknownPasswordHash
+		}
+
+		computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false, nil
+		}
+		outdated := config.Algorithm != Argon2id ||
+			memory != config.Argon2Memory || time != config.Argon2Time || threads != config.Argon2Threads
+		return true, outdated, nil
+	}
+
+	// accounts being deleted have no password
+	if hash == "" {
+		return false, false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, err
+	}
+	return true, config.Algorithm != Bcrypt || cost != config.BcryptCost, nil
+}
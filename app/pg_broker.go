@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+)
+
+// the channel nodes notify each other on
+const pgBrokerChannel = "chat_events"
+
+// postgres refuses notifications with payloads this long or longer
+const maxNotifyPayload = 8000
+
+var ErrEventTooLarge = errors.New("event is too large to publish")
+
+// a broker for several nodes sharing a postgres database, using LISTEN and
+// NOTIFY. events published while a node is reconnecting are lost to it
+type PgBroker struct {
+	db     *sql.DB
+	config pgx.ConnConfig
+}
+
+func NewPgBroker(config PgConfig) *PgBroker {
+	connConfig := config.connConfig()
+	return &PgBroker{
+		db:     stdlib.OpenDB(connConfig),
+		config: connConfig,
+	}
+}
+
+func (broker *PgBroker) Publish(ctx context.Context, event BrokerEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(data) >= maxNotifyPayload {
+		return ErrEventTooLarge
+	}
+
+	_, err = broker.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, pgBrokerChannel, string(data))
+	return err
+}
+
+func (broker *PgBroker) Subscribe(ctx context.Context, receive func(BrokerEvent)) error {
+	conn, err := broker.listen()
+	if err != nil {
+		return err
+	}
+	go broker.receive(ctx, conn, receive)
+	return nil
+}
+
+// a connection of its own that is listening on the channel, since pooled
+// connections can't wait for notifications
+func (broker *PgBroker) listen() (*pgx.Conn, error) {
+	conn, err := pgx.Connect(broker.config)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Listen(pgBrokerChannel)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// passes notifications on one at a time until ctx is done, listening again
+// whenever the connection is lost
+func (broker *PgBroker) receive(ctx context.Context, conn *pgx.Conn, receive func(BrokerEvent)) {
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			Sugar.Error("lost the postgres broker connection: ", err)
+			conn, err = broker.relisten(ctx)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		var event BrokerEvent
+		err = json.Unmarshal([]byte(notification.Payload), &event)
+		if err != nil {
+			Sugar.Error("error decoding broker event: ", err)
+			continue
+		}
+		receive(event)
+	}
+}
+
+// tries to listen again, waiting twice as long after each failure up to a
+// minute, until it works or ctx is done
+func (broker *PgBroker) relisten(ctx context.Context) (*pgx.Conn, error) {
+	wait := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		conn, err := broker.listen()
+		if err == nil {
+			return conn, nil
+		}
+		Sugar.Error("error listening for broker events: ", err)
+		if wait < time.Minute {
+			wait *= 2
+		}
+	}
+}
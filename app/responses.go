@@ -0,0 +1,130 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-playground/validator"
+)
+
+// describes why a single field of a request was rejected
+type FieldError struct {
+	Field string `json:"field"`
+	// the validation rule that failed, like required, email or min
+	Code  string `json:"code"`
+	Param string `json:"param,omitempty"`
+}
+
+// an application/problem+json body (RFC 7807). Code is what clients should
+// check, Detail is meant for people and RequestId finds the request in the logs
+type ErrorResponse struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// machine-readable, like validation_failed or invite_expired
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestId string       `json:"request_id,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) error {
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(bytes)
+	return err
+}
+
+// the code used when a handler doesn't give a more specific one,
+// like not_found for 404
+func statusCode(status int) string {
+	if status == http.StatusInternalServerError {
+		return "internal_error"
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// responds with the error as problem json, filling in everything but the
+// code, detail and fields from the status and request
+func writeError(w http.ResponseWriter, req *http.Request, status int, problem ErrorResponse) error {
+	problem.Type = "about:blank"
+	problem.Title = http.StatusText(status)
+	problem.Status = status
+	if problem.Code == "" {
+		problem.Code = statusCode(status)
+	}
+	problem.RequestId = middleware.GetReqID(req.Context())
+
+	bytes, err := json.Marshal(problem)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	if problem.RequestId != "" {
+		w.Header().Set("X-Request-Id", problem.RequestId)
+	}
+	w.WriteHeader(status)
+	_, err = w.Write(bytes)
+	return err
+}
+
+// the error for a single form value that was rejected without a form struct
+func invalidField(field string, code string, detail string) ErrorResponse {
+	return ErrorResponse{
+		Code:   "validation_failed",
+		Detail: detail,
+		Fields: []FieldError{{Field: field, Code: code}},
+	}
+}
+
+// the error for a form value rejected by Validate.Var
+func invalidVar(field string, err error, detail string) ErrorResponse {
+	code := "invalid"
+	if validationErrs, ok := err.(validator.ValidationErrors); ok && len(validationErrs) > 0 {
+		code = validationErrs[0].Tag()
+	}
+	return invalidField(field, code, detail)
+}
+
+// turns the errors from Validate.Struct into field errors named after
+// the json tags of the form that was validated
+func validationErrors(err error, form interface{}) []FieldError {
+	fieldErrors := []FieldError{}
+
+	validationErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return fieldErrors
+	}
+
+	formType := reflect.TypeOf(form)
+	if formType.Kind() == reflect.Ptr {
+		formType = formType.Elem()
+	}
+
+	for _, fieldErr := range validationErrs {
+		name := fieldErr.Field()
+		if field, ok := formType.FieldByName(fieldErr.StructField()); ok {
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+				name = tag
+			}
+		}
+		fieldErrors = append(fieldErrors, FieldError{
+			Field: name,
+			Code:  fieldErr.Tag(),
+			Param: fieldErr.Param(),
+		})
+	}
+
+	return fieldErrors
+}
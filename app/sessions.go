@@ -0,0 +1,306 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const defaultSessionMaxAge = time.Hour * 5
+
+// last seen is only updated once in this interval so every request
+// doesn't have to write to the database
+const sessionTouchInterval = time.Minute
+
+var ErrUserSessionNotFound = errors.New("user session not found")
+
+// a logged in session as shown to its user
+// the pgstore session id is never exposed since it identifies the cookie
+type UserSession struct {
+	Id        int64     `json:"id"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+	sessionId string
+}
+
+// parses the addresses of trusted proxies, each either an ip like 10.0.0.1
+// or a network like 10.0.0.0/8
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an ip or network", proxy)
+			}
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			bits := 8 * len(ip)
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an ip or network", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (app App) trustedProxy(ip net.IP) bool {
+	for _, network := range app.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the address the request came from. when it came through trusted proxies
+// the client is the last address in X-Forwarded-For that isn't one of them,
+// since anything before that was sent by the client and can't be believed
+func (app App) clientIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !app.trustedProxy(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIp := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIp == nil {
+			break
+		}
+		host = forwardedIp.String()
+		if !app.trustedProxy(forwardedIp) {
+			break
+		}
+	}
+	return host
+}
+
+// records where a new session was created so its user can recognize it
+func (app App) trackSession(ctx context.Context, req *http.Request, sessionId string, username string) error {
+	_, err := app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO UserSessions (session_id, username, ip, user_agent) VALUES ($1, $2, $3, $4)`,
+		sessionId,
+		username,
+		app.clientIp(req),
+		req.UserAgent(),
+	)
+	if err != nil {
+		Sugar.Error("error inserting user session: ", err)
+	}
+	return err
+}
+
+func (app App) touchSession(ctx context.Context, sessionId string) error {
+	_, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE UserSessions SET last_seen = now()
+		WHERE session_id=$1 AND last_seen < $2`,
+		sessionId,
+		time.Now().Add(-sessionTouchInterval),
+	)
+	return err
+}
+
+// returns the user's sessions that haven't expired, marking the one
+// with the current session id
+func (app App) userSessions(ctx context.Context, username string, currentSessionId string) ([]UserSession, error) {
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT us.id, us.session_id, us.created, us.last_seen, us.ip, us.user_agent
+		FROM UserSessions us JOIN http_sessions hs ON hs.key = us.session_id
+		WHERE us.username=$1 AND hs.expires_on > now()
+		ORDER BY us.last_seen DESC`,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error querying user sessions: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	userSessions := []UserSession{}
+	for rows.Next() {
+		var userSession UserSession
+		err = rows.Scan(
+			&userSession.Id,
+			&userSession.sessionId,
+			&userSession.Created,
+			&userSession.LastSeen,
+			&userSession.Ip,
+			&userSession.UserAgent,
+		)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			return nil, err
+		}
+		userSession.Current = userSession.sessionId == currentSessionId
+		userSessions = append(userSessions, userSession)
+	}
+
+	return userSessions, rows.Err()
+}
+
+// deletes the sessions so their cookies stop working and closes any
+// websockets or event streams they opened
+func (app App) revokeSessions(ctx context.Context, username string, sessionIds []string) error {
+	for _, sessionId := range sessionIds {
+		_, err := app.Pg.ExecContext(ctx, `DELETE FROM http_sessions WHERE key=$1`, sessionId)
+		if err != nil {
+			Sugar.Error("error deleting session: ", err)
+			return err
+		}
+		_, err = app.Pg.ExecContext(ctx, `DELETE FROM UserSessions WHERE session_id=$1`, sessionId)
+		if err != nil {
+			Sugar.Error("error deleting user session: ", err)
+			return err
+		}
+
+		// the session's connections could be on any node
+		err = app.Broker.Publish(ctx, BrokerEvent{Kind: BrokerSessionRevoked, User: username, Session: sessionId})
+		if err != nil {
+			Sugar.Error("error publishing revoked session: ", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokes one of the user's sessions by the id shown in their session list
+func (app App) revokeSession(ctx context.Context, username string, id int64) error {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT session_id FROM UserSessions WHERE id=$1 AND username=$2`,
+		id,
+		username,
+	)
+
+	var sessionId string
+	err := row.Scan(&sessionId)
+	if err != nil {
+		return ErrUserSessionNotFound
+	}
+
+	return app.revokeSessions(ctx, username, []string{sessionId})
+}
+
+// revokes every session of the user except the one with the given id
+// an empty id revokes all of them
+func (app App) revokeOtherSessions(ctx context.Context, username string, keepSessionId string) error {
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT session_id FROM UserSessions WHERE username=$1 AND session_id <> $2`,
+		username,
+		keepSessionId,
+	)
+	if err != nil {
+		Sugar.Error("error querying user sessions: ", err)
+		return err
+	}
+
+	var sessionIds []string
+	for rows.Next() {
+		var sessionId string
+		err = rows.Scan(&sessionId)
+		if err != nil {
+			rows.Close()
+			Sugar.Error("err scanning row: ", err)
+			return err
+		}
+		sessionIds = append(sessionIds, sessionId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return app.revokeSessions(ctx, username, sessionIds)
+}
+
+func (app App) ListSessions(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ListSessions")
+	defer span.End()
+
+	auth, _ := authFromContext(req.Context())
+	userSessions, err := app.userSessions(ctx, auth.Username, auth.SessionId)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error getting user sessions")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	err = writeJSON(w, http.StatusOK, userSessions)
+	if err != nil {
+		span.RecordError(err)
+		Sugar.Error("error writing user sessions in response: ", err)
+	}
+}
+
+func (app App) RevokeSession(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "RevokeSession")
+	defer span.End()
+
+	id, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 64)
+	if err != nil {
+		span.SetStatus(codes.Ok, "session id was not a number")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{})
+		return
+	}
+
+	err = app.revokeSession(ctx, currentUser(req), id)
+	if err == ErrUserSessionNotFound {
+		span.SetStatus(codes.Ok, "session not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "session_not_found"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error revoking session")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "session revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app App) RevokeOtherSessions(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "RevokeOtherSessions")
+	defer span.End()
+
+	auth, _ := authFromContext(req.Context())
+	err := app.revokeOtherSessions(ctx, auth.Username, auth.SessionId)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error revoking sessions")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "other sessions revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// the goroutines the app starts for itself, like rooms and account jobs, so
+// they can be told to stop and waited for when the server shuts down
+type Background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewBackground() *Background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Background{ctx: ctx, cancel: cancel}
+}
+
+// runs work in a goroutine. the context is canceled on shutdown and work
+// should return soon after
+func (background *Background) Go(work func(ctx context.Context)) {
+	background.wg.Add(1)
+	go func() {
+		defer background.wg.Done()
+		work(background.ctx)
+	}()
+}
+
+// closed once shutdown has started
+func (background *Background) stopping() <-chan struct{} {
+	return background.ctx.Done()
+}
+
+// cancels the goroutines' context and waits for them to return, or for ctx
+// to be done
+func (background *Background) Stop(ctx context.Context) error {
+	background.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		background.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sends a going away close to every websocket and ends every event and grpc
+// stream, then stops the rooms and background jobs. rooms save the messages
+// they were already handed before they stop. the http and grpc servers should
+// have stopped accepting connections first
+func (app App) Shutdown(ctx context.Context) error {
+	app.clientsMutex.RLock()
+	chatUsers := make([]*User, 0, len(app.Clients))
+	for _, chatUser := range app.Clients {
+		chatUsers = append(chatUsers, chatUser)
+	}
+	app.clientsMutex.RUnlock()
+
+	var closing sync.WaitGroup
+	for _, chatUser := range chatUsers {
+		closing.Add(1)
+		go func(chatUser *User) {
+			defer closing.Done()
+			chatUser.closeAll(CloseServerShutdown, "server shutting down")
+		}(chatUser)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		closing.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		Sugar.Warn("not every connection closed before the shutdown deadline")
+	}
+
+	return app.Background.Stop(ctx)
+}
@@ -1,11 +1,14 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/antonlindstrom/pgstore"
@@ -29,8 +32,42 @@ type App struct {
 	Chatrooms        map[string]*Chatroom
 	Clients          map[string]*User
 	ChatroomChannels map[string]chan MessageWithCtx
-	Tmpl             *template.Template
-	Invitations      *Invitations
+	// guards Chatrooms, Clients, ChatroomChannels and the rooms' Clients,
+	// which requests and broker events change from their own goroutines
+	clientsMutex *sync.RWMutex
+	Tmpl         *template.Template
+	Invitations  *Invitations
+	// how long a login lasts before the user has to log in again
+	SessionMaxAge time.Duration
+	Mailer        Mailer
+	// nil unless users can log in through an OpenID Connect provider
+	OIDC *OIDCProvider
+	// what happens to a user's messages when they delete their account
+	MessageDeletionPolicy MessageDeletionPolicy
+	// how new passwords are hashed
+	Passwords PasswordConfig
+	// how many failed logins lock an account or ip and for how long
+	LoginThrottle LoginThrottleConfig
+	// flags for the session and csrf cookies
+	Cookies CookieConfig
+	// pings and timeouts for websockets
+	Websockets WebsocketConfig
+	// host patterns of the pages allowed to open websockets, like
+	// chat.example.com or *.example.com. the app's own host is always allowed
+	AllowedOrigins []string
+	// reverse proxies whose X-Forwarded-For is believed when finding the
+	// client's ip for login throttling and sessions. none by default
+	TrustedProxies []*net.IPNet
+	// when the routes outside /api/v1 are going away, sent in their Sunset header
+	LegacySunset time.Time
+	// rooms and jobs running in their own goroutines, stopped on shutdown
+	Background *Background
+	// carries room events to the other nodes
+	Broker Broker
+	// requests are checked against the api document when it's loaded
+	Spec *OpenAPI
+	// also check responses against the document, for tests
+	CheckResponses bool
 }
 
 type PgConfig struct {
@@ -46,8 +83,32 @@ type ScyllaConfig struct {
 	Keyspace string
 }
 
-func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
+// what has to differ between nodes when several serve the same databases
+type NodeConfig struct {
+	// message ids are only unique when every node has its own machine id. 0
+	// uses the lower 16 bits of the node's private ip
+	MachineId uint16
+	// carries room events between the nodes, a MemoryBroker when nil
+	Broker Broker
+}
+
+func (config PgConfig) connConfig() pgx.ConnConfig {
+	return pgx.ConnConfig{
+		Host:     config.Host,
+		Port:     config.Port,
+		Database: config.Db,
+		User:     config.User,
+		Password: config.Password,
+	}
+}
+
+func NewApp(pg PgConfig, scy ScyllaConfig, node NodeConfig, templates string) *App {
 	app := new(App)
+	app.Background = NewBackground()
+	app.Broker = node.Broker
+	if app.Broker == nil {
+		app.Broker = NewMemoryBroker()
+	}
 
 	var err error
 	// app.Tmpl, err = template.New("templates").ParseGlob("templates/*.html")
@@ -56,16 +117,21 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 		Sugar.Fatalw("Error instantiating templates: ", err)
 	}
 
-	app.Pg = stdlib.OpenDB(pgx.ConnConfig{
-		Host:     pg.Host,
-		Port:     pg.Port,
-		Database: pg.Db,
-		User:     pg.User,
-		Password: pg.Password,
-	})
+	app.Pg = stdlib.OpenDB(pg.connConfig())
+
+	app.SessionMaxAge = defaultSessionMaxAge
+	// mail is kept in memory until a real mailer is configured
+	app.Mailer = &MemoryMailer{}
+	app.MessageDeletionPolicy = AnonymizeMessages
+	app.Passwords = DefaultPasswordConfig()
+	app.LoginThrottle = DefaultLoginThrottleConfig()
+	app.Cookies = DefaultCookieConfig()
+	app.Websockets = DefaultWebsocketConfig()
+	app.LegacySunset = defaultLegacySunset
 
 	app.Invitations = &Invitations{
-		pg: app.Pg,
+		pg:         app.Pg,
+		CodeConfig: DefaultInviteCodeConfig(),
 	}
 
 	app.PgStore, err = pgstore.NewPGStoreFromPool(app.Pg, []byte(os.Getenv("SESSION_SECRET")))
@@ -86,12 +152,225 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 		Sugar.Fatalw("Problem creating Users table: ", err)
 	}
 
+	// users that signed up before emails were verified are treated as verified
+	// and everyone after starts out unverified
+	_, err = app.Pg.Exec(
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT true`,
+	)
+	if err == nil {
+		_, err = app.Pg.Exec(`ALTER TABLE Users ALTER COLUMN verified SET DEFAULT false`)
+	}
+
+	if err != nil {
+		Sugar.Fatalw("Problem migrating Users table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS TwoFactor (
+			username TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT false,
+			last_step BIGINT NOT NULL DEFAULT 0,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating TwoFactor table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS RecoveryCodes (
+			id serial PRIMARY KEY,
+			username TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT false
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating RecoveryCodes table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS LoginChallenges (
+			id serial PRIMARY KEY,
+			username TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires TIMESTAMPTZ NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			used BOOLEAN NOT NULL DEFAULT false
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating LoginChallenges table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS OIDCLogins (
+			id serial PRIMARY KEY,
+			state_hash TEXT NOT NULL UNIQUE,
+			nonce TEXT NOT NULL,
+			verifier TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires TIMESTAMPTZ NOT NULL
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating OIDCLogins table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS UserIdentities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			username TEXT NOT NULL,
+			email TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (issuer, subject)
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating UserIdentities table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS AccountJobs (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			error TEXT NOT NULL DEFAULT '',
+			result TEXT,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finished TIMESTAMPTZ
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating AccountJobs table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS EmailVerifications (
+			id serial PRIMARY KEY,
+			username TEXT NOT NULL,
+			email TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires TIMESTAMPTZ NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT false
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating EmailVerifications table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS LoginFailures (
+			kind TEXT NOT NULL,
+			key TEXT NOT NULL,
+			failures INTEGER NOT NULL,
+			last_failure TIMESTAMPTZ NOT NULL,
+			locked_until TIMESTAMPTZ,
+			PRIMARY KEY (kind, key)
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating LoginFailures table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS SecurityEvents (
+			id serial PRIMARY KEY,
+			username TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			detail TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating SecurityEvents table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS PreviousUsernames (
+			previous TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			renamed TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating PreviousUsernames table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS UserSessions (
+			id serial PRIMARY KEY,
+			session_id TEXT NOT NULL UNIQUE,
+			username TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating UserSessions table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS PasswordResets (
+			id serial PRIMARY KEY,
+			username TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires TIMESTAMPTZ NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT false
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating PasswordResets table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS ApiTokens (
+			id serial PRIMARY KEY,
+			username TEXT NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_used TIMESTAMPTZ,
+			revoked BOOLEAN NOT NULL DEFAULT false
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating ApiTokens table: ", err)
+	}
+
 	_, err = app.Pg.Exec(
 		`CREATE TABLE IF NOT EXISTS Invites (
 			id serial PRIMARY KEY,
 			invite TEXT NOT NULL,
 			chatroom TEXT NOT NULL,
-			expires TIMESTAMPTZ NOT NULL
+			expires TIMESTAMPTZ NOT NULL,
+			creator TEXT NOT NULL DEFAULT '',
+			max_uses INTEGER NOT NULL DEFAULT 0,
+			uses INTEGER NOT NULL DEFAULT 0,
+			revoked BOOLEAN NOT NULL DEFAULT false
 		)`,
 	)
 
@@ -99,10 +378,63 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 		Sugar.Fatalw("Problem creating Invites table: ", err)
 	}
 
+	// invites tables created before invites could be limited or revoked
+	// won't have these columns
+	_, err = app.Pg.Exec(
+		`ALTER TABLE Invites
+			ADD COLUMN IF NOT EXISTS creator TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS max_uses INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS uses INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS revoked BOOLEAN NOT NULL DEFAULT false`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem migrating Invites table: ", err)
+	}
+
+	// the old generator could hand out the same code twice. a code shared by
+	// several invites couldn't tell them apart anyway, so only the newest
+	// one is kept before codes are made unique
+	_, err = app.Pg.Exec(
+		`DELETE FROM Invites older USING Invites newer
+			WHERE older.invite = newer.invite AND older.id < newer.id`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem removing duplicate invite codes: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE UNIQUE INDEX IF NOT EXISTS invites_invite_key ON Invites (invite)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating unique index on Invites table: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE TABLE IF NOT EXISTS UserInvites (
+			id serial PRIMARY KEY,
+			chatroom TEXT NOT NULL,
+			inviter TEXT NOT NULL,
+			invitee TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires TIMESTAMPTZ NOT NULL,
+			responded TIMESTAMPTZ
+		)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating UserInvites table: ", err)
+	}
+
 	_, err = app.Pg.Exec(
 		`CREATE TABLE IF NOT EXISTS Rooms (
 			id serial PRIMARY KEY,
-			name TEXT NOT NULL
+			name TEXT NOT NULL,
+			owner TEXT NOT NULL DEFAULT '',
+			members_can_invite BOOLEAN NOT NULL DEFAULT true
 		)`,
 	)
 
@@ -110,9 +442,41 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 		Sugar.Fatalw("Problem creating Rooms table: ", err)
 	}
 
+	_, err = app.Pg.Exec(
+		`ALTER TABLE Rooms
+			ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS members_can_invite BOOLEAN NOT NULL DEFAULT true`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem migrating Rooms table: ", err)
+	}
+
+	// creating a room that already existed used to add another row for it.
+	// the first row is the room's real owner, so the later ones are dropped
+	// before names are made unique
+	_, err = app.Pg.Exec(
+		`DELETE FROM Rooms newer USING Rooms older
+			WHERE newer.name = older.name AND newer.id > older.id`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem removing duplicate rooms: ", err)
+	}
+
+	_, err = app.Pg.Exec(
+		`CREATE UNIQUE INDEX IF NOT EXISTS rooms_name_key ON Rooms (name)`,
+	)
+
+	if err != nil {
+		Sugar.Fatalw("Problem creating unique index on Rooms table: ", err)
+	}
+
 	Sugar.Info("Postgres database has been initialized.")
 
-	go RemoveExpiredInvites(app.Pg, time.Minute*10)
+	app.Background.Go(func(ctx context.Context) {
+		RemoveExpiredInvites(ctx, app.Pg, time.Minute*10)
+	})
 
 	// TODO: I think I will have to figure out whether I need to remove this
 	// most likely I will. This should be unnecessary, the keyspace should be
@@ -174,11 +538,18 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 
 	// this will generate unique ids for each message on this
 	// particular server instance
-	app.Snowflake = sonyflake.NewSonyflake(
-		sonyflake.Settings{
-			StartTime: time.Unix(0, 0),
-		},
-	)
+	snowflakeSettings := sonyflake.Settings{
+		StartTime: time.Unix(0, 0),
+	}
+	if node.MachineId != 0 {
+		snowflakeSettings.MachineID = func() (uint16, error) {
+			return node.MachineId, nil
+		}
+	}
+	app.Snowflake = sonyflake.NewSonyflake(snowflakeSettings)
+	if app.Snowflake == nil {
+		Sugar.Warn("No machine id for message ids, messages can't be sent until MACHINE_ID is set")
+	}
 
 	rows, err := app.Pg.Query(
 		`SELECT name FROM Rooms`,
@@ -189,6 +560,7 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 
 	// initialize chatrooms
 	var name string
+	app.clientsMutex = new(sync.RWMutex)
 	app.Chatrooms = make(map[string]*Chatroom)
 	app.ChatroomChannels = make(map[string]chan MessageWithCtx)
 	for rows.Next() {
@@ -197,48 +569,145 @@ func NewApp(pg PgConfig, scy ScyllaConfig, templates string) *App {
 			Sugar.Fatalw("couldn't scan row: ", err)
 		}
 
-		room := NewChatroom()
-		room.Id = name
-		room.ScyllaSession = &app.ScyllaDb
-		room.Snowflake = app.Snowflake
-		room.Clients = []*ChatroomClient{}
-		room.Messages = make([]IncomingMessage, 20)
-		room.Channel = make(chan MessageWithCtx)
-
-		app.Chatrooms[room.Id] = room
-		app.ChatroomChannels[room.Id] = room.Channel
-
-		go room.Run()
+		app.localRoom(name)
 	}
 
 	app.Clients = make(map[string]*User)
 	Sugar.Infow("Chatrooms initialized.")
+
+	err = app.Broker.Subscribe(app.Background.ctx, func(event BrokerEvent) {
+		app.receive(event)
+	})
+	if err != nil {
+		Sugar.Fatal("Could not subscribe to broker events: ", err)
+	}
+
+	app.Background.Go(app.resumeAccountJobs)
 	return app
 }
 
 func (app App) Routes() *chi.Mux {
 	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
 	router.Use(middleware.Logger)
+	router.Use(app.CSRFProtection)
+	read := RequireScope(ScopeRead)
+	write := RequireScope(ScopeWrite)
 	router.Route("/api", func(router chi.Router) {
+		router.Use(app.ValidateRequests)
+		router.Route("/v1", func(router chi.Router) {
+			router.With(app.UserSession, RequireScope(ScopeChat)).Get("/ws", app.OpenWsConnection)
+			// for clients that can't keep a websocket open
+			router.With(app.UserSession, RequireScope(ScopeChat)).Get("/events", app.StreamEvents)
+			router.With(app.UserSession, RequireScope(ScopeChat)).Get("/events/poll", app.PollEvents)
+			router.Route("/rooms", func(router chi.Router) {
+				router.With(app.UserSession, write, app.RequireVerified).Post("/", app.Create)
+				router.With(app.UserSession, read).Get("/{room}/messages", app.GetRoomMessages)
+				router.With(app.UserSession, RequireScope(ScopeChat)).Post("/{room}/messages", app.SendMessage)
+				router.With(app.UserSession, read).Get("/{room}/invites", app.ListInvites)
+				router.With(app.UserSession, write, app.RequireVerified).Post("/{room}/invites", app.CreateInvite)
+				router.With(app.UserSession, write, app.RequireVerified).Post("/{room}/invitations", app.InviteUser)
+				router.With(app.UserSession, write).Patch("/{room}/settings", app.UpdateRoomSettings)
+			})
+			router.Route("/invites", func(router chi.Router) {
+				router.With(app.UserSession, write).Delete("/{code}", app.RevokeInvite)
+				router.With(app.UserSession, write).Post("/{code}/join", app.Join)
+			})
+			router.Route("/auth", func(router chi.Router) {
+				router.Post("/signup", app.SignupJSON)
+				router.Post("/login", app.LoginJSON)
+				router.Post("/login/2fa", app.LoginTwoFactorJSON)
+				router.Post("/logout", app.LogoutJSON)
+			})
+			router.Route("/user", func(router chi.Router) {
+				router.With(app.UserSession, read).Get("/", app.GetUserInfo)
+				router.With(app.UserSession, read).Get("/invitations", app.ListInvitations)
+				router.With(app.UserSession, read).Get("/invitations/sent", app.ListSentInvitations)
+				router.With(app.UserSession, write).Post("/invitations/{id}/accept", app.AcceptInvitation)
+				router.With(app.UserSession, write).Post("/invitations/{id}/decline", app.DeclineInvitation)
+				router.With(app.UserSession, RequireSession).Get("/tokens", app.ListTokens)
+				router.With(app.UserSession, RequireSession).Post("/tokens", app.CreateToken)
+				router.With(app.UserSession, RequireSession).Delete("/tokens/{id}", app.RevokeToken)
+				router.With(app.UserSession, RequireSession).Get("/sessions", app.ListSessions)
+				router.With(app.UserSession, RequireSession).Delete("/sessions", app.RevokeOtherSessions)
+				router.With(app.UserSession, RequireSession).Delete("/sessions/{id}", app.RevokeSession)
+				router.With(app.UserSession, RequireSession).Get("/security-events", app.ListSecurityEvents)
+				router.With(app.UserSession, RequireSession).Post("/2fa/enroll", app.EnrollTwoFactor)
+				router.With(app.UserSession, RequireSession).Post("/2fa/confirm", app.ConfirmTwoFactor)
+				router.With(app.UserSession, RequireSession).Post("/2fa/disable", app.DisableTwoFactor)
+				router.With(app.UserSession, RequireSession).Post("/account/password", app.ChangePassword)
+				router.With(app.UserSession, RequireSession).Post("/account/email", app.ChangeEmail)
+				router.With(app.UserSession, RequireSession).Post("/account/username", app.ChangeUsername)
+				router.With(app.UserSession, RequireSession).Post("/account/export", app.ExportAccount)
+				router.With(app.UserSession, RequireSession).Post("/account/delete", app.DeleteAccount)
+				router.With(app.UserSession, RequireSession).Get("/account/jobs", app.ListAccountJobs)
+				router.Get("/account/jobs/{id}", app.GetAccountJob)
+				router.With(app.UserSession, RequireSession).Get("/account/jobs/{id}/archive", app.DownloadAccountExport)
+				router.With(app.UserSession).Post("/verify/resend", app.ResendVerification)
+			})
+		})
+
+		// the routes from before /api/v1, kept until LegacySunset so
+		// clients can move over at their own pace
+		legacy := app.Deprecated
 		router.With(app.UserSession).Get("/chat", chat)
-		router.With(app.UserSession).Get("/ws", app.OpenWsConnection)
+		router.With(legacy("/api/v1/ws"), app.UserSession, RequireScope(ScopeChat)).Get("/ws", app.OpenWsConnection)
 		router.Route("/room", func(router chi.Router) {
-			// add validation middleware for create
-			router.With(app.UserSession).Post("/create", app.Create)
-			// add validation middleware for join
-			router.With(app.UserSession).Post("/join/*", app.Join)
-			// add validation middleware for invite
-			router.With(app.UserSession).Post("/invite", app.CreateInvite)
-			// add validation middleware for messages
-			router.With(app.UserSession).Post("/messages", app.GetRoomMessages)
+			router.With(legacy("/api/v1/rooms"), app.UserSession, write, app.RequireVerified).Post("/create", app.Create)
+			router.With(legacy("/api/v1/invites/{code}/join"), app.UserSession, write).Post("/join/{code}", app.Join)
+			router.With(legacy("/api/v1/rooms/{room}/invites"), app.UserSession, write, app.RequireVerified).Post("/invite", app.CreateInvite)
+			router.With(legacy("/api/v1/invites/{code}"), app.UserSession, write).Post("/invite/revoke", app.RevokeInvite)
+			router.With(legacy("/api/v1/rooms/{room}/invites"), app.UserSession, read).Get("/invites", app.ListInvites)
+			router.With(legacy("/api/v1/rooms/{room}/settings"), app.UserSession, write).Post("/settings", app.UpdateRoomSettings)
+			router.With(legacy("/api/v1/rooms/{room}/invitations"), app.UserSession, write, app.RequireVerified).Post("/invite/user", app.InviteUser)
+			router.With(legacy("/api/v1/rooms/{room}/messages"), app.UserSession, read).Post("/messages", app.GetRoomMessages)
 			// router.With(auth.UserSession).Post("/delete", chatroom.GetCurrentRoomMessages)
 		})
+		// json equivalents of the form based user endpoints for clients
+		// that aren't rendering the html pages
+		router.Route("/auth", func(router chi.Router) {
+			router.With(legacy("/api/v1/auth/signup")).Post("/signup", app.SignupJSON)
+			router.With(legacy("/api/v1/auth/login")).Post("/login", app.LoginJSON)
+			router.With(legacy("/api/v1/auth/login/2fa")).Post("/login/2fa", app.LoginTwoFactorJSON)
+			router.With(legacy("/api/v1/auth/logout")).Post("/logout", app.LogoutJSON)
+		})
 		router.Route("/user", func(router chi.Router) {
-			router.With(app.UserSession).Post("/chatrooms", app.GetUserInfo)
-			// add validation middleware for signup
+			router.With(legacy("/api/v1/user"), app.UserSession, read).Post("/chatrooms", app.GetUserInfo)
+			router.With(legacy("/api/v1/user/invitations"), app.UserSession, read).Get("/invitations", app.ListInvitations)
+			router.With(legacy("/api/v1/user/invitations/sent"), app.UserSession, read).Get("/invitations/sent", app.ListSentInvitations)
+			router.With(legacy("/api/v1/user/invitations/{id}/accept"), app.UserSession, write).Post("/invitations/{id}/accept", app.AcceptInvitation)
+			router.With(legacy("/api/v1/user/invitations/{id}/decline"), app.UserSession, write).Post("/invitations/{id}/decline", app.DeclineInvitation)
+			// api tokens can only be managed with a session so a leaked
+			// token can't be used to create more of them
+			router.With(legacy("/api/v1/user/tokens"), app.UserSession, RequireSession).Get("/tokens", app.ListTokens)
+			router.With(legacy("/api/v1/user/tokens"), app.UserSession, RequireSession).Post("/tokens", app.CreateToken)
+			router.With(legacy("/api/v1/user/tokens/{id}"), app.UserSession, RequireSession).Post("/tokens/{id}/revoke", app.RevokeToken)
+			router.With(legacy("/api/v1/user/sessions"), app.UserSession, RequireSession).Get("/sessions", app.ListSessions)
+			router.With(legacy("/api/v1/user/sessions/{id}"), app.UserSession, RequireSession).Post("/sessions/{id}/revoke", app.RevokeSession)
+			router.With(legacy("/api/v1/user/sessions"), app.UserSession, RequireSession).Post("/sessions/revoke-others", app.RevokeOtherSessions)
+			router.With(legacy("/api/v1/user/security-events"), app.UserSession, RequireSession).Get("/security-events", app.ListSecurityEvents)
+			router.With(legacy("/api/v1/user/2fa/enroll"), app.UserSession, RequireSession).Post("/2fa/enroll", app.EnrollTwoFactor)
+			router.With(legacy("/api/v1/user/2fa/confirm"), app.UserSession, RequireSession).Post("/2fa/confirm", app.ConfirmTwoFactor)
+			router.With(legacy("/api/v1/user/2fa/disable"), app.UserSession, RequireSession).Post("/2fa/disable", app.DisableTwoFactor)
+			router.With(legacy("/api/v1/user/account/password"), app.UserSession, RequireSession).Post("/account/password", app.ChangePassword)
+			router.With(legacy("/api/v1/user/account/email"), app.UserSession, RequireSession).Post("/account/email", app.ChangeEmail)
+			router.With(legacy("/api/v1/user/account/username"), app.UserSession, RequireSession).Post("/account/username", app.ChangeUsername)
+			router.With(legacy("/api/v1/user/account/export"), app.UserSession, RequireSession).Post("/account/export", app.ExportAccount)
+			router.With(legacy("/api/v1/user/account/delete"), app.UserSession, RequireSession).Post("/account/delete", app.DeleteAccount)
+			router.With(legacy("/api/v1/user/account/jobs"), app.UserSession, RequireSession).Get("/account/jobs", app.ListAccountJobs)
+			router.With(legacy("/api/v1/user/account/jobs/{id}")).Get("/account/jobs/{id}", app.GetAccountJob)
+			router.With(legacy("/api/v1/user/account/jobs/{id}/archive"), app.UserSession, RequireSession).Get("/account/jobs/{id}/archive", app.DownloadAccountExport)
+			router.With(legacy("/api/v1/user/verify/resend"), app.UserSession).Post("/verify/resend", app.ResendVerification)
+			// pages and links followed by browsers aren't versioned
+			router.Get("/verify", app.VerifyEmail)
+			router.Post("/password/forgot", app.ForgotPassword)
+			router.Get("/password/reset", app.ResetPasswordPage)
+			router.Post("/password/reset", app.ResetPassword)
 			router.Post("/signup", app.Signup)
-			// add validation middleware for login
 			router.Post("/login", app.Login)
+			router.Post("/login/2fa", app.LoginTwoFactor)
+			router.Get("/oidc/login", app.OIDCLogin)
+			router.Get("/oidc/callback", app.OIDCCallback)
 			router.With(app.UserSession).Post("/logout", app.Logout)
 			// router.With(auth.UserSession).Get("/", user.GetUser)
 		})
@@ -0,0 +1,448 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// targeted invites that aren't answered within this time expire
+const defaultTargetedInviteExpiry = time.Hour * 24 * 7
+
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+	InvitationExpired  = "expired"
+	// the inviter couldn't invite people to the room anymore when the
+	// invitee tried to accept
+	InvitationRevoked = "revoked"
+)
+
+var ErrInvitationNotFound = errors.New("invitation not found")
+
+// an invite to a room addressed to a particular user, unlike the link
+// based invites which anyone holding the code can use
+type TargetedInvite struct {
+	Id        int64      `json:"id"`
+	Chatroom  string     `json:"chatroom"`
+	Inviter   string     `json:"inviter"`
+	Invitee   string     `json:"invitee"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Expires   time.Time  `json:"expires"`
+	Responded *time.Time `json:"responded"`
+}
+
+// the status column only records what the invitee did, pending invites past
+// their expiry are reported as expired
+const targetedInviteColumns = `id, chatroom, inviter, invitee,
+	CASE WHEN status = 'pending' AND expires <= now() THEN 'expired' ELSE status END,
+	created, expires, responded`
+
+func scanTargetedInvites(rows *sql.Rows) ([]TargetedInvite, error) {
+	defer rows.Close()
+
+	invites := []TargetedInvite{}
+	for rows.Next() {
+		var invite TargetedInvite
+		err := rows.Scan(
+			&invite.Id,
+			&invite.Chatroom,
+			&invite.Inviter,
+			&invite.Invitee,
+			&invite.Status,
+			&invite.Created,
+			&invite.Expires,
+			&invite.Responded,
+		)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}
+
+func (app App) createTargetedInvite(roomName string, inviter string, invitee string) (TargetedInvite, error) {
+	invite := TargetedInvite{
+		Chatroom: roomName,
+		Inviter:  inviter,
+		Invitee:  invitee,
+		Status:   InvitationPending,
+	}
+
+	row := app.Pg.QueryRow(
+		`INSERT INTO UserInvites (chatroom, inviter, invitee, expires)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created, expires`,
+		roomName,
+		inviter,
+		invitee,
+		time.Now().Add(defaultTargetedInviteExpiry),
+	)
+	err := row.Scan(&invite.Id, &invite.Created, &invite.Expires)
+	if err != nil {
+		Sugar.Error("error inserting targeted invite: ", err)
+		return TargetedInvite{}, err
+	}
+
+	return invite, nil
+}
+
+// checks whether the user already has an invite to the room they haven't answered
+func (app App) hasPendingInvite(roomName string, invitee string) (bool, error) {
+	row := app.Pg.QueryRow(
+		`SELECT EXISTS (
+			SELECT 1 FROM UserInvites
+			WHERE chatroom=$1 AND invitee=$2 AND status='pending' AND expires > now()
+		)`,
+		roomName,
+		invitee,
+	)
+
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+// the invite addressed to the invitee if they haven't answered it and it
+// hasn't expired
+func (app App) pendingInvitation(ctx context.Context, id int64, invitee string) (TargetedInvite, error) {
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT `+targetedInviteColumns+` FROM UserInvites
+		WHERE id=$1 AND invitee=$2 AND status='pending' AND expires > now()`,
+		id,
+		invitee,
+	)
+	if err != nil {
+		Sugar.Error("error querying targeted invite: ", err)
+		return TargetedInvite{}, err
+	}
+
+	invites, err := scanTargetedInvites(rows)
+	if err != nil {
+		return TargetedInvite{}, err
+	}
+	if len(invites) == 0 {
+		return TargetedInvite{}, ErrInvitationNotFound
+	}
+
+	return invites[0], nil
+}
+
+// marks a pending invite addressed to the invitee as accepted, declined or revoked
+// and returns it
+func (app App) respondToInvite(id int64, invitee string, status string) (TargetedInvite, error) {
+	rows, err := app.Pg.Query(
+		`UPDATE UserInvites SET status=$1, responded=now()
+		WHERE id=$2 AND invitee=$3 AND status='pending' AND expires > now()
+		RETURNING `+targetedInviteColumns,
+		status,
+		id,
+		invitee,
+	)
+	if err != nil {
+		Sugar.Error("error responding to targeted invite: ", err)
+		return TargetedInvite{}, err
+	}
+
+	invites, err := scanTargetedInvites(rows)
+	if err != nil {
+		return TargetedInvite{}, err
+	}
+	if len(invites) == 0 {
+		return TargetedInvite{}, ErrInvitationNotFound
+	}
+
+	return invites[0], nil
+}
+
+func userExists(ctx context.Context, db *sql.DB, username string) (bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM Users WHERE username=$1)`,
+		username,
+	)
+
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+func (app App) InviteUser(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "InviteUser")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for invite user: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error parsing form for invite user")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	roomName := roomParam(req)
+	invitee := req.FormValue("username")
+
+	username := currentUser(req)
+
+	allowed, err := app.canInvite(ctx, username, roomName)
+	if err == ErrRoomNotFound {
+		span.SetStatus(codes.Ok, "room not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "room_not_found"})
+		return
+	} else if err != nil {
+		Sugar.Error("error checking invite permission: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error checking invite permission")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if !allowed {
+		span.SetStatus(codes.Ok, "user is not allowed to invite people to room")
+		writeError(w, req, http.StatusForbidden, ErrorResponse{Code: "invite_forbidden"})
+		return
+	}
+
+	exists, err := userExists(ctx, app.Pg, invitee)
+	if err != nil {
+		Sugar.Error("error checking invitee exists: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error checking invitee exists")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if !exists {
+		span.SetStatus(codes.Ok, "invitee not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "user_not_found"})
+		return
+	}
+
+	member, err := isRoomMember(ctx, app.ScyllaDb, invitee, roomName)
+	if err != nil {
+		Sugar.Error("error checking invitee membership: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error checking invitee membership")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if member {
+		span.SetStatus(codes.Ok, "invitee is already a member")
+		writeError(w, req, http.StatusConflict, ErrorResponse{Code: "already_member"})
+		return
+	}
+
+	pending, err := app.hasPendingInvite(roomName, invitee)
+	if err != nil {
+		Sugar.Error("error checking for pending invites: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error checking for pending invites")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if pending {
+		span.SetStatus(codes.Ok, "invitee already has a pending invite")
+		writeError(w, req, http.StatusConflict, ErrorResponse{Code: "already_invited"})
+		return
+	}
+
+	invite, err := app.createTargetedInvite(roomName, username, invitee)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error creating targeted invite")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	// the invitee will still find the invite in their pending invitations
+	// if they aren't connected
+	err = app.notifyUser(ctx, invitee, InvitationEvent{Type: InvitationEventType, Invitation: invite})
+	if err != nil {
+		span.RecordError(err)
+		Sugar.Error("error notifying invitee: ", err)
+	}
+
+	inviteJson, err := json.Marshal(invite)
+	if err != nil {
+		Sugar.Error("error marshalling targeted invite: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error marshalling targeted invite")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "user invited")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(inviteJson)
+}
+
+// lists the invites addressed to the user that they haven't answered yet
+func (app App) ListInvitations(w http.ResponseWriter, req *http.Request) {
+	app.listTargetedInvites(w, req, "ListInvitations",
+		`SELECT `+targetedInviteColumns+` FROM UserInvites
+		WHERE invitee=$1 AND status='pending' AND expires > now()
+		ORDER BY created DESC`,
+	)
+}
+
+// lists every invite the user has sent along with whether it was answered
+func (app App) ListSentInvitations(w http.ResponseWriter, req *http.Request) {
+	app.listTargetedInvites(w, req, "ListSentInvitations",
+		`SELECT `+targetedInviteColumns+` FROM UserInvites
+		WHERE inviter=$1
+		ORDER BY created DESC`,
+	)
+}
+
+func (app App) listTargetedInvites(w http.ResponseWriter, req *http.Request, spanName string, stmt string) {
+	ctx, span := otel.Tracer("").Start(req.Context(), spanName)
+	defer span.End()
+
+	username := currentUser(req)
+
+	rows, err := app.Pg.QueryContext(ctx, stmt, username)
+	if err != nil {
+		Sugar.Error("error querying targeted invites: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error querying targeted invites")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	invites, err := scanTargetedInvites(rows)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error scanning targeted invites")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	invitesJson, err := json.Marshal(invites)
+	if err != nil {
+		Sugar.Error("error marshalling targeted invites: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error marshalling targeted invites")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(invitesJson)
+}
+
+func (app App) AcceptInvitation(w http.ResponseWriter, req *http.Request) {
+	app.respondToInvitation(w, req, InvitationAccepted)
+}
+
+func (app App) DeclineInvitation(w http.ResponseWriter, req *http.Request) {
+	app.respondToInvitation(w, req, InvitationDeclined)
+}
+
+func (app App) respondToInvitation(w http.ResponseWriter, req *http.Request, status string) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "RespondToInvitation")
+	defer span.End()
+
+	id, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 64)
+	if err != nil {
+		span.SetStatus(codes.Ok, "invitation id was not a number")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{})
+		return
+	}
+
+	username := currentUser(req)
+
+	// the room's owner could have stopped members inviting people, or the
+	// inviter could have left, since the invitation was sent
+	if status == InvitationAccepted {
+		invite, err := app.pendingInvitation(ctx, id, username)
+		if err == ErrInvitationNotFound {
+			span.SetStatus(codes.Ok, "no pending invitation found")
+			writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "invitation_not_found"})
+			return
+		} else if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "error getting invitation")
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
+		}
+
+		allowed, err := app.canInvite(ctx, invite.Inviter, invite.Chatroom)
+		if err == ErrRoomNotFound {
+			span.SetStatus(codes.Ok, "room not found")
+			writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "room_not_found"})
+			return
+		} else if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "error checking inviter permissions")
+			writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+			return
+		}
+		if !allowed {
+			_, err = app.respondToInvite(id, username, InvitationRevoked)
+			if err != nil && err != ErrInvitationNotFound {
+				span.RecordError(err)
+			}
+			span.SetStatus(codes.Ok, "inviter can no longer invite people")
+			writeError(w, req, http.StatusGone, ErrorResponse{
+				Code:   "invitation_revoked",
+				Detail: "The inviter can no longer invite people to this room",
+			})
+			return
+		}
+	}
+
+	invite, err := app.respondToInvite(id, username, status)
+	if err == ErrInvitationNotFound {
+		span.SetStatus(codes.Ok, "no pending invitation found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "invitation_not_found"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error responding to invitation")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	if status == InvitationDeclined {
+		span.SetStatus(codes.Ok, "invitation declined")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = app.joinRoom(ctx, username, invite.Chatroom)
+	if err != nil {
+		Sugar.Error("error adding chatroom to user: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error adding chatroom to user")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	name, err := json.Marshal(invite.Chatroom)
+	if err != nil {
+		Sugar.Error(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error masharlling chatroom name")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "invitation accepted")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(name)
+}
@@ -0,0 +1,292 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// every api token starts with this so they are easy to recognize
+// when they leak into logs or source code
+const tokenPrefix = "chat_"
+
+var (
+	ErrInvalidToken  = errors.New("api token is invalid or revoked")
+	ErrTokenNotFound = errors.New("api token not found")
+)
+
+// a personal access token bots and scripts use instead of a session cookie
+// only a hash of the token is stored, the token itself is shown once
+// when it is created
+type ApiToken struct {
+	Id       int64      `json:"id"`
+	Name     string     `json:"name"`
+	Username string     `json:"-"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+type NewApiToken struct {
+	Name   string   `validate:"required,max=50"`
+	Scopes []string `validate:"required,min=1,dive,oneof=read write chat"`
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// returns a url safe string made from 32 random bytes
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func generateToken() (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return tokenPrefix + token, nil
+}
+
+// creates a token for the user and returns it along with the token itself
+func (app App) createToken(ctx context.Context, username string, newToken NewApiToken) (ApiToken, string, error) {
+	token, err := generateToken()
+	if err != nil {
+		Sugar.Error("error generating api token: ", err)
+		return ApiToken{}, "", err
+	}
+
+	apiToken := ApiToken{
+		Name:     newToken.Name,
+		Username: username,
+		Scopes:   newToken.Scopes,
+	}
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`INSERT INTO ApiTokens (username, name, token_hash, scopes)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created`,
+		username,
+		newToken.Name,
+		hashToken(token),
+		strings.Join(newToken.Scopes, ","),
+	)
+	err = row.Scan(&apiToken.Id, &apiToken.Created)
+	if err != nil {
+		Sugar.Error("error inserting api token: ", err)
+		return ApiToken{}, "", err
+	}
+
+	return apiToken, token, nil
+}
+
+// looks up the token and records that it was used
+func (app App) authenticateToken(ctx context.Context, token string) (ApiToken, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return ApiToken{}, ErrInvalidToken
+	}
+
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`UPDATE ApiTokens SET last_used = now()
+		WHERE token_hash=$1 AND NOT revoked
+		RETURNING id, name, username, scopes, created, last_used`,
+		hashToken(token),
+	)
+
+	var apiToken ApiToken
+	var scopes string
+	err := row.Scan(
+		&apiToken.Id,
+		&apiToken.Name,
+		&apiToken.Username,
+		&scopes,
+		&apiToken.Created,
+		&apiToken.LastUsed,
+	)
+	if err == sql.ErrNoRows {
+		return ApiToken{}, ErrInvalidToken
+	} else if err != nil {
+		Sugar.Error("error looking up api token: ", err)
+		return ApiToken{}, err
+	}
+	apiToken.Scopes = strings.Split(scopes, ",")
+
+	return apiToken, nil
+}
+
+func (app App) userTokens(ctx context.Context, username string) ([]ApiToken, error) {
+	rows, err := app.Pg.QueryContext(
+		ctx,
+		`SELECT id, name, scopes, created, last_used FROM ApiTokens
+		WHERE username=$1 AND NOT revoked
+		ORDER BY created DESC`,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error querying api tokens: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ApiToken{}
+	for rows.Next() {
+		apiToken := ApiToken{Username: username}
+		var scopes string
+		err = rows.Scan(&apiToken.Id, &apiToken.Name, &scopes, &apiToken.Created, &apiToken.LastUsed)
+		if err != nil {
+			Sugar.Error("err scanning row: ", err)
+			return nil, err
+		}
+		apiToken.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, apiToken)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (app App) revokeToken(ctx context.Context, username string, id int64) error {
+	result, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE ApiTokens SET revoked = true WHERE id=$1 AND username=$2 AND NOT revoked`,
+		id,
+		username,
+	)
+	if err != nil {
+		Sugar.Error("error revoking api token: ", err)
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+func (app App) CreateToken(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "CreateToken")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for create token: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error parsing form for create token")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	// scopes can be sent as repeated fields or a single comma separated one
+	var scopes []string
+	for _, value := range req.PostForm["scopes"] {
+		for _, scope := range strings.Split(value, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	newToken := NewApiToken{
+		Name:   req.PostFormValue("name"),
+		Scopes: scopes,
+	}
+
+	err = Validate.Struct(newToken)
+	if err != nil {
+		span.SetStatus(codes.Ok, "token was not valid")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, newToken),
+		})
+		return
+	}
+
+	apiToken, token, err := app.createToken(ctx, currentUser(req), newToken)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error creating api token")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "api token created")
+	err = writeJSON(w, http.StatusCreated, struct {
+		ApiToken
+		// only ever returned here
+		Token string `json:"token"`
+	}{apiToken, token})
+	if err != nil {
+		span.RecordError(err)
+		Sugar.Error("error writing api token in response: ", err)
+	}
+}
+
+func (app App) ListTokens(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ListTokens")
+	defer span.End()
+
+	tokens, err := app.userTokens(ctx, currentUser(req))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error getting api tokens")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	err = writeJSON(w, http.StatusOK, tokens)
+	if err != nil {
+		span.RecordError(err)
+		Sugar.Error("error writing api tokens in response: ", err)
+	}
+}
+
+func (app App) RevokeToken(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "RevokeToken")
+	defer span.End()
+
+	id, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 64)
+	if err != nil {
+		span.SetStatus(codes.Ok, "token id was not a number")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{})
+		return
+	}
+
+	err = app.revokeToken(ctx, currentUser(req), id)
+	if err == ErrTokenNotFound {
+		span.SetStatus(codes.Ok, "api token not found")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{Code: "token_not_found"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error revoking api token")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "api token revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 time based one time passwords with the parameters every
+// authenticator app supports: HMAC-SHA1, 6 digits and 30 second steps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// how many steps before and after the current one are accepted so
+	// slightly wrong clocks still work
+	totpSkew = 1
+	// shown as the account's issuer in authenticator apps
+	totpIssuer = "Chat App"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// returns a random 160 bit secret encoded the way authenticator apps expect it
+func newTotpSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// the RFC 4226 HOTP value for the counter
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// checks the code against the steps around now and returns the step it
+// matched. steps at or before lastStep were already used and are rejected
+func validateTotp(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// the otpauth:// uri authenticator apps read from a qr code
+func totpUri(account string, secret string) string {
+	label := url.PathEscape(totpIssuer) + ":" + url.PathEscape(account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
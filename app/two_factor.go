@@ -0,0 +1,715 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	recoveryCodeCount = 10
+	// how long the user has to enter their code after their password
+	loginChallengeExpiry = time.Minute * 5
+	// wrong codes allowed before the user has to enter their password again
+	maxLoginChallengeAttempts = 5
+)
+
+var (
+	ErrTwoFactorNotEnrolled  = errors.New("two factor authentication has not been enrolled")
+	ErrTwoFactorEnabled      = errors.New("two factor authentication is already enabled")
+	ErrInvalidTwoFactorCode  = errors.New("two factor code is incorrect or was already used")
+	ErrInvalidLoginChallenge = errors.New("login challenge is invalid, expired or already used")
+)
+
+type TwoFactorCode struct {
+	Code string `form:"code" json:"code" validate:"required,max=20"`
+}
+
+type TwoFactorLogin struct {
+	Challenge string `form:"challenge" json:"challenge" validate:"required"`
+	Code      string `form:"code" json:"code" validate:"required,max=20"`
+}
+
+type DisableTwoFactor struct {
+	Password string `form:"password" json:"password" validate:"required,min=8,max=50"`
+	Code     string `form:"code" json:"code" validate:"required,max=20"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+func (app App) twoFactorEnabled(ctx context.Context, username string) (bool, error) {
+	row := app.Pg.QueryRowContext(ctx, `SELECT enabled FROM TwoFactor WHERE username=$1`, username)
+	var enabled bool
+	err := row.Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		Sugar.Error("err getting two factor status: ", err)
+		return false, err
+	}
+	return enabled, nil
+}
+
+// stores a new secret for the user. enrolling again before confirming
+// replaces the old secret
+func (app App) enrollTwoFactor(ctx context.Context, username string) (string, error) {
+	secret, err := newTotpSecret()
+	if err != nil {
+		Sugar.Error("error generating totp secret: ", err)
+		return "", err
+	}
+
+	result, err := app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO TwoFactor (username, secret) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET secret = EXCLUDED.secret, last_step = 0, created = now()
+		WHERE NOT TwoFactor.enabled`,
+		username,
+		secret,
+	)
+	if err != nil {
+		Sugar.Error("error enrolling two factor: ", err)
+		return "", err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return "", ErrTwoFactorEnabled
+	}
+
+	return secret, nil
+}
+
+// checks a totp code for the user and marks its step as used so
+// the same code can't be used twice
+func (app App) useTotp(ctx context.Context, username string, code string, enabled bool) error {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`SELECT secret, last_step FROM TwoFactor WHERE username=$1 AND enabled=$2`,
+		username,
+		enabled,
+	)
+	var secret string
+	var lastStep int64
+	err := row.Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrTwoFactorNotEnrolled
+	} else if err != nil {
+		Sugar.Error("err getting totp secret: ", err)
+		return err
+	}
+
+	step, ok := validateTotp(secret, code, time.Now(), lastStep)
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+
+	// another request could have used the same code in the meantime
+	result, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE TwoFactor SET last_step=$2 WHERE username=$1 AND last_step < $2`,
+		username,
+		step,
+	)
+	if err != nil {
+		Sugar.Error("error updating totp step: ", err)
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+// recovery codes are shown as two groups of five so they're easier to copy
+// but are checked without the dash and in any case
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	recoveryCodes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		code, err := randomString(readableAlphabet, 10)
+		if err != nil {
+			return nil, err
+		}
+		recoveryCodes[i] = string(code[:5]) + "-" + string(code[5:])
+	}
+	return recoveryCodes, nil
+}
+
+func (app App) useRecoveryCode(ctx context.Context, username string, code string) error {
+	result, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE RecoveryCodes SET used = true WHERE username=$1 AND code_hash=$2 AND NOT used`,
+		username,
+		hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		Sugar.Error("error using recovery code: ", err)
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// accepts either a code from the user's authenticator app or one
+// of their recovery codes
+func (app App) checkSecondFactor(ctx context.Context, username string, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		err := app.useTotp(ctx, username, code, true)
+		if err == ErrTwoFactorNotEnrolled {
+			return ErrInvalidTwoFactorCode
+		}
+		return err
+	}
+	return app.useRecoveryCode(ctx, username, code)
+}
+
+// enables two factor authentication once the user has shown their app
+// produces valid codes and returns the recovery codes
+func (app App) confirmTwoFactor(ctx context.Context, username string, code string) ([]string, error) {
+	err := app.useTotp(ctx, username, strings.TrimSpace(code), false)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		Sugar.Error("error generating recovery codes: ", err)
+		return nil, err
+	}
+
+	tx, err := app.Pg.BeginTx(ctx, nil)
+	if err != nil {
+		Sugar.Error("error starting transaction: ", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE TwoFactor SET enabled = true WHERE username=$1`, username)
+	if err != nil {
+		Sugar.Error("error enabling two factor: ", err)
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM RecoveryCodes WHERE username=$1`, username)
+	if err != nil {
+		Sugar.Error("error deleting recovery codes: ", err)
+		return nil, err
+	}
+	for _, recoveryCode := range recoveryCodes {
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO RecoveryCodes (username, code_hash) VALUES ($1, $2)`,
+			username,
+			hashToken(normalizeRecoveryCode(recoveryCode)),
+		)
+		if err != nil {
+			Sugar.Error("error inserting recovery code: ", err)
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		Sugar.Error("error committing two factor confirmation: ", err)
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+func (app App) disableTwoFactor(ctx context.Context, username string) error {
+	tx, err := app.Pg.BeginTx(ctx, nil)
+	if err != nil {
+		Sugar.Error("error starting transaction: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM TwoFactor WHERE username=$1`, username)
+	if err != nil {
+		Sugar.Error("error deleting two factor: ", err)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM RecoveryCodes WHERE username=$1`, username)
+	if err != nil {
+		Sugar.Error("error deleting recovery codes: ", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checks the password of a user who is already logged in before changes
+// that need it. wrong passwords count as failed logins, so a stolen session
+// can't be used to guess the password
+func (app App) checkPassword(ctx context.Context, username string, password string, ip string) error {
+	row := app.Pg.QueryRowContext(ctx, `SELECT email, password FROM Users WHERE username=$1`, username)
+	var email, hash string
+	err := row.Scan(&email, &hash)
+	if err == sql.ErrNoRows {
+		return ErrInvalidCredentials
+	} else if err != nil {
+		Sugar.Error("err getting password hash: ", err)
+		return err
+	}
+
+	retryAfter, err := app.loginLockout(ctx, email, ip)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		return &LoginThrottledError{RetryAfter: retryAfter}
+	}
+
+	ok, _, err := app.Passwords.verify(hash, password)
+	if err != nil {
+		Sugar.Error("err verifying password: ", err)
+		return err
+	}
+	if !ok {
+		err = app.recordLoginFailure(ctx, email, username, ip)
+		if err != nil {
+			return err
+		}
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// returns the user's email after checking that logins for it and from the ip
+// aren't locked. wrong codes count as failed logins, so asking for fresh
+// challenges doesn't give more guesses at the code
+func (app App) secondFactorLockout(ctx context.Context, username string, ip string) (string, error) {
+	row := app.Pg.QueryRowContext(ctx, `SELECT email FROM Users WHERE username=$1`, username)
+	var email string
+	err := row.Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidLoginChallenge
+	} else if err != nil {
+		Sugar.Error("err getting user email: ", err)
+		return "", err
+	}
+
+	retryAfter, err := app.loginLockout(ctx, email, ip)
+	if err != nil {
+		return "", err
+	}
+	if retryAfter > 0 {
+		return "", &LoginThrottledError{RetryAfter: retryAfter}
+	}
+	return email, nil
+}
+
+// remembers that the user got their password right so the session is only
+// started once they also enter their second factor. a LoginThrottledError is
+// returned while the user's logins are locked
+func (app App) createLoginChallenge(ctx context.Context, username string, ip string) (string, error) {
+	_, err := app.secondFactorLockout(ctx, username, ip)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		Sugar.Error("error generating login challenge: ", err)
+		return "", err
+	}
+
+	_, err = app.Pg.ExecContext(
+		ctx,
+		`INSERT INTO LoginChallenges (username, token_hash, expires) VALUES ($1, $2, $3)`,
+		username,
+		hashToken(token),
+		time.Now().Add(loginChallengeExpiry),
+	)
+	if err != nil {
+		Sugar.Error("error inserting login challenge: ", err)
+		return "", err
+	}
+
+	return token, nil
+}
+
+// checks the code for the challenge's user and returns the user if it was right.
+// wrong codes are counted against the user's email and the ip like wrong
+// passwords, and a LoginThrottledError is returned once either is locked
+func (app App) completeLoginChallenge(ctx context.Context, challenge string, code string, ip string) (string, error) {
+	row := app.Pg.QueryRowContext(
+		ctx,
+		`UPDATE LoginChallenges SET attempts = attempts + 1
+		WHERE token_hash=$1 AND NOT used AND expires > now() AND attempts < $2
+		RETURNING id, username`,
+		hashToken(challenge),
+		maxLoginChallengeAttempts,
+	)
+	var id int64
+	var username string
+	err := row.Scan(&id, &username)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidLoginChallenge
+	} else if err != nil {
+		Sugar.Error("error getting login challenge: ", err)
+		return "", err
+	}
+
+	email, err := app.secondFactorLockout(ctx, username, ip)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.checkSecondFactor(ctx, username, code)
+	if err == ErrInvalidTwoFactorCode {
+		failureErr := app.recordLoginFailure(ctx, email, username, ip)
+		if failureErr != nil {
+			return "", failureErr
+		}
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+
+	result, err := app.Pg.ExecContext(
+		ctx,
+		`UPDATE LoginChallenges SET used = true WHERE id=$1 AND NOT used`,
+		id,
+	)
+	if err != nil {
+		Sugar.Error("error using login challenge: ", err)
+		return "", err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return "", ErrInvalidLoginChallenge
+	}
+
+	app.clearLoginFailures(ctx, email)
+	return username, nil
+}
+
+func (app App) EnrollTwoFactor(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "EnrollTwoFactor")
+	defer span.End()
+
+	username := currentUser(req)
+	secret, err := app.enrollTwoFactor(ctx, username)
+	if err == ErrTwoFactorEnabled {
+		span.SetStatus(codes.Ok, "Two factor already enabled.")
+		writeError(w, req, http.StatusConflict, ErrorResponse{
+			Code:   "two_factor_enabled",
+			Detail: "Disable two factor authentication before enrolling again",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error enrolling two factor.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Two factor enrolled.")
+	writeJSON(w, http.StatusOK, TwoFactorEnrollment{
+		Secret: secret,
+		Uri:    totpUri(username, secret),
+	})
+}
+
+func (app App) ConfirmTwoFactor(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "ConfirmTwoFactor")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for confirm two factor: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form TwoFactorCode
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	recoveryCodes, err := app.confirmTwoFactor(ctx, currentUser(req), form.Code)
+	if err == ErrTwoFactorNotEnrolled {
+		span.SetStatus(codes.Ok, "Two factor not enrolled.")
+		writeError(w, req, http.StatusNotFound, ErrorResponse{
+			Code:   "two_factor_not_enrolled",
+			Detail: "Enroll before confirming two factor authentication",
+		})
+		return
+	} else if err == ErrInvalidTwoFactorCode {
+		span.SetStatus(codes.Ok, "Invalid two factor code.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_code"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error confirming two factor.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Two factor enabled.")
+	writeJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{recoveryCodes})
+}
+
+func (app App) DisableTwoFactor(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "DisableTwoFactor")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		Sugar.Error("error parsing form for disable two factor: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error parsing form.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	var form DisableTwoFactor
+	err = Decoder.Decode(&form, req.PostForm)
+	if err == nil {
+		err = Validate.Struct(form)
+	}
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	username := currentUser(req)
+	err = app.checkPassword(ctx, username, form.Password, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many wrong passwords.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_attempts",
+			Detail: "Too many wrong passwords, try again later",
+		})
+		return
+	} else if err == ErrInvalidCredentials {
+		span.SetStatus(codes.Ok, "Incorrect password.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{
+			Code:   "invalid_credentials",
+			Detail: "Password is incorrect",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking password.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	err = app.checkSecondFactor(ctx, username, form.Code)
+	if err == ErrInvalidTwoFactorCode {
+		span.SetStatus(codes.Ok, "Invalid two factor code.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{Code: "invalid_code"})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking two factor code.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	err = app.disableTwoFactor(ctx, username)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error disabling two factor.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Two factor disabled.")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// the second step of the login form for users with two factor enabled
+func (app App) LoginTwoFactor(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "LoginTwoFactor")
+	defer span.End()
+
+	err := req.ParseForm()
+	if err != nil {
+		span.RecordError(err)
+		Sugar.Error("err parsing form data: ", err)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error parsing form data.")
+		return
+	}
+
+	var form TwoFactorLogin
+	err = Decoder.Decode(&form, req.PostForm)
+	if err != nil {
+		span.RecordError(err)
+		Sugar.Error("err decoding post form: ", err)
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error parsing form data.")
+		return
+	}
+
+	username, err := app.completeLoginChallenge(ctx, form.Challenge, form.Code, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many failed logins.")
+		err = app.renderLoginError(w, http.StatusTooManyRequests, "Too many failed logins, try again later")
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	} else if err == ErrInvalidTwoFactorCode {
+		w.WriteHeader(http.StatusOK)
+		span.SetStatus(codes.Ok, "Invalid two factor code.")
+		err = app.Tmpl.ExecuteTemplate(w, "login_2fa.html", struct {
+			Challenge    string
+			ErrorMessage string
+		}{form.Challenge, "Code is incorrect"})
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	} else if err == ErrInvalidLoginChallenge {
+		// start over from the password
+		w.WriteHeader(http.StatusOK)
+		span.SetStatus(codes.Ok, "Invalid login challenge.")
+		err = app.Tmpl.ExecuteTemplate(w, "login.html", struct {
+			Email        string
+			ErrorMessage string
+		}{"", "Login expired, try again"})
+		if err != nil {
+			Sugar.Error("error executing template: ", err)
+			span.RecordError(err)
+		}
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error checking two factor code.")
+		return
+	}
+
+	err = app.startSession(w, req, username)
+	if err != nil {
+		span.RecordError(err)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		span.SetStatus(codes.Error, "Error saving session to DB.")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Successfully logged in.")
+	http.Redirect(w, req, "/chat", http.StatusSeeOther)
+}
+
+func (app App) LoginTwoFactorJSON(w http.ResponseWriter, req *http.Request) {
+	ctx, span := otel.Tracer("").Start(req.Context(), "LoginTwoFactorJSON")
+	defer span.End()
+
+	var form TwoFactorLogin
+	if !decodeJSONForm(w, req, &form) {
+		span.SetStatus(codes.Ok, "Error decoding json.")
+		return
+	}
+
+	err := Validate.Struct(form)
+	if err != nil {
+		span.SetStatus(codes.Ok, "Error validating form.")
+		writeError(w, req, http.StatusBadRequest, ErrorResponse{
+			Code:   "validation_failed",
+			Fields: validationErrors(err, form),
+		})
+		return
+	}
+
+	username, err := app.completeLoginChallenge(ctx, form.Challenge, form.Code, app.clientIp(req))
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		setRetryAfter(w, throttled.RetryAfter)
+		span.SetStatus(codes.Ok, "Too many failed logins.")
+		writeError(w, req, http.StatusTooManyRequests, ErrorResponse{
+			Code:   "too_many_attempts",
+			Detail: "Too many failed logins, try again later",
+		})
+		return
+	} else if err == ErrInvalidTwoFactorCode {
+		span.SetStatus(codes.Ok, "Invalid two factor code.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{Code: "invalid_code"})
+		return
+	} else if err == ErrInvalidLoginChallenge {
+		span.SetStatus(codes.Ok, "Invalid login challenge.")
+		writeError(w, req, http.StatusUnauthorized, ErrorResponse{
+			Code:   "invalid_challenge",
+			Detail: "Login expired, log in with your password again",
+		})
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking two factor code.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+
+	err = app.startSession(w, req, username)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error saving session to DB.")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{Code: "internal_error"})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Successfully logged in.")
+	writeJSON(w, http.StatusOK, struct {
+		Username string `json:"username"`
+	}{username})
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/scylladb/gocqlx/v2"
 	"github.com/sony/sonyflake"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
-	"nhooyr.io/websocket"
 )
 
 type IncomingMessage struct {
@@ -31,14 +32,18 @@ type TestMessage struct {
 }
 
 type User struct {
-	Conn      *websocket.Conn
 	Id        string
 	Chatrooms []string
+	// nil until the user opens their first connection
+	Events *EventQueue
+	// the websockets and event streams the user has open
+	Connections []*Connection
+	mutex       sync.Mutex
 }
 
 type ChatroomClient struct {
-	Conn *websocket.Conn
-	Id   string
+	Events *EventQueue
+	Id     string
 }
 
 type UserChatrooms struct {
@@ -69,6 +74,36 @@ func getUserChatrooms(
 	return chatrooms, nil
 }
 
+func isRoomMember(ctx context.Context, session gocqlx.Session, username string, roomName string) (bool, error) {
+	stmt := "SELECT chatroom FROM users WHERE user = ? AND chatroom = ?;"
+	values := []string{"user", "chatroom"}
+	query := session.Query(stmt, values)
+	query.Bind(username, roomName)
+
+	var chatroom string
+	err := query.GetRelease(&chatroom)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		Sugar.Error("Error checking chatroom membership: ", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// records that the user is a member of the room and makes it their current room
+func addUserChatroom(ctx context.Context, session gocqlx.Session, username string, roomName string) error {
+	newRoomForUser := UserChatrooms{
+		User:            username,
+		CurrentChatroom: roomName,
+		Chatroom:        roomName,
+	}
+
+	query := session.Query(userTable.Insert()).BindStruct(newRoomForUser)
+	return query.ExecRelease()
+}
+
 func getUserCurrentRoom(ctx context.Context, session gocqlx.Session, username string) (string, error) {
 	stmt := "SELECT current_chatroom FROM users WHERE user = ? LIMIT 1;"
 	values := []string{"user"}
@@ -92,21 +127,10 @@ func (app App) GetUserInfo(writer http.ResponseWriter, req *http.Request) {
 
 	Sugar.Info("Getting user chatrooms")
 
-	session, err := app.PgStore.Get(req, "session-name")
-	if err != nil {
-		span.RecordError(err)
-		Sugar.Error("error getting session name: ", err)
-		span.SetStatus(codes.Error, "error getting session name")
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	Sugar.Info(session)
-
-	username := session.Values["username"].(string)
+	username := currentUser(req)
 	Sugar.Info(username)
 
-	var chatrooms []string
-	chatrooms, err = getUserChatrooms(ctx, app.ScyllaDb, username)
+	chatrooms, err := getUserChatrooms(ctx, app.ScyllaDb, username)
 	if err != nil {
 		span.RecordError(err)
 		if err.Error() == "not found" {
@@ -115,7 +139,7 @@ func (app App) GetUserInfo(writer http.ResponseWriter, req *http.Request) {
 			Sugar.Errorf("Error getting user chatrooms: %v", err)
 			span.RecordError(err)
 			span.SetStatus(codes.Error, "error getting user chatrooms")
-			writer.WriteHeader(http.StatusInternalServerError)
+			writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
 			return
 		}
 	}
@@ -130,7 +154,7 @@ func (app App) GetUserInfo(writer http.ResponseWriter, req *http.Request) {
 			Sugar.Errorf("Error getting current user chatroom: %v", err)
 			span.RecordError(err)
 			span.SetStatus(codes.Error, "error getting current user chatroom")
-			writer.WriteHeader(http.StatusInternalServerError)
+			writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
 			return
 		}
 	}
@@ -146,53 +170,85 @@ func (app App) GetUserInfo(writer http.ResponseWriter, req *http.Request) {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "error marhaslling row data")
 		Sugar.Error("Error marshalling row data: ", err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeError(writer, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
 
 	span.SetStatus(codes.Ok, "")
+	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	writer.Write(rowsJson)
 }
 
 func (app App) GetRoomMessages(w http.ResponseWriter, req *http.Request) {
-	_, span := otel.Tracer("").Start(req.Context(), "GetRoomMessages")
+	ctx, span := otel.Tracer("").Start(req.Context(), "GetRoomMessages")
 	defer span.End()
 
-	session, err := app.PgStore.Get(req, "session-name")
-	if err != nil {
-		Sugar.Error("error getting session name: ", err)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "error getting session name")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	err = req.ParseForm()
+	err := req.ParseForm()
 	if err != nil {
 		Sugar.Error("err parsing form data: ", err)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "error parsing form")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
 		return
 	}
 
-	roomName := req.PostFormValue("chatroom_name")
+	roomName := roomParam(req)
 	if roomName == "" {
 		room_messages := []string{}
 		rowsJson, err := json.Marshal(room_messages)
 		if err != nil {
 			Sugar.Error("Error marshalling row data: ", err)
 		}
-		w.Write(rowsJson)
 		span.SetStatus(codes.Ok, "")
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		w.Write(rowsJson)
 		return
 	}
 
-	username := session.Values["username"].(string)
+	username := currentUser(req)
 	Sugar.Info(roomName)
 	Sugar.Info(username)
+	member, err := isRoomMember(ctx, app.ScyllaDb, username, roomName)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error checking chatroom membership")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	if !member {
+		span.SetStatus(codes.Ok, "user is not a member of the room")
+		writeError(w, req, http.StatusForbidden, ErrorResponse{
+			Code:   "not_room_member",
+			Detail: "Only members of the room can read its messages",
+		})
+		return
+	}
+	roomMessages, err := app.roomMessages(roomName)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error closing interator for chatroom messages")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+	rowsJson, err := json.Marshal(roomMessages)
+	if err != nil {
+		Sugar.Error("Error marshalling row data: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Error marshalling messages into Json")
+		writeError(w, req, http.StatusInternalServerError, ErrorResponse{})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rowsJson)
+}
+
+// the messages saved for the room, oldest first
+func (app App) roomMessages(roomName string) ([]OutgoingMessage, error) {
 	stmt := "SELECT * FROM messages WHERE chatroom_name = ?;"
 	values := []string{"chatroom_name"}
 	query := app.ScyllaDb.Query(stmt, values)
@@ -214,21 +270,8 @@ func (app App) GetRoomMessages(w http.ResponseWriter, req *http.Request) {
 	}
 	if err := iter.Close(); err != nil {
 		Sugar.Error("Error closing iterator for chatroom messages: ", err)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "Error closing interator for chatroom messages")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	rowsJson, err := json.Marshal(roomMessages)
-	if err != nil {
-		Sugar.Error("Error marshalling row data: ", err)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "Error marshalling messages into Json")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	span.SetStatus(codes.Ok, "")
-	w.WriteHeader(http.StatusOK)
-	w.Write(rowsJson)
+	return roomMessages, nil
 }
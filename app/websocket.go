@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// the close codes the server ends websockets with, so clients can tell why
+// they were disconnected. codes from 4000 up are the app's own
+const (
+	// the server is restarting or shutting down, reconnecting later works
+	CloseServerShutdown = websocket.StatusGoingAway
+	// the client sent a frame that isn't a json or protobuf message
+	CloseProtocolError websocket.StatusCode = 4000
+	// the session was logged out or revoked, or the account was deleted.
+	// reconnecting needs a new login
+	CloseSessionRevoked websocket.StatusCode = 4001
+	// an admin ended the user's connections, reconnecting is allowed
+	CloseKicked websocket.StatusCode = 4002
+	// the account was banned, reconnecting won't work
+	CloseBanned websocket.StatusCode = 4003
+	// a ping went unanswered or the client was quiet for too long
+	CloseTimeout websocket.StatusCode = 4004
+)
+
+// how the server notices websockets that have gone away without closing,
+// like half open tcp connections, so they don't stay connected forever
+type WebsocketConfig struct {
+	// how often the server pings, 0 to never ping
+	PingInterval time.Duration
+	// how long a ping waits for its pong before the websocket is closed
+	ReadTimeout time.Duration
+	// how long a websocket can go without the client sending a message,
+	// 0 to allow it forever
+	IdleTimeout time.Duration
+}
+
+func DefaultWebsocketConfig() WebsocketConfig {
+	return WebsocketConfig{
+		PingInterval: 30 * time.Second,
+		ReadTimeout:  10 * time.Second,
+		IdleTimeout:  time.Hour,
+	}
+}
+
+func (config WebsocketConfig) Validate() error {
+	if config.PingInterval < 0 || config.IdleTimeout < 0 {
+		return errors.New("websocket ping interval and idle timeout can't be negative")
+	}
+	if config.PingInterval > 0 && config.ReadTimeout <= 0 {
+		return errors.New("websocket read timeout must be positive when pings are sent")
+	}
+	return nil
+}
+
+// pings the websocket every interval until the context is done. a ping that
+// isn't answered in time closes the connection, which ends its read loop
+func (config WebsocketConfig) heartbeat(ctx context.Context, conn *websocket.Conn) {
+	if config.PingInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, config.ReadTimeout)
+		err := conn.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				Sugar.Info("websocket did not answer a ping: ", err)
+				conn.Close(CloseTimeout, "ping timeout")
+			}
+			return
+		}
+	}
+}
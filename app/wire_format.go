@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// how events are encoded on a connection
+type WireFormat string
+
+const (
+	JSONFormat WireFormat = "json"
+	// the ChatEvent message in proto/chat.proto, without its id
+	ProtobufFormat WireFormat = "protobuf"
+)
+
+// the websocket subprotocols clients can ask for to pick a format. websockets
+// opened without one get json
+const (
+	JSONSubprotocol     = "chat.v1.json"
+	ProtobufSubprotocol = "chat.v1.protobuf"
+)
+
+// in the order the server prefers them when a client offers more than one
+var wireSubprotocols = []string{ProtobufSubprotocol, JSONSubprotocol}
+
+func subprotocolFormat(subprotocol string) WireFormat {
+	if subprotocol == ProtobufSubprotocol {
+		return ProtobufFormat
+	}
+	return JSONFormat
+}
+
+// the websocket frame type the format is sent in
+func (format WireFormat) messageType() websocket.MessageType {
+	if format == ProtobufFormat {
+		return websocket.MessageBinary
+	}
+	return websocket.MessageText
+}
+
+// an OutgoingMessage or InvitationEvent that's being sent to one or more
+// users. rooms push the same payload onto every member's queue, so each
+// format is only encoded once however many connections it's written to
+type Payload struct {
+	Value   interface{}
+	mutex   sync.Mutex
+	encoded map[WireFormat][]byte
+}
+
+func NewPayload(value interface{}) *Payload {
+	return &Payload{Value: value, encoded: make(map[WireFormat][]byte)}
+}
+
+// the value in the format, encoding it the first time it's asked for
+func (payload *Payload) Encode(format WireFormat) ([]byte, error) {
+	payload.mutex.Lock()
+	defer payload.mutex.Unlock()
+
+	if data, ok := payload.encoded[format]; ok {
+		return data, nil
+	}
+
+	var data []byte
+	var err error
+	switch format {
+	case JSONFormat:
+		data, err = json.Marshal(payload.Value)
+	case ProtobufFormat:
+		event := chatEvent(0, payload.Value)
+		if event == nil {
+			return nil, fmt.Errorf("%T has no protobuf encoding", payload.Value)
+		}
+		data = event.marshalProto()
+	default:
+		return nil, fmt.Errorf("unknown wire format %v", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload.encoded[format] = data
+	return data, nil
+}
@@ -165,6 +165,7 @@ class Main extends React.Component {
         let jsonPayload = await fetch("/api/room/create", {
             method: "POST",
             mode: "same-origin",
+            headers: { "X-CSRF-Token": window.csrfToken() },
             body: formData,
         }).catch((err) => console.log(err));
         let chatroomId = await jsonPayload.json().catch((err) => console.log(err));
@@ -204,6 +205,7 @@ class Main extends React.Component {
         // and all the names of the chatrooms their user belongs to
         const response = await fetch("/api/user/chatrooms", {
             method: 'POST',
+            headers: { 'X-CSRF-Token': window.csrfToken() },
             // mode: 'same-origin',
             // mode: "cors",
             // credentials: 'include',
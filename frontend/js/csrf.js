@@ -0,0 +1,27 @@
+// Requests that change anything have to send back the csrf-token cookie the
+// server sets, either in the X-CSRF-Token header or a csrf_token form field.
+function csrfToken() {
+  const cookie = document.cookie
+    .split('; ')
+    .find((row) => row.startsWith('csrf-token='));
+  return cookie ? decodeURIComponent(cookie.split('=')[1]) : '';
+}
+
+window.csrfToken = csrfToken;
+
+// Adds the token to every form as it's submitted, before the form's own
+// submit handlers build their requests from it.
+document.addEventListener('submit', (event) => {
+  const form = event.target;
+  if (form.method.toLowerCase() !== 'post') {
+    return;
+  }
+  let input = form.querySelector('input[name="csrf_token"]');
+  if (!input) {
+    input = document.createElement('input');
+    input.type = 'hidden';
+    input.name = 'csrf_token';
+    form.appendChild(input);
+  }
+  input.value = csrfToken();
+}, true);
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -25,6 +29,10 @@ import (
 
 const addr = ":8000"
 
+const defaultGrpcAddr = ":9000"
+
+const defaultShutdownTimeout = 30 * time.Second
+
 var tp *sdktrace.TracerProvider
 
 func main() {
@@ -79,7 +87,217 @@ func main() {
 		Keyspace: scyllaKeyspace,
 	}
 
-	application := app.NewApp(pgConfig, scyConfig, "templates/*.html")
+	// nodes serving the same databases each need their own machine id and
+	// a broker shared with the others
+	nodeConfig := app.NodeConfig{}
+	if machineIdStr, ok := os.LookupEnv("MACHINE_ID"); ok {
+		machineId, err := strconv.ParseUint(machineIdStr, 10, 16)
+		if err != nil || machineId == 0 {
+			app.Sugar.Fatalf("MACHINE_ID must be a number from 1 to 65535. %v", machineIdStr)
+		}
+		nodeConfig.MachineId = uint16(machineId)
+	}
+	switch broker := os.Getenv("BROKER"); broker {
+	case "", "memory":
+	case "postgres":
+		nodeConfig.Broker = app.NewPgBroker(pgConfig)
+	default:
+		app.Sugar.Fatalf("BROKER must be memory or postgres. %v", broker)
+	}
+
+	application := app.NewApp(pgConfig, scyConfig, nodeConfig, "templates/*.html")
+
+	if sessionMaxAgeStr, ok := os.LookupEnv("SESSION_MAX_AGE"); ok {
+		sessionMaxAge, err := time.ParseDuration(sessionMaxAgeStr)
+		if err != nil {
+			app.Sugar.Fatalf("Could not convert SESSION_MAX_AGE to a duration. %v", sessionMaxAgeStr)
+		}
+		application.SessionMaxAge = sessionMaxAge
+	}
+
+	// mail goes to an smtp server when one is configured, otherwise it is
+	// written to files so it can be read while developing
+	mailFrom, ok := os.LookupEnv("MAIL_FROM")
+	if !ok {
+		mailFrom = "chat-app@localhost"
+	}
+	if smtpAddr, ok := os.LookupEnv("SMTP_ADDR"); ok {
+		mailer := app.SMTPMailer{
+			Addr: smtpAddr,
+			From: mailFrom,
+		}
+		if smtpUser, ok := os.LookupEnv("SMTP_USER"); ok {
+			smtpHost, _, err := net.SplitHostPort(smtpAddr)
+			if err != nil {
+				app.Sugar.Fatalf("Could not get host from SMTP_ADDR. %v", smtpAddr)
+			}
+			mailer.Auth = smtp.PlainAuth("", smtpUser, os.Getenv("SMTP_PASSWORD"), smtpHost)
+		}
+		application.Mailer = mailer
+	} else {
+		mailDir, ok := os.LookupEnv("MAIL_DIR")
+		if !ok {
+			mailDir = "./mail"
+		}
+		app.Sugar.Warnf("SMTP_ADDR is not set, mail will be written to %v", mailDir)
+		application.Mailer = app.FileMailer{
+			Dir:  mailDir,
+			From: mailFrom,
+		}
+	}
+
+	// invite codes are random letters and digits unless configured otherwise
+	if inviteFormat, ok := os.LookupEnv("INVITE_CODE_FORMAT"); ok {
+		inviteLength := 0
+		if inviteLengthStr, ok := os.LookupEnv("INVITE_CODE_LENGTH"); ok {
+			inviteLength, err = strconv.Atoi(inviteLengthStr)
+			if err != nil {
+				app.Sugar.Fatalf("Could not convert INVITE_CODE_LENGTH to a number. %v", inviteLengthStr)
+			}
+		}
+		codeConfig, err := app.NewInviteCodeConfig(
+			app.InviteCodeFormat(inviteFormat),
+			inviteLength,
+			os.Getenv("INVITE_CODE_ALPHABET"),
+		)
+		if err != nil {
+			app.Sugar.Fatal("Invalid invite code configuration: ", err)
+		}
+		application.Invitations.CodeConfig = codeConfig
+	}
+
+	// deleted users' messages are anonymized unless configured otherwise
+	if policy, ok := os.LookupEnv("MESSAGE_DELETION_POLICY"); ok {
+		switch app.MessageDeletionPolicy(policy) {
+		case app.DeleteMessages, app.AnonymizeMessages:
+			application.MessageDeletionPolicy = app.MessageDeletionPolicy(policy)
+		default:
+			app.Sugar.Fatalf("MESSAGE_DELETION_POLICY must be delete or anonymize. %v", policy)
+		}
+	}
+
+	if algorithm, ok := os.LookupEnv("PASSWORD_HASH"); ok {
+		application.Passwords.Algorithm = app.PasswordAlgorithm(algorithm)
+	}
+	if costStr, ok := os.LookupEnv("BCRYPT_COST"); ok {
+		cost, err := strconv.Atoi(costStr)
+		if err != nil {
+			app.Sugar.Fatalf("Could not convert BCRYPT_COST to a number. %v", costStr)
+		}
+		application.Passwords.BcryptCost = cost
+	}
+	err = application.Passwords.Validate()
+	if err != nil {
+		app.Sugar.Fatal("Invalid password hashing configuration: ", err)
+	}
+
+	if secure, ok := os.LookupEnv("COOKIE_SECURE"); ok {
+		application.Cookies.Secure, err = strconv.ParseBool(secure)
+		if err != nil {
+			app.Sugar.Fatalf("COOKIE_SECURE must be true or false. %v", secure)
+		}
+	}
+	if sameSite, ok := os.LookupEnv("COOKIE_SAMESITE"); ok {
+		switch strings.ToLower(sameSite) {
+		case "lax":
+			application.Cookies.SameSite = http.SameSiteLaxMode
+		case "strict":
+			application.Cookies.SameSite = http.SameSiteStrictMode
+		case "none":
+			application.Cookies.SameSite = http.SameSiteNoneMode
+		default:
+			app.Sugar.Fatalf("COOKIE_SAMESITE must be lax, strict or none. %v", sameSite)
+		}
+	}
+	application.Cookies.Domain = os.Getenv("COOKIE_DOMAIN")
+	err = application.Cookies.Validate()
+	if err != nil {
+		app.Sugar.Fatal("Invalid cookie configuration: ", err)
+	}
+
+	// websockets are pinged so connections that went away without closing
+	// are noticed
+	for name, setting := range map[string]*time.Duration{
+		"WS_PING_INTERVAL": &application.Websockets.PingInterval,
+		"WS_READ_TIMEOUT":  &application.Websockets.ReadTimeout,
+		"WS_IDLE_TIMEOUT":  &application.Websockets.IdleTimeout,
+	} {
+		if durationStr, ok := os.LookupEnv(name); ok {
+			*setting, err = time.ParseDuration(durationStr)
+			if err != nil {
+				app.Sugar.Fatalf("Could not convert %v to a duration. %v", name, durationStr)
+			}
+		}
+	}
+	err = application.Websockets.Validate()
+	if err != nil {
+		app.Sugar.Fatal("Invalid websocket configuration: ", err)
+	}
+
+	if origins, ok := os.LookupEnv("ALLOWED_ORIGINS"); ok {
+		for _, origin := range strings.Split(origins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				application.AllowedOrigins = append(application.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	if proxies, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		var addresses []string
+		for _, proxy := range strings.Split(proxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				addresses = append(addresses, proxy)
+			}
+		}
+		application.TrustedProxies, err = app.ParseTrustedProxies(addresses)
+		if err != nil {
+			app.Sugar.Fatal("Invalid TRUSTED_PROXIES: ", err)
+		}
+	}
+
+	if sunsetStr, ok := os.LookupEnv("LEGACY_API_SUNSET"); ok {
+		sunset, err := time.Parse("2006-01-02", sunsetStr)
+		if err != nil {
+			app.Sugar.Fatalf("LEGACY_API_SUNSET must be a date like 2027-04-19. %v", sunsetStr)
+		}
+		application.LegacySunset = sunset
+	}
+
+	// users can also log in through an OpenID Connect provider when one is configured
+	if oidcIssuer, ok := os.LookupEnv("OIDC_ISSUER"); ok {
+		oidcClientId, ok := os.LookupEnv("OIDC_CLIENT_ID")
+		if !ok {
+			app.Sugar.Fatal("OIDC_ISSUER is set but OIDC_CLIENT_ID is not")
+		}
+		oidcRedirectUrl, ok := os.LookupEnv("OIDC_REDIRECT_URL")
+		if !ok {
+			oidcRedirectUrl = "http://localhost:8000/api/user/oidc/callback"
+		}
+		application.OIDC = app.NewOIDCProvider(app.OIDCConfig{
+			Issuer:       oidcIssuer,
+			ClientId:     oidcClientId,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectUrl:  oidcRedirectUrl,
+			Scopes:       []string{"openid", "email", "profile"},
+		})
+	}
+	// how long open connections, rooms and jobs get to finish on SIGTERM
+	shutdownTimeout := defaultShutdownTimeout
+	if shutdownTimeoutStr, ok := os.LookupEnv("SHUTDOWN_TIMEOUT"); ok {
+		shutdownTimeout, err = time.ParseDuration(shutdownTimeoutStr)
+		if err != nil {
+			app.Sugar.Fatalf("Could not convert SHUTDOWN_TIMEOUT to a duration. %v", shutdownTimeoutStr)
+		}
+	}
+
+	// requests to documented endpoints are checked against the api docs
+	// before reaching their handlers
+	spec, err := app.LoadOpenAPI("api.yaml")
+	if err != nil {
+		app.Sugar.Fatal("Could not load api.yaml: ", err)
+	}
+	application.Spec = spec
+
 	tracerCleanup := initTracer()
 	defer tracerCleanup()
 
@@ -89,12 +307,74 @@ func main() {
 
 	routes := application.Routes()
 	FileServer(routes, "/", http.Dir("./frontend"))
-	err = http.ListenAndServe(addr, routes)
 
+	// the grpc api in proto/chat.proto is served on its own port
+	grpcAddr, ok := os.LookupEnv("GRPC_ADDR")
+	if !ok {
+		grpcAddr = defaultGrpcAddr
+	}
+	grpcListener, err := net.Listen("tcp", grpcAddr)
 	if err != nil {
-		app.Sugar.Fatal("error starting server: ", err)
+		app.Sugar.Fatalf("Could not listen on GRPC_ADDR %v: %v", grpcAddr, err)
 	}
+	grpcServer := application.GrpcServer()
+	go func() {
+		err := grpcServer.Serve(grpcListener)
+		if err != nil {
+			app.Sugar.Error("error serving grpc: ", err)
+		}
+	}()
+
+	server := &http.Server{Addr: addr, Handler: routes}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			app.Sugar.Fatal("error starting server: ", err)
+		}
+	}()
 	app.Sugar.Info("Starting server.")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	app.Sugar.Info("Shutting down.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdown(ctx, application, server, grpcServer)
+}
+
+// stops both servers from taking new connections while the app closes the
+// ones that are open and stops its rooms and jobs, giving up at ctx's deadline
+func shutdown(ctx context.Context, application *app.App, server *http.Server, grpcServer *grpc.Server) {
+	httpStopped := make(chan error, 1)
+	go func() {
+		// waits for requests in progress, including event streams, which
+		// end when the app closes its connections
+		httpStopped <- server.Shutdown(ctx)
+	}()
+	grpcStopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(grpcStopped)
+	}()
+
+	err := application.Shutdown(ctx)
+	if err != nil {
+		app.Sugar.Error("error stopping background jobs: ", err)
+	}
+
+	err = <-httpStopped
+	if err != nil {
+		app.Sugar.Error("error shutting down http server: ", err)
+	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		app.Sugar.Error("grpc server did not stop in time")
+		grpcServer.Stop()
+	}
+	app.Sugar.Info("Server stopped.")
 }
 
 func FileServer(r chi.Router, path string, root http.FileSystem) {